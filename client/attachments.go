@@ -0,0 +1,155 @@
+package client
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/n0madic/go-poe/types"
+)
+
+// mergeAttachment applies a later file event for the same inline_ref on top of
+// an earlier one. Empty fields in the update keep their previous values.
+func mergeAttachment(prev *types.Attachment, update types.Attachment) types.Attachment {
+	merged := *prev
+	if update.URL != "" {
+		merged.URL = update.URL
+	}
+	if update.ContentType != "" {
+		merged.ContentType = update.ContentType
+	}
+	if update.Name != "" {
+		merged.Name = update.Name
+	}
+	if update.ParsedContent != nil {
+		merged.ParsedContent = update.ParsedContent
+	}
+	return merged
+}
+
+// CoalesceAttachments collapses attachments sharing an inline_ref into a single
+// entry holding the latest values, in order of first appearance.
+// Bots may stream an attachment by emitting several file events with the same
+// inline_ref; each event updates the previous one. Attachments without an
+// inline_ref are returned unchanged.
+func CoalesceAttachments(attachments []types.Attachment) []types.Attachment {
+	result := make([]types.Attachment, 0, len(attachments))
+	byRef := make(map[string]int)
+	for _, att := range attachments {
+		if att.InlineRef == nil {
+			result = append(result, att)
+			continue
+		}
+		if i, ok := byRef[*att.InlineRef]; ok {
+			result[i] = mergeAttachment(&result[i], att)
+			continue
+		}
+		byRef[*att.InlineRef] = len(result)
+		result = append(result, att)
+	}
+	return result
+}
+
+// AttachmentIndex collects streamed attachments keyed by inline_ref. Later
+// file events for the same inline_ref update the earlier attachment.
+// It is safe for concurrent use.
+type AttachmentIndex struct {
+	mu    sync.RWMutex
+	byRef map[string]types.Attachment
+	order []string
+}
+
+// NewAttachmentIndex returns an empty AttachmentIndex
+func NewAttachmentIndex() *AttachmentIndex {
+	return &AttachmentIndex{byRef: make(map[string]types.Attachment)}
+}
+
+// Add records att under its inline_ref and returns the merged attachment.
+// Attachments without an inline_ref are returned unchanged and not recorded.
+func (x *AttachmentIndex) Add(att types.Attachment) types.Attachment {
+	if att.InlineRef == nil {
+		return att
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	ref := *att.InlineRef
+	if prev, ok := x.byRef[ref]; ok {
+		att = mergeAttachment(&prev, att)
+	} else {
+		x.order = append(x.order, ref)
+	}
+	x.byRef[ref] = att
+	return att
+}
+
+// Get returns the attachment recorded for an inline_ref
+func (x *AttachmentIndex) Get(ref string) (types.Attachment, bool) {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	att, ok := x.byRef[ref]
+	return att, ok
+}
+
+// Map returns a copy of the attachments keyed by inline_ref
+func (x *AttachmentIndex) Map() map[string]types.Attachment {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	m := make(map[string]types.Attachment, len(x.byRef))
+	for ref, att := range x.byRef {
+		m[ref] = att
+	}
+	return m
+}
+
+// Attachments returns the recorded attachments in order of first appearance
+func (x *AttachmentIndex) Attachments() []types.Attachment {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	atts := make([]types.Attachment, 0, len(x.order))
+	for _, ref := range x.order {
+		atts = append(atts, x.byRef[ref])
+	}
+	return atts
+}
+
+// Resolve is ResolveInlineRefs with the recorded attachments
+func (x *AttachmentIndex) Resolve(text string) string {
+	return ResolveInlineRefs(text, x.Attachments())
+}
+
+// inlineRefPattern matches [label][ref] and ![label][ref] references
+var inlineRefPattern = regexp.MustCompile(`(!?)\[([^\]]*)\]\[([^\]]+)\]`)
+
+// ResolveInlineRefs replaces [label][ref] references to attachments by their
+// inline_ref with markdown links to the attachment URLs, so the text no longer
+// depends on the attachments. Image attachments become images. References to
+// unknown inline_refs are left unchanged; an empty label falls back to the
+// attachment name.
+func ResolveInlineRefs(text string, attachments []types.Attachment) string {
+	byRef := make(map[string]types.Attachment)
+	for _, att := range CoalesceAttachments(attachments) {
+		if att.InlineRef != nil && att.URL != "" {
+			byRef[*att.InlineRef] = att
+		}
+	}
+	if len(byRef) == 0 {
+		return text
+	}
+
+	return inlineRefPattern.ReplaceAllStringFunc(text, func(match string) string {
+		groups := inlineRefPattern.FindStringSubmatch(match)
+		att, ok := byRef[groups[3]]
+		if !ok {
+			return match
+		}
+		label := groups[2]
+		if label == "" {
+			label = att.Name
+		}
+		prefix := ""
+		if groups[1] == "!" || strings.HasPrefix(att.ContentType, "image/") {
+			prefix = "!"
+		}
+		return prefix + "[" + label + "](" + att.URL + ")"
+	})
+}
@@ -0,0 +1,67 @@
+package client
+
+import (
+	"context"
+	"math"
+	"math/rand/v2"
+	"time"
+)
+
+// BackoffStrategy computes the delay before a retry. attempt is 0 for the
+// delay after the first failed try; base is StreamRequestOptions.RetrySleepTime.
+type BackoffStrategy interface {
+	NextDelay(attempt int, base time.Duration) time.Duration
+}
+
+// ExponentialBackoff doubles the delay on every retry and adds random jitter
+// of up to ±25%, so retrying clients don't hit a struggling bot in lockstep.
+// Cap the delay with StreamRequestOptions.MaxRetrySleepTime.
+type ExponentialBackoff struct{}
+
+// exponentialJitter is the maximum jitter as a fraction of the delay
+const exponentialJitter = 0.25
+
+// NextDelay returns base * 2^attempt with jitter applied, capped at the
+// largest time.Duration
+func (ExponentialBackoff) NextDelay(attempt int, base time.Duration) time.Duration {
+	if attempt > 30 {
+		attempt = 30 // avoid overflowing the shift
+	}
+	delay := float64(base) * float64(int64(1)<<attempt)
+	delay *= 1 + exponentialJitter*(2*rand.Float64()-1)
+	if delay >= math.MaxInt64 {
+		return math.MaxInt64
+	}
+	return time.Duration(delay)
+}
+
+// retryDelay returns the delay before the retry following attempt
+func (o *StreamRequestOptions) retryDelay(attempt int) time.Duration {
+	delay := o.RetrySleepTime
+	if o.BackoffStrategy != nil {
+		delay = o.BackoffStrategy.NextDelay(attempt, o.RetrySleepTime)
+	}
+	if o.MaxRetrySleepTime > 0 && delay > o.MaxRetrySleepTime {
+		delay = o.MaxRetrySleepTime
+	}
+	return delay
+}
+
+// attemptTimeout returns the timeout of try attempt from RequestTimeout and
+// RequestTimeoutFunc (0 means no limit)
+func (o *StreamRequestOptions) attemptTimeout(attempt int) time.Duration {
+	if o.RequestTimeoutFunc != nil {
+		return o.RequestTimeoutFunc(attempt, o.RequestTimeout)
+	}
+	return o.RequestTimeout
+}
+
+// attemptContext returns the context for try attempt, bounded by
+// attemptTimeout
+func (o *StreamRequestOptions) attemptContext(ctx context.Context, attempt int) (context.Context, context.CancelFunc) {
+	timeout := o.attemptTimeout(attempt)
+	if timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, timeout)
+}
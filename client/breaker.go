@@ -0,0 +1,141 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// CircuitBreaker stops calling a dependency bot after repeated failures.
+// After Threshold consecutive failures within Window, requests to that bot
+// are rejected with a *BotError for Cooldown. Once the cooldown has passed
+// one trial request is let through, and others are rejected while it is in
+// flight: success closes the breaker, failure opens it again.
+//
+// Only transport errors, 5xx responses and expired per-try deadlines count as
+// failures; error events and other errors caused by the request don't. A
+// CircuitBreaker is safe for concurrent use and is typically shared across
+// requests via StreamRequestOptions.CircuitBreaker.
+type CircuitBreaker struct {
+	Threshold int
+	Window    time.Duration
+	Cooldown  time.Duration
+
+	mu     sync.Mutex
+	states map[string]*breakerState
+	clock  clock
+}
+
+type breakerState struct {
+	failures     int
+	firstFailure time.Time
+	openUntil    time.Time
+	halfOpen     bool
+	// probing is set while the trial request of a half-open breaker is in
+	// flight
+	probing bool
+}
+
+// NewCircuitBreaker creates a CircuitBreaker with the given thresholds
+func NewCircuitBreaker(threshold int, window, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		Threshold: threshold,
+		Window:    window,
+		Cooldown:  cooldown,
+		states:    make(map[string]*breakerState),
+		clock:     realClock{},
+	}
+}
+
+func (cb *CircuitBreaker) state(botName string) *breakerState {
+	if cb.states == nil {
+		cb.states = make(map[string]*breakerState)
+	}
+	if cb.clock == nil {
+		cb.clock = realClock{}
+	}
+	st, ok := cb.states[botName]
+	if !ok {
+		st = &breakerState{}
+		cb.states[botName] = st
+	}
+	return st
+}
+
+// Allow returns a *BotError if the breaker for botName is open
+func (cb *CircuitBreaker) Allow(botName string) error {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	st := cb.state(botName)
+	if st.halfOpen {
+		if st.probing {
+			return &BotError{Message: fmt.Sprintf(
+				"circuit breaker half-open for bot %s: a trial request is in flight", botName)}
+		}
+		st.probing = true
+		return nil
+	}
+	if st.openUntil.IsZero() {
+		return nil
+	}
+	now := cb.clock.Now()
+	if now.Before(st.openUntil) {
+		return &BotError{Message: fmt.Sprintf(
+			"circuit breaker open for bot %s: retry after %s", botName, st.openUntil.Sub(now).Round(time.Millisecond))}
+	}
+	// Cooldown passed: let a trial request through
+	st.openUntil = time.Time{}
+	st.halfOpen = true
+	st.probing = true
+	return nil
+}
+
+// recordAbandoned ends a request to botName that neither succeeded nor
+// failed, e.g. because the caller cancelled it. A trial request of a
+// half-open breaker is then given to the next caller.
+func (cb *CircuitBreaker) recordAbandoned(botName string) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.state(botName).probing = false
+}
+
+// isUnavailable reports whether err says the bot could not be reached or
+// failed with a 5xx response
+func isUnavailable(err error) bool {
+	var botErr *BotError
+	return errors.As(err, &botErr) && botErr.unavailable
+}
+
+// RecordSuccess resets the failure count for botName
+func (cb *CircuitBreaker) RecordSuccess(botName string) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	*cb.state(botName) = breakerState{}
+}
+
+// RecordFailure counts a failure for botName and opens the breaker when the
+// threshold is reached
+func (cb *CircuitBreaker) RecordFailure(botName string) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	st := cb.state(botName)
+	now := cb.clock.Now()
+	if st.halfOpen {
+		*st = breakerState{openUntil: now.Add(cb.Cooldown)}
+		return
+	}
+	if st.failures == 0 || (cb.Window > 0 && now.Sub(st.firstFailure) > cb.Window) {
+		st.failures = 0
+		st.firstFailure = now
+	}
+	st.failures++
+	if cb.Threshold > 0 && st.failures >= cb.Threshold {
+		*st = breakerState{openUntil: now.Add(cb.Cooldown)}
+	}
+}
+
+// Reset closes the breaker for botName
+func (cb *CircuitBreaker) Reset(botName string) {
+	cb.RecordSuccess(botName)
+}
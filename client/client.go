@@ -3,11 +3,14 @@ package client
 import (
 	"context"
 	"encoding/json"
-	"log"
+	"errors"
+	"fmt"
 	"net/http"
+	neturl "net/url"
 	"strings"
 	"time"
 
+	"github.com/n0madic/go-poe/sse"
 	"github.com/n0madic/go-poe/types"
 )
 
@@ -24,6 +27,23 @@ type ToolExecutable struct {
 	Execute func(ctx context.Context, args string) (string, error)
 }
 
+// RedirectPolicy controls how bot calls follow HTTP redirects
+type RedirectPolicy int
+
+const (
+	// RedirectFollow follows redirects like http.Client does by default,
+	// which drops the Authorization header on cross-domain hops
+	RedirectFollow RedirectPolicy = iota
+	// RedirectDisallow fails the call with a BotErrorNoRetry on a redirect
+	RedirectDisallow
+	// RedirectKeepHeaders follows redirects and re-attaches all request
+	// headers, including Authorization, on every hop
+	RedirectKeepHeaders
+)
+
+// maxRedirects matches the limit of the default http.Client
+const maxRedirects = 10
+
 // StreamRequestOptions configures a stream request
 type StreamRequestOptions struct {
 	APIKey          string
@@ -34,6 +54,90 @@ type StreamRequestOptions struct {
 	BaseURL         string
 	ExtraHeaders    map[string]string
 	HTTPClient      *http.Client
+	// BackoffStrategy computes the delay between tries from RetrySleepTime,
+	// e.g. ExponentialBackoff (default: a constant RetrySleepTime)
+	BackoffStrategy BackoffStrategy
+	// MaxRetrySleepTime caps the delay between tries (default: no cap)
+	MaxRetrySleepTime time.Duration
+	// RequestTimeout bounds each try, on top of HTTPClient's own timeout
+	// (default: no limit)
+	RequestTimeout time.Duration
+	// RequestTimeoutFunc computes the timeout of a try from RequestTimeout, so
+	// that the first try fails fast while later ones are more patient, e.g.
+	// ExponentialBackoff{}.NextDelay for a jittered doubling. attempt is
+	// 0-based. Default: a constant RequestTimeout.
+	RequestTimeoutFunc func(attempt int, base time.Duration) time.Duration
+	// RawPayload, when set, is sent verbatim as the POST body instead of the
+	// payload built from the QueryRequest. Tools are not processed in this mode.
+	RawPayload json.RawMessage
+	// NoRetryOnPlainTextError treats error events whose data is not JSON as
+	// permanent instead of retrying them
+	NoRetryOnPlainTextError bool
+	// CircuitBreaker, when set, short-circuits requests to bots that keep failing
+	CircuitBreaker *CircuitBreaker
+	// DisableTimestamps stops GetBotResponse from stamping messages that have
+	// no Timestamp with the current time
+	DisableTimestamps bool
+	// CorrelationIDHeader names the header used to forward the correlation ID
+	// found in the request context (default: X-Correlation-ID)
+	CorrelationIDHeader string
+	// RedirectPolicy controls how bot calls follow HTTP redirects
+	// (default: RedirectFollow)
+	RedirectPolicy RedirectPolicy
+	// CollectAttachments sends a final response whose RawResponse is an
+	// *AttachmentIndex of the attachments streamed with an inline_ref
+	CollectAttachments bool
+	// ShouldRetryResponse is called with the text chunks of a response that
+	// completed without error. If it returns true and tries remain, the
+	// request is sent again; text already streamed is cleared first with an
+	// empty replace response. Retries count toward NumTries.
+	ShouldRetryResponse func(chunks []string) bool
+	// AggregateToolCallsWithoutExecutables makes the tools path buffer tool
+	// call deltas when ToolExecutables is empty and send the complete calls
+	// in AggregatedToolCalls once the bot finishes with "tool_calls",
+	// instead of sending each delta in ToolCalls
+	AggregateToolCallsWithoutExecutables bool
+	// MaxConcurrentTools limits how many ToolExecutables run at once when the
+	// bot requests several tool calls. The default (0, like 1) runs them one
+	// after another; a negative value means no limit, so all calls of a round
+	// run concurrently. Results keep the order of the calls.
+	MaxConcurrentTools int
+	// ToolTimeout bounds each ToolExecutables call (default: no limit). The
+	// call's context is cancelled after it, and the result sent to the bot
+	// reports that the tool timed out.
+	ToolTimeout time.Duration
+	// ValidateToolArgs checks that tool call arguments are a JSON object with
+	// all Required parameters of the tool before calling its executable. On
+	// failure the bot receives a result naming the problem instead.
+	ValidateToolArgs bool
+	// ValidateRequest runs ValidateRequest before sending, so an invalid
+	// request fails without reaching the bot
+	ValidateRequest bool
+	// MaxToolRounds is how many times tool calls requested by the bot are
+	// executed and their results sent back before the response is streamed
+	// as is (default: 1)
+	MaxToolRounds int
+	// DedupeConsecutiveIdenticalChunks drops a text chunk identical to the
+	// previous text chunk of the same index, as sent by some buggy bots
+	DedupeConsecutiveIdenticalChunks bool
+	// OnToolsExecuted is called with the tool calls of each round and the
+	// results of running them, before the results are sent to the bot
+	OnToolsExecuted func(calls []types.ToolCallDefinition, results []types.ToolResultDefinition)
+	// DefaultBotName is the bot called when the bot name argument is empty
+	DefaultBotName string
+	// OnRequestStart is called with the bot URL before every try
+	OnRequestStart func(url string)
+	// OnRawEvent is called with every SSE event received, before it is parsed
+	OnRawEvent func(event sse.Event)
+	// OnRetry is called when a try fails and another one follows. attempt is
+	// the 0-based number of the failed try.
+	OnRetry func(attempt int, err error)
+	// OnError is called with the error that ended a request without a
+	// response: invalid options, an empty bot name or a request rejected by
+	// ValidateRequest, a permanent error, or the error of the last try
+	OnError func(err error)
+
+	clock clock // overridden in tests
 }
 
 func (o *StreamRequestOptions) defaults() {
@@ -49,13 +153,61 @@ func (o *StreamRequestOptions) defaults() {
 	if o.HTTPClient == nil {
 		o.HTTPClient = &http.Client{Timeout: defaultClientTimeout}
 	}
+	if o.clock == nil {
+		o.clock = realClock{}
+	}
+	if o.MaxToolRounds <= 0 {
+		o.MaxToolRounds = 1
+	}
+	if o.CorrelationIDHeader == "" {
+		o.CorrelationIDHeader = types.DefaultCorrelationIDHeader
+	}
+}
+
+// Validate reports whether the options can be used for a request. It checks
+// that BaseURL, if set, is an absolute http or https URL.
+func (o *StreamRequestOptions) Validate() error {
+	if o.BaseURL == "" {
+		return nil
+	}
+	return validateBaseURL(o.BaseURL)
+}
+
+// botName returns name, or DefaultBotName if name is empty
+func (o *StreamRequestOptions) botName(name string) (string, error) {
+	if name == "" {
+		name = o.DefaultBotName
+	}
+	if name == "" {
+		return "", &BotErrorNoRetry{BotError{Message: "bot name is empty and no DefaultBotName is set"}}
+	}
+	return name, nil
 }
 
-func (o *StreamRequestOptions) headers() map[string]string {
+// validateBaseURL checks that baseURL is an absolute http or https URL, so a
+// typo fails early with a clear error instead of a cryptic request error
+func validateBaseURL(baseURL string) error {
+	u, err := neturl.Parse(baseURL)
+	if err != nil {
+		return fmt.Errorf("invalid BaseURL %q: %w", baseURL, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("invalid BaseURL %q: scheme must be http or https", baseURL)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("invalid BaseURL %q: missing host", baseURL)
+	}
+	return nil
+}
+
+func (o *StreamRequestOptions) headers(ctx context.Context) map[string]string {
 	headers := make(map[string]string)
 	if o.APIKey != "" {
 		headers["Authorization"] = "Bearer " + o.APIKey
 	}
+	if id := types.CorrelationIDFromContext(ctx); id != "" {
+		headers[o.CorrelationIDHeader] = id
+	}
 	for k, v := range o.ExtraHeaders {
 		headers[k] = v
 	}
@@ -63,17 +215,51 @@ func (o *StreamRequestOptions) headers() map[string]string {
 }
 
 // StreamRequest is the main entry point for calling other Poe bots.
-// If Tools are provided, it uses the tools path.
+// If Tools are provided, it uses the tools path. Log lines carry the request
+// ID from ctx; a new one is generated when ctx has none.
 func StreamRequest(ctx context.Context, req *types.QueryRequest, botName string, opts *StreamRequestOptions) <-chan *types.PartialResponse {
+	return streamRequest(ctx, req, botName, opts, true)
+}
+
+// streamRequest implements StreamRequest. With resolveName false, botName is
+// used as is, even when empty, as QueryBotURL does for a bot served at the
+// root path.
+func streamRequest(ctx context.Context, req *types.QueryRequest, botName string, opts *StreamRequestOptions, resolveName bool) <-chan *types.PartialResponse {
 	ch := make(chan *types.PartialResponse, 64)
 	if opts == nil {
 		opts = &StreamRequestOptions{}
 	}
 	opts.defaults()
+	if types.RequestIDFromContext(ctx) == "" {
+		ctx = types.WithRequestID(ctx, types.NewRequestID())
+	}
 
 	go func() {
 		defer close(ch)
-		if len(opts.Tools) > 0 {
+		if err := opts.Validate(); err != nil {
+			types.Logf(ctx, "Bot request to %s failed: %v", botName, err)
+			opts.reportError(err)
+			return
+		}
+		if resolveName {
+			name, err := opts.botName(botName)
+			if err != nil {
+				types.Logf(ctx, "Bot request failed: %v", err)
+				opts.reportError(err)
+				return
+			}
+			botName = name
+		}
+		if opts.ValidateRequest && opts.RawPayload == nil {
+			if err := validateQuery(req, opts); err != nil {
+				types.Logf(ctx, "Bot request to %s failed: invalid request: %v", botName, err)
+				opts.reportError(err)
+				return
+			}
+		}
+		if opts.RawPayload != nil {
+			streamRequestBody(ctx, botName, opts, opts.RawPayload, false, ch)
+		} else if len(opts.Tools) > 0 {
 			streamRequestWithTools(ctx, req, botName, opts, ch)
 		} else {
 			streamRequestBase(ctx, req, botName, opts, ch)
@@ -84,71 +270,109 @@ func StreamRequest(ctx context.Context, req *types.QueryRequest, botName string,
 
 // streamRequestBase handles retries and calls performQueryRequest
 func streamRequestBase(ctx context.Context, req *types.QueryRequest, botName string, opts *StreamRequestOptions, ch chan<- *types.PartialResponse) {
-	url := strings.TrimRight(opts.BaseURL, "/") + "/" + botName
-	headers := opts.headers()
-
 	payload := buildPayload(req, nil, nil, nil)
+	streamRequestBaseWithPayload(ctx, botName, opts, payload, ch)
+}
 
-	for i := 0; i < opts.NumTries; i++ {
-		err := performQueryRequest(ctx, opts.HTTPClient, url, payload, headers, ch)
-		if err == nil {
-			return
-		}
-
-		if IsBotErrorNoRetry(err) {
-			log.Printf("Bot request to %s failed (no retry): %v", botName, err)
-			return
-		}
-
-		log.Printf("Bot request to %s failed on try %d: %v", botName, i, err)
-
-		if i == opts.NumTries-1 {
-			return
-		}
+// streamRequestBaseWithPayload handles retries with a custom payload
+func streamRequestBaseWithPayload(ctx context.Context, botName string, opts *StreamRequestOptions, payload map[string]any, ch chan<- *types.PartialResponse) {
+	body, err := jsonMarshal(payload)
+	if err != nil {
+		types.Logf(ctx, "Bot request to %s failed: failed to marshal request: %v", botName, err)
+		return
+	}
+	streamRequestBody(ctx, botName, opts, body, payload["tools"] != nil, ch)
+}
 
-		select {
-		case <-ctx.Done():
-			return
-		case <-time.After(opts.RetrySleepTime):
-		}
+// reportError passes the error that ended a request to OnError
+func (o *StreamRequestOptions) reportError(err error) {
+	if o.OnError != nil {
+		o.OnError(err)
 	}
 }
 
-// streamRequestBaseWithPayload handles retries with a custom payload
-func streamRequestBaseWithPayload(ctx context.Context, botName string, opts *StreamRequestOptions, payload map[string]any, ch chan<- *types.PartialResponse) {
+// streamRequestBody handles retries for an already encoded request body
+func streamRequestBody(ctx context.Context, botName string, opts *StreamRequestOptions, body []byte, hasTools bool, ch chan<- *types.PartialResponse) {
 	url := strings.TrimRight(opts.BaseURL, "/") + "/" + botName
-	headers := opts.headers()
+	headers := opts.headers(ctx)
 
 	for i := 0; i < opts.NumTries; i++ {
-		err := performQueryRequest(ctx, opts.HTTPClient, url, payload, headers, ch)
+		if opts.CircuitBreaker != nil {
+			if err := opts.CircuitBreaker.Allow(botName); err != nil {
+				types.Logf(ctx, "Bot request to %s skipped: %v", botName, err)
+				opts.reportError(err)
+				return
+			}
+		}
+
+		attemptCtx, cancel := opts.attemptContext(ctx, i)
+		err := performQueryRequest(attemptCtx, opts, url, body, hasTools, headers, ch)
+		timedOut := ctx.Err() == nil && attemptCtx.Err() != nil
+		cancel()
+		if opts.CircuitBreaker != nil {
+			switch {
+			case err == nil:
+				opts.CircuitBreaker.RecordSuccess(botName)
+			case ctx.Err() == nil && (timedOut || isUnavailable(err)):
+				opts.CircuitBreaker.RecordFailure(botName)
+			default:
+				// Cancelled by the caller, or an error caused by the
+				// request rather than the bot's health
+				opts.CircuitBreaker.recordAbandoned(botName)
+			}
+		}
 		if err == nil {
 			return
 		}
+		if ctx.Err() != nil {
+			types.Logf(ctx, "Bot request to %s cancelled: %v", botName, ctx.Err())
+			return
+		}
+
+		var rejected *rejectedResponseError
+		if errors.As(err, &rejected) {
+			if i == opts.NumTries-1 {
+				types.Logf(ctx, "Bot request to %s: keeping rejected response, no tries left", botName)
+				if opts.CollectAttachments {
+					ch <- &types.PartialResponse{RawResponse: rejected.attachments}
+				}
+				return
+			}
+			if rejected.hadText {
+				ch <- &types.PartialResponse{IsReplaceResponse: true}
+			}
+		}
 
 		if IsBotErrorNoRetry(err) {
-			log.Printf("Bot request to %s failed (no retry): %v", botName, err)
+			types.Logf(ctx, "Bot request to %s failed (no retry): %v", botName, err)
+			opts.reportError(err)
 			return
 		}
 
-		log.Printf("Bot request to %s failed on try %d: %v", botName, i, err)
+		types.Logf(ctx, "Bot request to %s failed on try %d: %v", botName, i, err)
 
 		if i == opts.NumTries-1 {
+			opts.reportError(err)
 			return
 		}
 
+		if opts.OnRetry != nil {
+			opts.OnRetry(i, err)
+		}
+
 		select {
 		case <-ctx.Done():
 			return
-		case <-time.After(opts.RetrySleepTime):
+		case <-opts.clock.After(opts.retryDelay(i)):
 		}
 	}
 }
 
 func buildPayload(req *types.QueryRequest, tools []types.ToolDefinition, toolCalls []types.ToolCallDefinition, toolResults []types.ToolResultDefinition) map[string]any {
 	// Marshal the request to get a map
-	data, _ := json.Marshal(req)
+	data, _ := jsonMarshal(req)
 	var payload map[string]any
-	json.Unmarshal(data, &payload)
+	jsonUnmarshal(data, &payload)
 
 	if tools != nil {
 		payload["tools"] = tools
@@ -169,6 +393,10 @@ func GetBotResponse(ctx context.Context, messages []types.ProtocolMessage, botNa
 	}
 	opts.APIKey = apiKey
 
+	if !opts.DisableTimestamps {
+		messages = types.WithTimestamps(messages, time.Now())
+	}
+
 	req := &types.QueryRequest{
 		BaseRequest: types.BaseRequest{
 			Version: types.ProtocolVersion,
@@ -183,7 +411,50 @@ func GetBotResponse(ctx context.Context, messages []types.ProtocolMessage, botNa
 	return StreamRequest(ctx, req, botName, opts)
 }
 
-// GetFinalResponse collects the full response text
+// QueryBotURL sends messages to the bot served at botURL and collects all
+// responses. botURL is the full URL of the bot, e.g. the URL of a
+// server.NewTestServer plus the bot's path. It is intended for integration
+// tests that exercise a bot over HTTP and SSE.
+func QueryBotURL(ctx context.Context, botURL string, messages []types.ProtocolMessage, opts *StreamRequestOptions) ([]*types.PartialResponse, error) {
+	u, err := neturl.Parse(botURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid bot URL %q: %w", botURL, err)
+	}
+	if u.Path == "" {
+		u.Path = "/"
+	}
+	i := strings.LastIndex(u.Path, "/")
+	botName := u.Path[i+1:]
+	u.Path = u.Path[:i+1]
+
+	var reqOpts StreamRequestOptions
+	if opts != nil {
+		reqOpts = *opts
+	}
+	reqOpts.BaseURL = u.String()
+
+	req := &types.QueryRequest{
+		BaseRequest: types.BaseRequest{
+			Version: types.ProtocolVersion,
+			Type:    types.RequestTypeQuery,
+		},
+		Query: messages,
+	}
+
+	var responses []*types.PartialResponse
+	// A bot served at the root path has an empty name, which StreamRequest
+	// rejects, so the name is used as is
+	for msg := range streamRequest(ctx, req, botName, &reqOpts, false) {
+		responses = append(responses, msg)
+	}
+	return responses, nil
+}
+
+// GetFinalResponse collects the full response text. With indexed multi-responses,
+// the text of each index is joined in order of first appearance, and a
+// replace_response with an index only replaces that index's text. If the bot
+// sent no text, the error that ended the request is returned, e.g. for
+// IsInsufficientFund.
 func GetFinalResponse(ctx context.Context, req *types.QueryRequest, botName, apiKey string, opts *StreamRequestOptions) (string, error) {
 	if opts == nil {
 		opts = &StreamRequestOptions{}
@@ -191,28 +462,133 @@ func GetFinalResponse(ctx context.Context, req *types.QueryRequest, botName, api
 	if apiKey != "" {
 		opts.APIKey = apiKey
 	}
+	if err := opts.Validate(); err != nil {
+		return "", err
+	}
+	botName, err := opts.botName(botName)
+	if err != nil {
+		return "", err
+	}
 
-	ch := StreamRequest(ctx, req, botName, opts)
-	var chunks []string
+	// Keep the error that ended the request, to return it if there is no text
+	var lastErr error
+	streamOpts := *opts
+	streamOpts.OnError = func(err error) {
+		lastErr = err
+		opts.reportError(err)
+	}
+	ch := StreamRequest(ctx, req, botName, &streamOpts)
+	var text responseText
 
 	for msg := range ch {
-		// Skip meta responses
-		if msg.RawResponse != nil {
-			if _, ok := msg.RawResponse.(*types.MetaResponse); ok {
-				continue
-			}
+		if isResponseText(msg) {
+			text.add(msg)
+		}
+	}
+
+	if !text.received {
+		if lastErr != nil {
+			return "", lastErr
 		}
-		if msg.IsSuggestedReply {
+		return "", &BotError{Message: "Bot " + botName + " sent no response"}
+	}
+	return text.String(), nil
+}
+
+// responseText accumulates response text per index. Unindexed text shares one
+// buffer; an unindexed replace_response replaces everything.
+type responseText struct {
+	order    []int
+	byIndex  map[int][]string
+	received bool
+}
+
+// unindexed is the responseText key for responses without an Index
+const unindexed = -1
+
+func (t *responseText) add(msg *types.PartialResponse) {
+	key := unindexed
+	if msg.Index != nil {
+		key = *msg.Index
+	}
+	if msg.IsReplaceResponse {
+		if key == unindexed {
+			t.order, t.byIndex = nil, nil
+		} else if t.byIndex != nil {
+			t.byIndex[key] = nil
+		}
+	}
+	if t.byIndex == nil {
+		t.byIndex = make(map[int][]string)
+	}
+	if _, ok := t.byIndex[key]; !ok {
+		t.order = append(t.order, key)
+	}
+	t.byIndex[key] = append(t.byIndex[key], msg.Text)
+	t.received = true
+}
+
+func (t *responseText) String() string {
+	var b strings.Builder
+	for _, key := range t.order {
+		for _, chunk := range t.byIndex[key] {
+			b.WriteString(chunk)
+		}
+	}
+	return b.String()
+}
+
+// isResponseText reports whether msg is part of the response text, as opposed
+// to meta and data responses, suggested replies, thinking, aggregated tool
+// calls and collected attachments
+func isResponseText(msg *types.PartialResponse) bool {
+	switch msg.RawResponse.(type) {
+	case *types.MetaResponse, *types.DataResponse, *AttachmentIndex:
+		return false
+	}
+	return !msg.IsSuggestedReply && !msg.IsThinking && len(msg.AggregatedToolCalls) == 0
+}
+
+// StreamUntil collects the response text like GetFinalResponse, but calls stop
+// with the text accumulated so far after every chunk and cancels the request
+// as soon as it returns true. It returns the text collected up to that point.
+func StreamUntil(ctx context.Context, req *types.QueryRequest, botName, apiKey string, opts *StreamRequestOptions, stop func(accumulated string) bool) (string, error) {
+	if opts == nil {
+		opts = &StreamRequestOptions{}
+	}
+	if apiKey != "" {
+		opts.APIKey = apiKey
+	}
+	if err := opts.Validate(); err != nil {
+		return "", err
+	}
+	botName, err := opts.botName(botName)
+	if err != nil {
+		return "", err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	ch := StreamRequest(ctx, req, botName, opts)
+	var text responseText
+
+	for msg := range ch {
+		if !isResponseText(msg) {
 			continue
 		}
-		if msg.IsReplaceResponse {
-			chunks = nil
+		text.add(msg)
+		if stop(text.String()) {
+			cancel()
+			// Drain so the request goroutine can exit
+			for range ch {
+			}
+			return text.String(), nil
 		}
-		chunks = append(chunks, msg.Text)
 	}
 
-	if len(chunks) == 0 {
+	if !text.received {
 		return "", &BotError{Message: "Bot " + botName + " sent no response"}
 	}
-	return strings.Join(chunks, ""), nil
+	return text.String(), nil
 }
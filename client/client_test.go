@@ -3,14 +3,22 @@ package client
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/n0madic/go-poe/sse"
 	"github.com/n0madic/go-poe/types"
 )
 
@@ -610,6 +618,128 @@ func TestSyncBotSettings_WithoutSettings(t *testing.T) {
 	}
 }
 
+func TestSyncBotSettingsWithOptions_Cancel(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	var used int32
+	httpClient := &http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		atomic.AddInt32(&used, 1)
+		return http.DefaultTransport.RoundTrip(req)
+	})}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+	err := SyncBotSettingsWithOptions(ctx, &SyncSettingsOptions{
+		BotName:    "testbot",
+		AccessKey:  "test-key",
+		Settings:   map[string]any{"introduction_message": "Hello!"},
+		BaseURL:    server.URL + "/",
+		HTTPClient: httpClient,
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected a cancellation error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected cancellation to abort the request, took %v", elapsed)
+	}
+	if atomic.LoadInt32(&used) != 1 {
+		t.Error("Expected the custom HTTP client to send the request")
+	}
+}
+
+func TestFetchBotSettings(t *testing.T) {
+	body := `{"response_version": 2, "introduction_message": "Hi there!", "server_bot_dependencies": {"GPT-4": 2}, "allow_attachments": false}`
+	var receivedPath string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		receivedPath = r.URL.Path
+		fmt.Fprint(w, body)
+	}))
+	defer server.Close()
+
+	settings, err := FetchBotSettings(context.Background(), "testbot", "test-key", server.URL)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if expected := fmt.Sprintf("/fetch_settings/testbot/test-key/%s", types.ProtocolVersion); receivedPath != expected {
+		t.Errorf("Expected path %s, got %s", expected, receivedPath)
+	}
+	if settings.ResponseVersion == nil || *settings.ResponseVersion != 2 {
+		t.Errorf("Expected response_version 2, got %v", settings.ResponseVersion)
+	}
+	if settings.IntroductionMessage == nil || *settings.IntroductionMessage != "Hi there!" {
+		t.Errorf("Unexpected introduction message: %v", settings.IntroductionMessage)
+	}
+	if settings.ServerBotDependencies["GPT-4"] != 2 {
+		t.Errorf("Unexpected dependencies: %v", settings.ServerBotDependencies)
+	}
+	if settings.AllowAttachments == nil || *settings.AllowAttachments {
+		t.Errorf("Expected allow_attachments false, got %v", settings.AllowAttachments)
+	}
+
+	// An empty body gives zero settings
+	body = ""
+	settings, err = FetchBotSettings(context.Background(), "testbot", "test-key", server.URL)
+	if err != nil {
+		t.Fatalf("Unexpected error for empty body: %v", err)
+	}
+	if settings == nil || settings.ResponseVersion != nil || settings.IntroductionMessage != nil {
+		t.Errorf("Expected zero settings, got %+v", settings)
+	}
+
+	body = "not json"
+	if _, err := FetchBotSettings(context.Background(), "testbot", "test-key", server.URL); err == nil {
+		t.Error("Expected an error for an invalid body")
+	}
+}
+
+// roundTripperFunc adapts a function to http.RoundTripper
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+func TestSyncAllBotSettings(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/badbot/") || strings.Contains(r.URL.Path, "/revoked/") {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, "invalid settings")
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	settings := map[string]any{"introduction_message": "Hello!"}
+	results := SyncAllBotSettings(context.Background(), []BotSettingsEntry{
+		{BotName: "goodbot", AccessKey: "key1", Settings: settings, BaseURL: server.URL + "/"},
+		{BotName: "badbot", AccessKey: "key2", Settings: settings, BaseURL: server.URL + "/"},
+		{BotName: "goodbot", AccessKey: "revoked", Settings: settings, BaseURL: server.URL + "/"},
+	})
+
+	if len(results) != 3 {
+		t.Fatalf("Expected results for 3 entries, got %d", len(results))
+	}
+	if err := results[0]; err != nil {
+		t.Errorf("Expected goodbot to sync, got %v", err)
+	}
+	if err := results[1]; err == nil || !strings.Contains(err.Error(), "invalid settings") {
+		t.Errorf("Expected badbot error, got %v", err)
+	}
+	// An entry with a repeated name keeps its own result
+	if err := results[2]; err == nil {
+		t.Error("Expected an error for the second goodbot entry")
+	}
+}
+
 func TestStreamRequest_Index(t *testing.T) {
 	events := []string{
 		"event: text\ndata: {\"text\": \"First\", \"index\": 0}\n\n",
@@ -711,6 +841,28 @@ func TestStreamRequest_JsonEvent(t *testing.T) {
 	}
 }
 
+func TestStreamRequest_JsonArrayEvent(t *testing.T) {
+	server := mockSSEServer([]string{
+		"event: json\ndata: [{\"id\": 1}, {\"id\": 2}, \"three\"]\n\n",
+		"event: json\ndata: 42\n\n",
+		"event: done\ndata: {}\n\n",
+	})
+	defer server.Close()
+
+	var messages []*types.PartialResponse
+	for msg := range StreamRequest(context.Background(), newTestQueryRequest("hi"), "testbot", &StreamRequestOptions{BaseURL: server.URL + "/", NumTries: 1}) {
+		messages = append(messages, msg)
+	}
+
+	if len(messages) != 1 {
+		t.Fatalf("Expected 1 message before the invalid scalar event, got %d", len(messages))
+	}
+	want := []any{map[string]any{"id": float64(1)}, map[string]any{"id": float64(2)}, "three"}
+	if got := messages[0].DataArray; !reflect.DeepEqual(got, want) || messages[0].Data != nil {
+		t.Errorf("Expected the array in DataArray, got %v and Data %v", got, messages[0].Data)
+	}
+}
+
 func TestGetBotResponse(t *testing.T) {
 	events := []string{
 		"event: text\ndata: {\"text\": \"Response\"}\n\n",
@@ -741,6 +893,52 @@ func TestGetBotResponse(t *testing.T) {
 	}
 }
 
+func TestGetBotResponse_Timestamps(t *testing.T) {
+	var mu sync.Mutex
+	var bodies []map[string]any
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]any
+		json.NewDecoder(r.Body).Decode(&payload)
+		mu.Lock()
+		bodies = append(bodies, payload)
+		mu.Unlock()
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "event: done\ndata: {}\n\n")
+	}))
+	defer server.Close()
+
+	before := time.Now().UnixMilli()
+	messages := []types.ProtocolMessage{
+		{Role: "user", Content: "Earlier", Timestamp: 1000},
+		{Role: "user", Content: "Hello"},
+	}
+	for range GetBotResponse(context.Background(), messages, "testbot", "key", &StreamRequestOptions{BaseURL: server.URL + "/"}) {
+	}
+	for range GetBotResponse(context.Background(), messages, "testbot", "key", &StreamRequestOptions{BaseURL: server.URL + "/", DisableTimestamps: true}) {
+	}
+
+	if messages[1].Timestamp != 0 {
+		t.Error("Expected caller's messages to be left unchanged")
+	}
+	if len(bodies) != 2 {
+		t.Fatalf("Expected 2 requests, got %d", len(bodies))
+	}
+
+	query := bodies[0]["query"].([]any)
+	if ts := query[0].(map[string]any)["timestamp"]; ts != float64(1000) {
+		t.Errorf("Expected existing timestamp to be kept, got %v", ts)
+	}
+	ts, _ := query[1].(map[string]any)["timestamp"].(float64)
+	if int64(ts) < before || int64(ts) > time.Now().UnixMilli() {
+		t.Errorf("Expected current unix millis timestamp, got %v", ts)
+	}
+
+	query = bodies[1]["query"].([]any)
+	if _, ok := query[1].(map[string]any)["timestamp"]; ok {
+		t.Error("Expected no timestamp with DisableTimestamps")
+	}
+}
+
 func TestBotErrorNoRetry_Type(t *testing.T) {
 	err := &BotErrorNoRetry{BotError{Message: "test error"}}
 
@@ -803,3 +1001,2168 @@ func TestUploadFile_NotBoth(t *testing.T) {
 		t.Errorf("Expected 'not both' error, got: %v", err)
 	}
 }
+
+// newTestQueryRequest builds a minimal query request for tests
+func newTestQueryRequest(content string) *types.QueryRequest {
+	return &types.QueryRequest{
+		BaseRequest: types.BaseRequest{
+			Version: types.ProtocolVersion,
+			Type:    types.RequestTypeQuery,
+		},
+		Query:          []types.ProtocolMessage{{Role: "user", Content: content}},
+		UserID:         "test-user",
+		ConversationID: "test-conv",
+		MessageID:      "test-msg",
+	}
+}
+
+func TestStreamRequest_FileEventCoalescedByInlineRef(t *testing.T) {
+	events := []string{
+		"event: file\ndata: {\"url\": \"https://example.com/part1\", \"content_type\": \"text/plain\", \"name\": \"log.txt\", \"inline_ref\": \"ref1\"}\n\n",
+		"event: file\ndata: {\"url\": \"https://example.com/other\", \"content_type\": \"image/png\", \"name\": \"img.png\"}\n\n",
+		"event: file\ndata: {\"url\": \"https://example.com/part2\", \"inline_ref\": \"ref1\"}\n\n",
+		"event: done\ndata: {}\n\n",
+	}
+
+	server := mockSSEServer(events)
+	defer server.Close()
+
+	opts := &StreamRequestOptions{
+		BaseURL:    server.URL + "/",
+		HTTPClient: &http.Client{Timeout: 5 * time.Second},
+	}
+
+	var attachments []types.Attachment
+	for msg := range StreamRequest(context.Background(), newTestQueryRequest("test"), "testbot", opts) {
+		if msg.Attachment != nil {
+			attachments = append(attachments, *msg.Attachment)
+		}
+	}
+
+	if len(attachments) != 3 {
+		t.Fatalf("Expected 3 file events, got %d", len(attachments))
+	}
+
+	// The update keeps fields not present in the later event
+	update := attachments[2]
+	if update.URL != "https://example.com/part2" || update.Name != "log.txt" || update.ContentType != "text/plain" {
+		t.Errorf("Expected merged attachment, got %+v", update)
+	}
+
+	coalesced := CoalesceAttachments(attachments)
+	if len(coalesced) != 2 {
+		t.Fatalf("Expected 2 coalesced attachments, got %d", len(coalesced))
+	}
+	if coalesced[0].URL != "https://example.com/part2" || *coalesced[0].InlineRef != "ref1" {
+		t.Errorf("Expected ref1 to hold the latest URL, got %+v", coalesced[0])
+	}
+	if coalesced[1].Name != "img.png" {
+		t.Errorf("Expected attachment without inline_ref to be kept, got %+v", coalesced[1])
+	}
+}
+
+func TestStreamRequest_CollectAttachments(t *testing.T) {
+	server := mockSSEServer([]string{
+		"event: file\ndata: {\"url\": \"https://example.com/draft.png\", \"content_type\": \"image/png\", \"name\": \"chart.png\", \"inline_ref\": \"chart\"}\n\n",
+		"event: text\ndata: {\"text\": \"Here: ![Chart][chart]\"}\n\n",
+		"event: file\ndata: {\"url\": \"https://example.com/final.png\", \"inline_ref\": \"chart\"}\n\n",
+		"event: done\ndata: {}\n\n",
+	})
+	defer server.Close()
+
+	opts := &StreamRequestOptions{BaseURL: server.URL + "/", CollectAttachments: true}
+	var text string
+	var index *AttachmentIndex
+	for msg := range StreamRequest(context.Background(), newTestQueryRequest("hi"), "bot", opts) {
+		if idx, ok := msg.RawResponse.(*AttachmentIndex); ok {
+			index = idx
+			continue
+		}
+		text += msg.Text
+	}
+
+	if index == nil {
+		t.Fatal("Expected an AttachmentIndex at the end of the stream")
+	}
+	att, ok := index.Get("chart")
+	if !ok || att.URL != "https://example.com/final.png" || att.Name != "chart.png" {
+		t.Errorf("Expected merged attachment for chart, got %+v", att)
+	}
+	if len(index.Map()) != 1 || len(index.Attachments()) != 1 {
+		t.Errorf("Expected one indexed attachment, got %v", index.Map())
+	}
+	if got := index.Resolve(text); got != "Here: ![Chart](https://example.com/final.png)" {
+		t.Errorf("Unexpected resolved text: %q", got)
+	}
+
+	// GetFinalResponse ignores the index
+	final, err := GetFinalResponse(context.Background(), newTestQueryRequest("hi"), "bot", "", opts)
+	if err != nil || final != "Here: ![Chart][chart]" {
+		t.Errorf("Unexpected final response %q, %v", final, err)
+	}
+}
+
+func TestResolveInlineRefs(t *testing.T) {
+	imgRef, fileRef := "img1", "doc1"
+	attachments := []types.Attachment{
+		{URL: "https://example.com/chart.png", ContentType: "image/png", Name: "chart.png", InlineRef: &imgRef},
+		{URL: "https://example.com/report.pdf", ContentType: "application/pdf", Name: "report.pdf", InlineRef: &fileRef},
+	}
+
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{"image", "See ![chart][img1] below", "See ![chart](https://example.com/chart.png) below"},
+		{"image without bang", "See [chart][img1]", "See ![chart](https://example.com/chart.png)"},
+		{"file", "Download [the report][doc1].", "Download [the report](https://example.com/report.pdf)."},
+		{"empty label", "[][doc1]", "[report.pdf](https://example.com/report.pdf)"},
+		{"unknown ref", "Missing [x][nope]", "Missing [x][nope]"},
+		{"plain link", "[site](https://example.com)", "[site](https://example.com)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ResolveInlineRefs(tt.text, attachments); got != tt.want {
+				t.Errorf("ResolveInlineRefs(%q) = %q, want %q", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCoalesceAttachments(t *testing.T) {
+	ref := "chart"
+	other := "table"
+	parsed := "final"
+	attachments := []types.Attachment{
+		{URL: "u1", Name: "chart.png", ContentType: "image/png", InlineRef: &ref},
+		{URL: "t1", Name: "table.csv", InlineRef: &other},
+		{URL: "u2", InlineRef: &ref, ParsedContent: &parsed},
+		{URL: "u3", InlineRef: &ref},
+	}
+
+	result := CoalesceAttachments(attachments)
+	if len(result) != 2 {
+		t.Fatalf("Expected 2 attachments, got %d", len(result))
+	}
+	if result[0].URL != "u3" || result[0].Name != "chart.png" || result[0].ContentType != "image/png" {
+		t.Errorf("Unexpected coalesced chart attachment: %+v", result[0])
+	}
+	if result[0].ParsedContent == nil || *result[0].ParsedContent != "final" {
+		t.Errorf("Expected parsed content to be kept from earlier update")
+	}
+	if result[1].URL != "t1" {
+		t.Errorf("Expected table attachment second, got %+v", result[1])
+	}
+	if len(CoalesceAttachments(nil)) != 0 {
+		t.Error("Expected empty result for nil input")
+	}
+}
+
+func TestClient_StructAPI(t *testing.T) {
+	var authHeader string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authHeader = r.Header.Get("Authorization")
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "event: text\ndata: {\"text\": \"Hello\"}\n\n")
+		fmt.Fprint(w, "event: text\ndata: {\"text\": \" there\"}\n\n")
+		fmt.Fprint(w, "event: done\ndata: {}\n\n")
+	}))
+	defer server.Close()
+
+	c := NewClient("test-key", &StreamRequestOptions{BaseURL: server.URL + "/"})
+	defer c.Close()
+
+	var texts []string
+	for msg := range c.Stream(context.Background(), newTestQueryRequest("hi"), "testbot") {
+		texts = append(texts, msg.Text)
+	}
+	if strings.Join(texts, "") != "Hello there" {
+		t.Errorf("Expected streamed text 'Hello there', got %q", strings.Join(texts, ""))
+	}
+	if authHeader != "Bearer test-key" {
+		t.Errorf("Expected client API key in Authorization header, got %q", authHeader)
+	}
+
+	final, err := c.GetFinalResponse(context.Background(), newTestQueryRequest("hi"), "testbot")
+	if err != nil {
+		t.Fatalf("GetFinalResponse failed: %v", err)
+	}
+	if final != "Hello there" {
+		t.Errorf("Expected final response 'Hello there', got %q", final)
+	}
+
+	if c.HTTPClient() == nil {
+		t.Error("Expected default HTTP client to be set")
+	}
+	if err := c.Close(); err != nil {
+		t.Errorf("Close returned error: %v", err)
+	}
+}
+
+func TestClient_Upload(t *testing.T) {
+	var authHeader string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authHeader = r.Header.Get("Authorization")
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"attachment_url": "https://example.com/a.txt", "mime_type": "text/plain"}`)
+	}))
+	defer server.Close()
+
+	c := NewClient("test-key", nil)
+	defer c.Close()
+
+	att, err := c.Upload(context.Background(), &UploadFileOptions{
+		File:     strings.NewReader("content"),
+		FileName: "a.txt",
+		BaseURL:  server.URL,
+	})
+	if err != nil {
+		t.Fatalf("Upload failed: %v", err)
+	}
+	if att.URL != "https://example.com/a.txt" {
+		t.Errorf("Unexpected attachment URL: %s", att.URL)
+	}
+	if authHeader != "test-key" {
+		t.Errorf("Expected client API key to be used for upload, got %q", authHeader)
+	}
+}
+
+// fakeClock records requested sleeps and fires immediately
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	sleeps []time.Duration
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sleeps = append(c.sleeps, d)
+	c.now = c.now.Add(d)
+	ch := make(chan time.Time, 1)
+	ch <- c.now
+	return ch
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func (c *fakeClock) Sleeps() []time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]time.Duration(nil), c.sleeps...)
+}
+
+func TestStreamRequest_RetryUsesClock(t *testing.T) {
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "event: error\ndata: {\"allow_retry\": true, \"text\": \"busy\"}\n\n")
+	}))
+	defer server.Close()
+
+	clk := &fakeClock{now: time.Unix(0, 0)}
+	opts := &StreamRequestOptions{
+		BaseURL:        server.URL + "/",
+		NumTries:       3,
+		RetrySleepTime: time.Hour,
+		clock:          clk,
+	}
+
+	start := time.Now()
+	for range StreamRequest(context.Background(), newTestQueryRequest("hi"), "testbot", opts) {
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("Expected retries without real sleeps, took %v", elapsed)
+	}
+
+	if got := atomic.LoadInt32(&attempts); got != 3 {
+		t.Errorf("Expected 3 attempts, got %d", got)
+	}
+	sleeps := clk.Sleeps()
+	if len(sleeps) != 2 {
+		t.Fatalf("Expected 2 retry sleeps, got %d", len(sleeps))
+	}
+	for i, d := range sleeps {
+		if d != time.Hour {
+			t.Errorf("Sleep %d: expected %v, got %v", i, time.Hour, d)
+		}
+	}
+}
+
+// deadlineTransport records the time left before the deadline of every
+// request and fails it
+type deadlineTransport struct {
+	mu        sync.Mutex
+	remaining []time.Duration
+}
+
+func (d *deadlineTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	deadline, _ := req.Context().Deadline()
+	d.mu.Lock()
+	d.remaining = append(d.remaining, time.Until(deadline))
+	d.mu.Unlock()
+	return nil, fmt.Errorf("upstream unavailable")
+}
+
+// checkTryTimeouts checks that every try of opts ran with the timeout given
+// by attemptTimeout and that those are want
+func checkTryTimeouts(t *testing.T, opts *StreamRequestOptions, transport *deadlineTransport, want []time.Duration) {
+	t.Helper()
+	for range StreamRequest(context.Background(), newTestQueryRequest("hi"), "testbot", opts) {
+	}
+	if len(transport.remaining) != len(want) {
+		t.Fatalf("Expected %d tries, got %d", len(want), len(transport.remaining))
+	}
+	for i, remaining := range transport.remaining {
+		if got := opts.attemptTimeout(i); got != want[i] {
+			t.Errorf("Try %d: expected timeout %v, got %v", i, want[i], got)
+		}
+		// The deadline is enforced by the runtime timer, so it is measured
+		// on the real clock whatever the options' clock
+		if remaining <= 0 || remaining > want[i] || remaining < want[i]-time.Second {
+			t.Errorf("Try %d: expected a deadline about %v away, got %v", i, want[i], remaining)
+		}
+	}
+}
+
+func TestStreamRequest_RequestTimeoutEscalates(t *testing.T) {
+	transport := &deadlineTransport{}
+	opts := &StreamRequestOptions{
+		BaseURL:        "http://bot.test/",
+		HTTPClient:     &http.Client{Transport: transport},
+		NumTries:       3,
+		RetrySleepTime: time.Second,
+		RequestTimeout: 10 * time.Second,
+		RequestTimeoutFunc: func(attempt int, base time.Duration) time.Duration {
+			return base << attempt
+		},
+		// A fake clock far from real time must not shift the deadlines
+		clock: &fakeClock{now: time.Unix(0, 0)},
+	}
+	checkTryTimeouts(t, opts, transport, []time.Duration{10 * time.Second, 20 * time.Second, 40 * time.Second})
+}
+
+func TestStreamRequest_RequestTimeoutConstantByDefault(t *testing.T) {
+	transport := &deadlineTransport{}
+	opts := &StreamRequestOptions{
+		BaseURL:        "http://bot.test/",
+		HTTPClient:     &http.Client{Transport: transport},
+		NumTries:       2,
+		RetrySleepTime: time.Second,
+		RequestTimeout: 10 * time.Second,
+		clock:          &fakeClock{now: time.Unix(0, 0)},
+	}
+	checkTryTimeouts(t, opts, transport, []time.Duration{10 * time.Second, 10 * time.Second})
+}
+
+func TestStreamRequest_MetaEventExtraFields(t *testing.T) {
+	events := []string{
+		"event: meta\ndata: {\"linkify\": true, \"content_type\": \"text/markdown\", \"refetch_settings\": true, \"new_field\": \"value\", \"limits\": {\"max\": 3}}\n\n",
+		"event: done\ndata: {}\n\n",
+	}
+
+	server := mockSSEServer(events)
+	defer server.Close()
+
+	opts := &StreamRequestOptions{
+		BaseURL:    server.URL + "/",
+		HTTPClient: &http.Client{Timeout: 5 * time.Second},
+	}
+
+	var meta *types.MetaResponse
+	for msg := range StreamRequest(context.Background(), newTestQueryRequest("test"), "testbot", opts) {
+		if m, ok := msg.RawResponse.(*types.MetaResponse); ok {
+			meta = m
+		}
+	}
+
+	if meta == nil {
+		t.Fatal("Expected meta response")
+	}
+	if !meta.RefetchSettings {
+		t.Error("Expected refetch_settings=true")
+	}
+	if meta.Extra["new_field"] != "value" {
+		t.Errorf("Expected Extra[new_field]=value, got %v", meta.Extra["new_field"])
+	}
+	limits, ok := meta.Extra["limits"].(map[string]any)
+	if !ok || limits["max"] != float64(3) {
+		t.Errorf("Expected Extra[limits] object, got %v", meta.Extra["limits"])
+	}
+	if _, ok := meta.Extra["linkify"]; ok {
+		t.Error("Known fields should not be duplicated in Extra")
+	}
+}
+
+func TestStreamRequest_RawPayload(t *testing.T) {
+	var received []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received, _ = io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "event: text\ndata: {\"text\": \"ok\"}\n\n")
+		fmt.Fprint(w, "event: done\ndata: {}\n\n")
+	}))
+	defer server.Close()
+
+	raw := []byte(`{"version":"1.2","type":"query","query":[],"zeta":1,"alpha":"first"}`)
+	opts := &StreamRequestOptions{
+		BaseURL:    server.URL + "/",
+		RawPayload: raw,
+	}
+
+	var texts []string
+	for msg := range StreamRequest(context.Background(), newTestQueryRequest("ignored"), "testbot", opts) {
+		texts = append(texts, msg.Text)
+	}
+
+	if string(received) != string(raw) {
+		t.Errorf("Expected raw payload to be sent verbatim:\n got %s\nwant %s", received, raw)
+	}
+	if len(texts) != 1 || texts[0] != "ok" {
+		t.Errorf("Expected response 'ok', got %v", texts)
+	}
+}
+
+func TestStreamRequest_EmptyReplaceResponseClears(t *testing.T) {
+	events := []string{
+		"event: text\ndata: {\"text\": \"Draft\"}\n\n",
+		"event: replace_response\ndata: {\"text\": \"\"}\n\n",
+		"event: text\ndata: {\"text\": \"Final\"}\n\n",
+		"event: done\ndata: {}\n\n",
+	}
+
+	server := mockSSEServer(events)
+	defer server.Close()
+
+	opts := &StreamRequestOptions{
+		BaseURL:    server.URL + "/",
+		HTTPClient: &http.Client{Timeout: 5 * time.Second},
+	}
+
+	var messages []*types.PartialResponse
+	for msg := range StreamRequest(context.Background(), newTestQueryRequest("test"), "testbot", opts) {
+		messages = append(messages, msg)
+	}
+
+	if len(messages) != 3 {
+		t.Fatalf("Expected 3 messages, got %d", len(messages))
+	}
+	if messages[0].IsClearResponse() || messages[2].IsClearResponse() {
+		t.Error("Text events should not be reported as clear")
+	}
+	if !messages[1].IsClearResponse() {
+		t.Error("Expected empty replace_response to be reported as clear")
+	}
+
+	final, err := GetFinalResponse(context.Background(), newTestQueryRequest("test"), "testbot", "", opts)
+	if err != nil {
+		t.Fatalf("GetFinalResponse failed: %v", err)
+	}
+	if final != "Final" {
+		t.Errorf("Expected 'Final' after clear, got %q", final)
+	}
+}
+
+func TestStreamRequest_PlainTextErrorEvent(t *testing.T) {
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "event: error\ndata: upstream exploded \n\n")
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name     string
+		noRetry  bool
+		attempts int32
+	}{
+		{"retry by default", false, 3},
+		{"no retry when configured", true, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			atomic.StoreInt32(&attempts, 0)
+			opts := &StreamRequestOptions{
+				BaseURL:                 server.URL + "/",
+				NumTries:                3,
+				NoRetryOnPlainTextError: tt.noRetry,
+				clock:                   &fakeClock{},
+			}
+			for range StreamRequest(context.Background(), newTestQueryRequest("hi"), "testbot", opts) {
+			}
+			if got := atomic.LoadInt32(&attempts); got != tt.attempts {
+				t.Errorf("Expected %d attempts, got %d", tt.attempts, got)
+			}
+		})
+	}
+
+	t.Run("error carries trimmed text", func(t *testing.T) {
+		opts := &StreamRequestOptions{NoRetryOnPlainTextError: true}
+		opts.defaults()
+		ch := make(chan *types.PartialResponse, 1)
+		err := performQueryRequest(context.Background(), opts, server.URL, []byte("{}"), false, nil, ch)
+		if !IsBotErrorNoRetry(err) {
+			t.Fatalf("Expected BotErrorNoRetry, got %T: %v", err, err)
+		}
+		if err.Error() != "upstream exploded" {
+			t.Errorf("Expected raw error text, got %q", err.Error())
+		}
+	})
+}
+
+func TestCircuitBreaker_TripsAndResets(t *testing.T) {
+	var attempts int32
+	var healthy atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		if !healthy.Load() {
+			http.Error(w, "overloaded", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "event: text\ndata: {\"text\": \"ok\"}\n\nevent: done\ndata: {}\n\n")
+	}))
+	defer server.Close()
+
+	clk := &fakeClock{now: time.Unix(0, 0)}
+	breaker := NewCircuitBreaker(2, time.Minute, 30*time.Second)
+	breaker.clock = clk
+
+	newOpts := func() *StreamRequestOptions {
+		return &StreamRequestOptions{
+			BaseURL:        server.URL + "/",
+			NumTries:       1,
+			CircuitBreaker: breaker,
+			clock:          clk,
+		}
+	}
+	stream := func() []string {
+		var texts []string
+		for msg := range StreamRequest(context.Background(), newTestQueryRequest("hi"), "flaky", newOpts()) {
+			texts = append(texts, msg.Text)
+		}
+		return texts
+	}
+
+	stream()
+	stream()
+	if got := atomic.LoadInt32(&attempts); got != 2 {
+		t.Fatalf("Expected 2 attempts before tripping, got %d", got)
+	}
+
+	// Breaker is open: requests are short-circuited
+	stream()
+	if got := atomic.LoadInt32(&attempts); got != 2 {
+		t.Errorf("Expected request to be short-circuited, got %d attempts", got)
+	}
+	err := breaker.Allow("flaky")
+	var botErr *BotError
+	if !errors.As(err, &botErr) {
+		t.Errorf("Expected *BotError from open breaker, got %T: %v", err, err)
+	}
+	if breaker.Allow("other") != nil {
+		t.Error("Breaker should be keyed by bot name")
+	}
+
+	// After the cooldown a trial request goes through and closes the breaker
+	clk.Advance(31 * time.Second)
+	healthy.Store(true)
+	if texts := stream(); len(texts) != 1 || texts[0] != "ok" {
+		t.Errorf("Expected trial request to succeed, got %v", texts)
+	}
+	if err := breaker.Allow("flaky"); err != nil {
+		t.Errorf("Expected breaker to be closed after success, got %v", err)
+	}
+}
+
+func TestCircuitBreaker_HalfOpenFailureReopens(t *testing.T) {
+	clk := &fakeClock{now: time.Unix(0, 0)}
+	breaker := NewCircuitBreaker(3, time.Minute, 10*time.Second)
+	breaker.clock = clk
+
+	for i := 0; i < 3; i++ {
+		breaker.RecordFailure("bot")
+	}
+	if breaker.Allow("bot") == nil {
+		t.Fatal("Expected breaker to be open after threshold failures")
+	}
+
+	clk.Advance(11 * time.Second)
+	if err := breaker.Allow("bot"); err != nil {
+		t.Fatalf("Expected trial request after cooldown, got %v", err)
+	}
+	breaker.RecordFailure("bot")
+	if breaker.Allow("bot") == nil {
+		t.Error("Expected a failed trial request to reopen the breaker")
+	}
+
+	breaker.Reset("bot")
+	if err := breaker.Allow("bot"); err != nil {
+		t.Errorf("Expected breaker to be closed after Reset, got %v", err)
+	}
+
+	// Failures spread beyond the window don't trip the breaker
+	breaker.RecordFailure("bot")
+	breaker.RecordFailure("bot")
+	clk.Advance(2 * time.Minute)
+	breaker.RecordFailure("bot")
+	if err := breaker.Allow("bot"); err != nil {
+		t.Errorf("Expected failures outside the window to be forgotten, got %v", err)
+	}
+}
+
+func TestCircuitBreaker_HalfOpenAdmitsOneTrial(t *testing.T) {
+	clk := &fakeClock{now: time.Unix(0, 0)}
+	breaker := NewCircuitBreaker(1, time.Minute, 10*time.Second)
+	breaker.clock = clk
+	breaker.RecordFailure("bot")
+	clk.Advance(11 * time.Second)
+
+	var allowed atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if breaker.Allow("bot") == nil {
+				allowed.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := allowed.Load(); got != 1 {
+		t.Fatalf("Expected exactly one trial request, got %d", got)
+	}
+
+	// An abandoned trial hands the probe to the next caller
+	breaker.recordAbandoned("bot")
+	if err := breaker.Allow("bot"); err != nil {
+		t.Errorf("Expected a new trial after an abandoned one, got %v", err)
+	}
+	if breaker.Allow("bot") == nil {
+		t.Error("Expected other callers to be rejected during the new trial")
+	}
+	breaker.RecordSuccess("bot")
+	if err := breaker.Allow("bot"); err != nil {
+		t.Errorf("Expected breaker to be closed after a successful trial, got %v", err)
+	}
+}
+
+func TestCircuitBreaker_CountsOnlyHealthFailures(t *testing.T) {
+	started := make(chan struct{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		if strings.HasSuffix(r.URL.Path, "/picky") {
+			fmt.Fprint(w, "event: error\ndata: {\"allow_retry\": false, \"error_type\": \"user_caused_error\"}\n\n")
+			return
+		}
+		w.(http.Flusher).Flush()
+		started <- struct{}{}
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	breaker := NewCircuitBreaker(1, time.Minute, time.Minute)
+	run := func(ctx context.Context, botName string, opts *StreamRequestOptions) {
+		opts.BaseURL = server.URL + "/"
+		opts.NumTries = 1
+		opts.CircuitBreaker = breaker
+		for range StreamRequest(ctx, newTestQueryRequest("hi"), botName, opts) {
+		}
+	}
+
+	// Cancelled by the caller
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-started
+		cancel()
+	}()
+	run(ctx, "slow", &StreamRequestOptions{})
+	if err := breaker.Allow("slow"); err != nil {
+		t.Errorf("Expected a cancelled request not to count as a failure, got %v", err)
+	}
+
+	// An error event caused by the request
+	run(context.Background(), "picky", &StreamRequestOptions{})
+	if err := breaker.Allow("picky"); err != nil {
+		t.Errorf("Expected an error event not to count as a failure, got %v", err)
+	}
+
+	// Per-try deadline
+	go func() { <-started }()
+	run(context.Background(), "slow", &StreamRequestOptions{RequestTimeout: 50 * time.Millisecond})
+	if breaker.Allow("slow") == nil {
+		t.Error("Expected an expired per-try deadline to count as a failure")
+	}
+}
+
+func TestUploadFile_RetryClassification(t *testing.T) {
+	tests := []struct {
+		name      string
+		status    int
+		wantCalls int32
+	}{
+		{"unauthorized is permanent", http.StatusUnauthorized, 1},
+		{"rate limit is retried", http.StatusTooManyRequests, 3},
+		{"service unavailable is retried", http.StatusServiceUnavailable, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls.Add(1)
+				w.WriteHeader(tt.status)
+			}))
+			defer server.Close()
+
+			_, err := UploadFile(context.Background(), &UploadFileOptions{
+				File:     strings.NewReader("content"),
+				FileName: "a.txt",
+				APIKey:   "key",
+				BaseURL:  server.URL,
+				NumTries: 3,
+				clock:    &fakeClock{},
+			})
+			var uploadErr *AttachmentUploadError
+			if !errors.As(err, &uploadErr) {
+				t.Fatalf("Expected AttachmentUploadError, got %v", err)
+			}
+			if uploadErr.StatusCode != tt.status {
+				t.Errorf("Expected status %d, got %d", tt.status, uploadErr.StatusCode)
+			}
+			if got := calls.Load(); got != tt.wantCalls {
+				t.Errorf("Expected %d attempts, got %d", tt.wantCalls, got)
+			}
+		})
+	}
+}
+
+func TestUploadFile_RetryResendsFile(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			t.Errorf("Missing file part: %v", err)
+			return
+		}
+		content, _ := io.ReadAll(file)
+		if string(content) != "content" {
+			t.Errorf("Expected full file content on attempt %d, got %q", calls.Load()+1, content)
+		}
+		if calls.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, `{"attachment_url": "https://example.com/a.txt", "mime_type": "text/plain"}`)
+	}))
+	defer server.Close()
+
+	att, err := UploadFile(context.Background(), &UploadFileOptions{
+		File:     strings.NewReader("content"),
+		FileName: "a.txt",
+		APIKey:   "key",
+		BaseURL:  server.URL,
+		clock:    &fakeClock{},
+	})
+	if err != nil {
+		t.Fatalf("Upload failed: %v", err)
+	}
+	if att.URL != "https://example.com/a.txt" || calls.Load() != 2 {
+		t.Errorf("Expected success on second attempt, got %v after %d calls", att, calls.Load())
+	}
+}
+
+func TestStreamRequest_RedirectPolicy(t *testing.T) {
+	var mu sync.Mutex
+	var targetAuth []string
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		targetAuth = append(targetAuth, r.Header.Get("Authorization"))
+		mu.Unlock()
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "event: text\ndata: {\"text\": \"moved\"}\n\nevent: done\ndata: {}\n\n")
+	}))
+	defer target.Close()
+
+	// Redirect to a different host name so the hop is cross-domain
+	targetURL := strings.Replace(target.URL, "127.0.0.1", "localhost", 1)
+	redirector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, targetURL+r.URL.Path, http.StatusTemporaryRedirect)
+	}))
+	defer redirector.Close()
+
+	run := func(policy RedirectPolicy) string {
+		opts := &StreamRequestOptions{
+			APIKey:         "secret",
+			BaseURL:        redirector.URL + "/",
+			NumTries:       1,
+			RedirectPolicy: policy,
+		}
+		var text string
+		for msg := range StreamRequest(context.Background(), newTestQueryRequest("hi"), "bot", opts) {
+			text += msg.Text
+		}
+		return text
+	}
+
+	t.Run("follow drops authorization", func(t *testing.T) {
+		targetAuth = nil
+		if text := run(RedirectFollow); text != "moved" {
+			t.Fatalf("Expected redirect to be followed, got %q", text)
+		}
+		if len(targetAuth) != 1 || targetAuth[0] != "" {
+			t.Errorf("Expected Authorization to be dropped cross-domain, got %v", targetAuth)
+		}
+	})
+
+	t.Run("keep headers", func(t *testing.T) {
+		targetAuth = nil
+		if text := run(RedirectKeepHeaders); text != "moved" {
+			t.Fatalf("Expected redirect to be followed, got %q", text)
+		}
+		if len(targetAuth) != 1 || targetAuth[0] != "Bearer secret" {
+			t.Errorf("Expected Authorization to be re-attached, got %v", targetAuth)
+		}
+	})
+
+	t.Run("disallow", func(t *testing.T) {
+		targetAuth = nil
+		text := run(RedirectDisallow)
+		if text != "" || len(targetAuth) != 0 {
+			t.Errorf("Expected redirect not to be followed, got text %q and %d target hits", text, len(targetAuth))
+		}
+	})
+}
+
+func TestParsePartialToolArguments(t *testing.T) {
+	full := `{"location": "Paris, \"FR\"", "days": 3, "units": {"temp": "C"}, "tags": ["a", "b"], "verbose": true}`
+
+	tests := []struct {
+		prefixLen int
+		want      map[string]any
+	}{
+		{0, map[string]any{}},
+		{len(`{"location": "Par`), map[string]any{}},
+		{len(`{"location": "Paris, \"FR\""`), map[string]any{"location": `Paris, "FR"`}},
+		{len(`{"location": "Paris, \"FR\"", "days": 3`), map[string]any{"location": `Paris, "FR"`}},
+		{len(`{"location": "Paris, \"FR\"", "days": 3,`), map[string]any{"location": `Paris, "FR"`, "days": float64(3)}},
+		{len(`{"location": "Paris, \"FR\"", "days": 3, "units": {"temp": "C"`), map[string]any{"location": `Paris, "FR"`, "days": float64(3)}},
+		{len(`{"location": "Paris, \"FR\"", "days": 3, "units": {"temp": "C"}`), map[string]any{
+			"location": `Paris, "FR"`, "days": float64(3), "units": map[string]any{"temp": "C"},
+		}},
+		{len(`{"location": "Paris, \"FR\"", "days": 3, "units": {"temp": "C"}, "tags": ["a", "b"]`), map[string]any{
+			"location": `Paris, "FR"`, "days": float64(3), "units": map[string]any{"temp": "C"}, "tags": []any{"a", "b"},
+		}},
+		{len(full), map[string]any{
+			"location": `Paris, "FR"`, "days": float64(3), "units": map[string]any{"temp": "C"}, "tags": []any{"a", "b"}, "verbose": true,
+		}},
+	}
+
+	for _, tt := range tests {
+		args := full[:tt.prefixLen]
+		got := ParsePartialToolArguments(args)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParsePartialToolArguments(%q) = %v, want %v", args, got, tt.want)
+		}
+	}
+}
+
+func TestGetFinalResponse_SkipsThinking(t *testing.T) {
+	server := mockSSEServer([]string{
+		"event: thinking\ndata: {\"text\": \"Considering...\"}\n\n",
+		"event: text\ndata: {\"text\": \"Answer\"}\n\n",
+		"event: done\ndata: {}\n\n",
+	})
+	defer server.Close()
+
+	text, err := GetFinalResponse(context.Background(), newTestQueryRequest("hi"), "bot", "key", &StreamRequestOptions{BaseURL: server.URL + "/"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if text != "Answer" {
+		t.Errorf("Expected thinking to be excluded, got %q", text)
+	}
+}
+
+func TestStreamRequest_ShouldRetryResponse(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		switch calls.Add(1) {
+		case 1:
+			fmt.Fprint(w, "event: done\ndata: {}\n\n")
+		case 2:
+			fmt.Fprint(w, "event: text\ndata: {\"text\": \"Trunc\"}\n\nevent: done\ndata: {}\n\n")
+		default:
+			fmt.Fprint(w, "event: text\ndata: {\"text\": \"Complete.\"}\n\nevent: done\ndata: {}\n\n")
+		}
+	}))
+	defer server.Close()
+
+	incomplete := func(chunks []string) bool {
+		return !strings.HasSuffix(strings.Join(chunks, ""), ".")
+	}
+	clock := &fakeClock{}
+	opts := &StreamRequestOptions{
+		BaseURL:             server.URL + "/",
+		NumTries:            5,
+		ShouldRetryResponse: incomplete,
+		clock:               clock,
+	}
+
+	text, err := GetFinalResponse(context.Background(), newTestQueryRequest("hi"), "bot", "", opts)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if text != "Complete." {
+		t.Errorf("Expected retried response to replace the truncated one, got %q", text)
+	}
+	if calls.Load() != 3 {
+		t.Errorf("Expected 3 requests, got %d", calls.Load())
+	}
+
+	// Retries are bounded by NumTries and the last response is kept
+	calls.Store(1)
+	opts.NumTries = 1
+	text, _ = GetFinalResponse(context.Background(), newTestQueryRequest("hi"), "bot", "", opts)
+	if text != "Trunc" || calls.Load() != 2 {
+		t.Errorf("Expected a single try keeping the response, got %q after %d calls", text, calls.Load()-1)
+	}
+}
+
+func TestStreamUntil(t *testing.T) {
+	released := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		flusher := w.(http.Flusher)
+		for _, text := range []string{"Hello", " world", " <END>", " ignored"} {
+			fmt.Fprintf(w, "event: text\ndata: {\"text\": %q}\n\n", text)
+			flusher.Flush()
+		}
+		// Hold the stream open until the client cancels it
+		<-r.Context().Done()
+		close(released)
+	}))
+	defer server.Close()
+
+	var calls int
+	text, err := StreamUntil(context.Background(), newTestQueryRequest("hi"), "bot", "key", &StreamRequestOptions{BaseURL: server.URL + "/"}, func(accumulated string) bool {
+		calls++
+		return strings.Contains(accumulated, "<END>")
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if text != "Hello world <END>" {
+		t.Errorf("Expected text up to the marker, got %q", text)
+	}
+	if calls != 3 {
+		t.Errorf("Expected the predicate to be called 3 times, got %d", calls)
+	}
+
+	select {
+	case <-released:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the request to be cancelled")
+	}
+}
+
+func TestStreamRequestOptions_ValidateBaseURL(t *testing.T) {
+	tests := []struct {
+		baseURL string
+		wantErr string
+	}{
+		{"", ""},
+		{"https://api.poe.com/bot/", ""},
+		{"http://localhost:8080", ""},
+		{"api.poe.com/bot/", "scheme must be http or https"},
+		{"ftp://api.poe.com/bot/", "scheme must be http or https"},
+		{"https:///bot/", "missing host"},
+		{"http://[::1/bot/", "missing ']' in host"},
+	}
+	for _, tt := range tests {
+		err := (&StreamRequestOptions{BaseURL: tt.baseURL}).Validate()
+		if tt.wantErr == "" {
+			if err != nil {
+				t.Errorf("Validate(%q) = %v, want nil", tt.baseURL, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) || !strings.Contains(err.Error(), "invalid BaseURL") {
+			t.Errorf("Validate(%q) = %v, want error containing %q", tt.baseURL, err, tt.wantErr)
+		}
+	}
+
+	_, err := GetFinalResponse(context.Background(), newTestQueryRequest("hi"), "bot", "key", &StreamRequestOptions{BaseURL: "api.poe.com/bot/"})
+	if err == nil || !strings.Contains(err.Error(), "invalid BaseURL") {
+		t.Errorf("Expected GetFinalResponse to fail early, got %v", err)
+	}
+	_, err = UploadFile(context.Background(), &UploadFileOptions{APIKey: "key", FileURL: "https://example.com/a.png", BaseURL: "www.quora.com/poe_api/"})
+	if err == nil || !strings.Contains(err.Error(), "invalid BaseURL") {
+		t.Errorf("Expected UploadFile to fail early, got %v", err)
+	}
+	if err := SyncBotSettings("bot", "key", nil, "http://[::1/bot/"); err == nil || !strings.Contains(err.Error(), "invalid BaseURL") {
+		t.Errorf("Expected SyncBotSettings to fail early, got %v", err)
+	}
+}
+
+func TestToolCallAggregationWithoutExecutables(t *testing.T) {
+	server := mockSSEServer([]string{
+		"event: json\ndata: {\"choices\": [{\"delta\": {\"tool_calls\": [{\"index\": 0, \"id\": \"call_1\", \"type\": \"function\", \"function\": {\"name\": \"get_weather\", \"arguments\": \"\"}}]}, \"finish_reason\": null}]}\n\n",
+		"event: json\ndata: {\"choices\": [{\"delta\": {\"tool_calls\": [{\"index\": 0, \"function\": {\"arguments\": \"{\\\"location\\\":\"}}]}, \"finish_reason\": null}]}\n\n",
+		"event: json\ndata: {\"choices\": [{\"delta\": {\"tool_calls\": [{\"index\": 0, \"function\": {\"arguments\": \" \\\"Paris\\\"}\"}}]}, \"finish_reason\": null}]}\n\n",
+		"event: json\ndata: {\"choices\": [{\"delta\": {}, \"finish_reason\": \"tool_calls\"}]}\n\n",
+		"event: done\ndata: {}\n\n",
+	})
+	defer server.Close()
+
+	opts := &StreamRequestOptions{
+		BaseURL:                              server.URL + "/",
+		Tools:                                []types.ToolDefinition{{Type: "function", Function: types.FunctionDefinition{Name: "get_weather"}}},
+		AggregateToolCallsWithoutExecutables: true,
+	}
+
+	var aggregated []types.ToolCallDefinition
+	for msg := range StreamRequest(context.Background(), newTestQueryRequest("Weather in Paris?"), "testbot", opts) {
+		if len(msg.ToolCalls) > 0 {
+			t.Errorf("Expected no raw deltas, got %+v", msg.ToolCalls)
+		}
+		aggregated = append(aggregated, msg.AggregatedToolCalls...)
+	}
+
+	want := []types.ToolCallDefinition{{
+		ID:       "call_1",
+		Type:     "function",
+		Function: types.FunctionCallDefinition{Name: "get_weather", Arguments: `{"location": "Paris"}`},
+	}}
+	if !reflect.DeepEqual(aggregated, want) {
+		t.Errorf("Expected a single aggregated call %+v, got %+v", want, aggregated)
+	}
+}
+
+func TestStreamRequest_ExponentialBackoff(t *testing.T) {
+	server := mockSSEServer([]string{
+		"event: error\ndata: {\"allow_retry\": true, \"text\": \"busy\"}\n\n",
+	})
+	defer server.Close()
+
+	run := func(opts *StreamRequestOptions) []time.Duration {
+		clk := &fakeClock{now: time.Unix(0, 0)}
+		opts.BaseURL = server.URL + "/"
+		opts.clock = clk
+		for range StreamRequest(context.Background(), newTestQueryRequest("hi"), "testbot", opts) {
+		}
+		return clk.Sleeps()
+	}
+
+	base := time.Second
+	sleeps := run(&StreamRequestOptions{NumTries: 5, RetrySleepTime: base, BackoffStrategy: ExponentialBackoff{}})
+	if len(sleeps) != 4 {
+		t.Fatalf("Expected 4 retry sleeps, got %v", sleeps)
+	}
+	for i, d := range sleeps {
+		want := base << i
+		if d < want*3/4 || d > want*5/4 {
+			t.Errorf("Sleep %d: expected %v ±25%%, got %v", i, want, d)
+		}
+		if i > 0 && d <= sleeps[i-1] {
+			t.Errorf("Expected sleeps to grow, got %v", sleeps)
+		}
+	}
+
+	// MaxRetrySleepTime caps the growth
+	sleeps = run(&StreamRequestOptions{NumTries: 5, RetrySleepTime: base, BackoffStrategy: ExponentialBackoff{}, MaxRetrySleepTime: 3 * time.Second})
+	if last := sleeps[len(sleeps)-1]; last != 3*time.Second {
+		t.Errorf("Expected the last sleep to be capped at 3s, got %v", sleeps)
+	}
+
+	// Without a strategy the delay stays constant
+	sleeps = run(&StreamRequestOptions{NumTries: 3, RetrySleepTime: base})
+	if len(sleeps) != 2 || sleeps[0] != base || sleeps[1] != base {
+		t.Errorf("Expected constant sleeps of %v, got %v", base, sleeps)
+	}
+}
+
+func TestExponentialBackoff_LargeDelays(t *testing.T) {
+	for _, base := range []time.Duration{time.Minute, time.Hour} {
+		for _, attempt := range []int{30, 31, 100} {
+			if d := (ExponentialBackoff{}).NextDelay(attempt, base); d != math.MaxInt64 {
+				t.Errorf("NextDelay(%d, %v): expected the largest duration, got %v", attempt, base, d)
+			}
+		}
+	}
+}
+
+func TestGetFinalResponse_IndexedReplaceResponse(t *testing.T) {
+	server := mockSSEServer([]string{
+		"event: text\ndata: {\"text\": \"First \", \"index\": 0}\n\n",
+		"event: text\ndata: {\"text\": \"draft\", \"index\": 1}\n\n",
+		"event: text\ndata: {\"text\": \"answer.\", \"index\": 0}\n\n",
+		"event: replace_response\ndata: {\"text\": \"Second answer.\", \"index\": 1}\n\n",
+		"event: done\ndata: {}\n\n",
+	})
+	defer server.Close()
+
+	text, err := GetFinalResponse(context.Background(), newTestQueryRequest("hi"), "bot", "key", &StreamRequestOptions{BaseURL: server.URL + "/"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if text != "First answer.Second answer." {
+		t.Errorf("Expected only index 1 to be replaced, got %q", text)
+	}
+}
+
+func TestStreamRequest_Callbacks(t *testing.T) {
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		if atomic.AddInt32(&attempts, 1) < 3 {
+			fmt.Fprint(w, "event: error\ndata: {\"allow_retry\": true, \"text\": \"busy\"}\n\n")
+			return
+		}
+		fmt.Fprint(w, "event: text\ndata: {\"text\": \"Hello\"}\n\nevent: done\ndata: {}\n\n")
+	}))
+	defer server.Close()
+
+	var starts []string
+	var rawEvents []string
+	var retries []int
+	opts := &StreamRequestOptions{
+		BaseURL:        server.URL + "/",
+		NumTries:       3,
+		clock:          &fakeClock{now: time.Unix(0, 0)},
+		OnRequestStart: func(url string) { starts = append(starts, url) },
+		OnRawEvent:     func(event sse.Event) { rawEvents = append(rawEvents, event.Event) },
+		OnRetry: func(attempt int, err error) {
+			if err == nil {
+				t.Errorf("OnRetry called without an error")
+			}
+			retries = append(retries, attempt)
+		},
+	}
+	for range StreamRequest(context.Background(), newTestQueryRequest("hi"), "testbot", opts) {
+	}
+
+	if len(starts) != 3 || starts[0] != server.URL+"/testbot" {
+		t.Errorf("Expected 3 request starts for %s, got %v", server.URL+"/testbot", starts)
+	}
+	if !reflect.DeepEqual(rawEvents, []string{"error", "error", "text", "done"}) {
+		t.Errorf("Unexpected raw events: %v", rawEvents)
+	}
+	if !reflect.DeepEqual(retries, []int{0, 1}) {
+		t.Errorf("Expected retries after tries 0 and 1, got %v", retries)
+	}
+}
+
+func TestStreamRequest_CancelMidStream(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "event: text\ndata: {\"text\": \"first\"}\n\n")
+		w.(http.Flusher).Flush()
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := StreamRequest(ctx, newTestQueryRequest("hi"), "testbot", &StreamRequestOptions{BaseURL: server.URL + "/", NumTries: 3})
+
+	if msg := <-ch; msg == nil || msg.Text != "first" {
+		t.Fatalf("Expected the first text event, got %+v", msg)
+	}
+	cancel()
+
+	deadline := time.After(2 * time.Second)
+	for {
+		select {
+		case msg, ok := <-ch:
+			if !ok {
+				return
+			}
+			t.Errorf("Unexpected response after cancel: %+v", msg)
+		case <-deadline:
+			t.Fatal("Expected the stream to close promptly after cancel")
+		}
+	}
+}
+
+func TestExecuteTools_Concurrency(t *testing.T) {
+	const delay = 50 * time.Millisecond
+	var running, maxRunning int32
+	executables := []ToolExecutable{
+		{Name: "get_weather", Execute: func(ctx context.Context, args string) (string, error) {
+			n := atomic.AddInt32(&running, 1)
+			for {
+				m := atomic.LoadInt32(&maxRunning)
+				if n <= m || atomic.CompareAndSwapInt32(&maxRunning, m, n) {
+					break
+				}
+			}
+			time.Sleep(delay)
+			atomic.AddInt32(&running, -1)
+			return "sunny in " + args, nil
+		}},
+		{Name: "explode", Execute: func(ctx context.Context, args string) (string, error) {
+			panic("kaboom")
+		}},
+	}
+	var toolCalls []types.ToolCallDefinition
+	for i, city := range []string{"Paris", "Rome", "Oslo", "Lima"} {
+		toolCalls = append(toolCalls, types.ToolCallDefinition{
+			ID:       fmt.Sprintf("call_%d", i),
+			Type:     "function",
+			Function: types.FunctionCallDefinition{Name: "get_weather", Arguments: city},
+		})
+	}
+	toolCalls = append(toolCalls, types.ToolCallDefinition{ID: "call_4", Type: "function", Function: types.FunctionCallDefinition{Name: "explode"}})
+
+	run := func(maxConcurrent int) ([]types.ToolResultDefinition, time.Duration, int32) {
+		atomic.StoreInt32(&maxRunning, 0)
+		start := time.Now()
+		results, err := executeTools(context.Background(), &StreamRequestOptions{ToolExecutables: executables, MaxConcurrentTools: maxConcurrent}, toolCalls)
+		if err != nil {
+			t.Fatalf("executeTools failed: %v", err)
+		}
+		return results, time.Since(start), atomic.LoadInt32(&maxRunning)
+	}
+
+	sequential, seqElapsed, seqMax := run(1)
+	parallel, parElapsed, parMax := run(-1)
+	if seqMax != 1 {
+		t.Errorf("Expected sequential execution, got %d tools at once", seqMax)
+	}
+	if parMax != 4 || parElapsed >= seqElapsed {
+		t.Errorf("Expected unbounded execution to be faster (%v vs %v) with 4 tools at once, got %d", parElapsed, seqElapsed, parMax)
+	}
+	if _, _, bounded := run(2); bounded != 2 {
+		t.Errorf("Expected at most 2 tools at once, got %d", bounded)
+	}
+	if _, _, unset := run(0); unset != 1 {
+		t.Errorf("Expected tools to run one after another by default, got %d at once", unset)
+	}
+
+	for _, results := range [][]types.ToolResultDefinition{sequential, parallel} {
+		if len(results) != len(toolCalls) {
+			t.Fatalf("Expected %d results, got %+v", len(toolCalls), results)
+		}
+		for i, result := range results {
+			if result.ToolCallID != toolCalls[i].ID {
+				t.Errorf("Result %d: expected %s, got %s", i, toolCalls[i].ID, result.ToolCallID)
+			}
+		}
+		if results[0].Content != "sunny in Paris" {
+			t.Errorf("Unexpected result content: %q", results[0].Content)
+		}
+		if !strings.Contains(results[4].Content, "kaboom") {
+			t.Errorf("Expected the panic to become an error result, got %q", results[4].Content)
+		}
+	}
+}
+
+func TestStreamRequest_MultipleToolRounds(t *testing.T) {
+	toolCallEvent := func(id, city string) string {
+		return fmt.Sprintf("event: json\ndata: {\"choices\": [{\"delta\": {\"tool_calls\": [{\"index\": 0, \"id\": %q, \"type\": \"function\", \"function\": {\"name\": \"get_weather\", \"arguments\": %q}}]}, \"finish_reason\": null}]}\n\n", id, city) +
+			"event: json\ndata: {\"choices\": [{\"delta\": {}, \"finish_reason\": \"tool_calls\"}]}\n\nevent: done\ndata: {}\n\n"
+	}
+	var mu sync.Mutex
+	var payloads []map[string]any
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]any
+		json.NewDecoder(r.Body).Decode(&payload)
+		mu.Lock()
+		payloads = append(payloads, payload)
+		mu.Unlock()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		results, _ := payload["tool_results"].([]any)
+		switch len(results) {
+		case 0:
+			fmt.Fprint(w, toolCallEvent("call_1", "Paris"))
+		case 1:
+			fmt.Fprint(w, toolCallEvent("call_2", "Rome"))
+		default:
+			fmt.Fprint(w, "event: text\ndata: {\"text\": \"Both sunny\"}\n\nevent: done\ndata: {}\n\n")
+		}
+	}))
+	defer server.Close()
+
+	var executed []string
+	run := func(maxRounds int) string {
+		executed, payloads = nil, nil
+		opts := &StreamRequestOptions{
+			BaseURL:       server.URL + "/",
+			Tools:         []types.ToolDefinition{{Type: "function", Function: types.FunctionDefinition{Name: "get_weather"}}},
+			MaxToolRounds: maxRounds,
+			ToolExecutables: []ToolExecutable{{Name: "get_weather", Execute: func(ctx context.Context, args string) (string, error) {
+				executed = append(executed, args)
+				return "sunny", nil
+			}}},
+		}
+		var text strings.Builder
+		for msg := range StreamRequest(context.Background(), newTestQueryRequest("Weather?"), "testbot", opts) {
+			text.WriteString(msg.Text)
+		}
+		return text.String()
+	}
+
+	if text := run(2); text != "Both sunny" {
+		t.Errorf("Expected the final answer after two rounds, got %q", text)
+	}
+	if !reflect.DeepEqual(executed, []string{"Paris", "Rome"}) {
+		t.Errorf("Expected tools to run in two rounds, got %v", executed)
+	}
+	if len(payloads) != 3 {
+		t.Fatalf("Expected 3 requests, got %d", len(payloads))
+	}
+	last := payloads[2]
+	if calls, _ := last["tool_calls"].([]any); len(calls) != 2 {
+		t.Errorf("Expected both rounds' tool calls in the final payload, got %v", last["tool_calls"])
+	}
+	if results, _ := last["tool_results"].([]any); len(results) != 2 {
+		t.Errorf("Expected both rounds' tool results in the final payload, got %v", last["tool_results"])
+	}
+
+	// The default single round stops after the second response
+	if text := run(0); text != "" {
+		t.Errorf("Expected no final answer with one round, got %q", text)
+	}
+	if len(executed) != 1 || len(payloads) != 2 {
+		t.Errorf("Expected 1 execution and 2 requests, got %v and %d", executed, len(payloads))
+	}
+}
+
+func TestUploadFile_CustomFieldNames(t *testing.T) {
+	var fileField, fileContent string
+	var form map[string][]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/") {
+			r.ParseMultipartForm(1 << 20)
+			for name, files := range r.MultipartForm.File {
+				fileField = name
+				f, _ := files[0].Open()
+				data, _ := io.ReadAll(f)
+				fileContent = string(data)
+			}
+		} else {
+			r.ParseForm()
+			form = r.PostForm
+		}
+		fmt.Fprint(w, `{"attachment_url": "https://example.com/a.txt", "mime_type": "text/plain"}`)
+	}))
+	defer server.Close()
+
+	_, err := UploadFile(context.Background(), &UploadFileOptions{
+		APIKey:        "key",
+		File:          strings.NewReader("content"),
+		FileName:      "a.txt",
+		BaseURL:       server.URL,
+		FileFieldName: "upload",
+	})
+	if err != nil {
+		t.Fatalf("Upload failed: %v", err)
+	}
+	if fileField != "upload" || fileContent != "content" {
+		t.Errorf("Expected the file in field %q, got %q with %q", "upload", fileField, fileContent)
+	}
+
+	_, err = UploadFile(context.Background(), &UploadFileOptions{
+		APIKey:            "key",
+		FileURL:           "https://example.com/a.txt?x=1&y=2",
+		FileName:          "a.txt",
+		BaseURL:           server.URL,
+		URLFieldName:      "source",
+		FileNameFieldName: "name",
+	})
+	if err != nil {
+		t.Fatalf("Upload failed: %v", err)
+	}
+	if got := form["source"]; len(got) != 1 || got[0] != "https://example.com/a.txt?x=1&y=2" {
+		t.Errorf("Expected the URL in field source, got %v", form)
+	}
+	if got := form["name"]; len(got) != 1 || got[0] != "a.txt" {
+		t.Errorf("Expected the file name in field name, got %v", form)
+	}
+}
+
+func TestStreamRequest_DedupeConsecutiveIdenticalChunks(t *testing.T) {
+	server := mockSSEServer([]string{
+		"event: text\ndata: {\"text\": \"Hello\"}\n\n",
+		"event: text\ndata: {\"text\": \"Hello\"}\n\n",
+		"event: text\ndata: {\"text\": \"A\", \"index\": 1}\n\n",
+		"event: text\ndata: {\"text\": \" world\"}\n\n",
+		"event: text\ndata: {\"text\": \"A\", \"index\": 1}\n\n",
+		"event: text\ndata: {\"text\": \"Hello\", \"index\": 1}\n\n",
+		"event: done\ndata: {}\n\n",
+	})
+	defer server.Close()
+
+	collect := func(dedupe bool) []string {
+		opts := &StreamRequestOptions{BaseURL: server.URL + "/", DedupeConsecutiveIdenticalChunks: dedupe}
+		var texts []string
+		for msg := range StreamRequest(context.Background(), newTestQueryRequest("hi"), "bot", opts) {
+			index := -1
+			if msg.Index != nil {
+				index = *msg.Index
+			}
+			texts = append(texts, fmt.Sprintf("%d:%s", index, msg.Text))
+		}
+		return texts
+	}
+
+	want := []string{"-1:Hello", "1:A", "-1: world", "1:Hello"}
+	if got := collect(true); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected duplicates within an index to be dropped, got %q, want %q", got, want)
+	}
+	if got := collect(false); len(got) != 6 {
+		t.Errorf("Expected all 6 chunks by default, got %q", got)
+	}
+}
+
+func TestStreamRequest_ToolTimeout(t *testing.T) {
+	var mu sync.Mutex
+	var toolResults []any
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]any
+		json.NewDecoder(r.Body).Decode(&payload)
+		w.Header().Set("Content-Type", "text/event-stream")
+		if results, ok := payload["tool_results"].([]any); ok {
+			mu.Lock()
+			toolResults = results
+			mu.Unlock()
+			fmt.Fprint(w, "event: text\ndata: {\"text\": \"Sorry, the weather service is slow\"}\n\nevent: done\ndata: {}\n\n")
+			return
+		}
+		fmt.Fprint(w, "event: json\ndata: {\"choices\": [{\"delta\": {\"tool_calls\": [{\"index\": 0, \"id\": \"call_1\", \"type\": \"function\", \"function\": {\"name\": \"get_weather\", \"arguments\": \"{}\"}}]}, \"finish_reason\": null}]}\n\n")
+		fmt.Fprint(w, "event: json\ndata: {\"choices\": [{\"delta\": {}, \"finish_reason\": \"tool_calls\"}]}\n\nevent: done\ndata: {}\n\n")
+	}))
+	defer server.Close()
+
+	release := make(chan struct{})
+	defer close(release)
+	opts := &StreamRequestOptions{
+		BaseURL:     server.URL + "/",
+		Tools:       []types.ToolDefinition{{Type: "function", Function: types.FunctionDefinition{Name: "get_weather"}}},
+		ToolTimeout: 50 * time.Millisecond,
+		ToolExecutables: []ToolExecutable{{Name: "get_weather", Execute: func(ctx context.Context, args string) (string, error) {
+			<-release // ignores its context
+			return "sunny", nil
+		}}},
+	}
+
+	start := time.Now()
+	var text strings.Builder
+	for msg := range StreamRequest(context.Background(), newTestQueryRequest("Weather?"), "testbot", opts) {
+		text.WriteString(msg.Text)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("Expected the hanging tool to time out, took %v", elapsed)
+	}
+	if text.String() != "Sorry, the weather service is slow" {
+		t.Errorf("Expected the final answer, got %q", text.String())
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(toolResults) != 1 {
+		t.Fatalf("Expected 1 tool result, got %v", toolResults)
+	}
+	if content := toolResults[0].(map[string]any)["content"]; content != "error: tool execution timed out" {
+		t.Errorf("Expected a timeout result, got %v", content)
+	}
+}
+
+func TestStreamRequest_OnToolsExecuted(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]any
+		json.NewDecoder(r.Body).Decode(&payload)
+		w.Header().Set("Content-Type", "text/event-stream")
+		if payload["tool_results"] != nil {
+			fmt.Fprint(w, "event: text\ndata: {\"text\": \"It's sunny\"}\n\nevent: done\ndata: {}\n\n")
+			return
+		}
+		fmt.Fprint(w, "event: json\ndata: {\"choices\": [{\"delta\": {\"tool_calls\": [{\"index\": 0, \"id\": \"call_1\", \"type\": \"function\", \"function\": {\"name\": \"get_weather\", \"arguments\": \"{\\\"location\\\": \\\"Paris\\\"}\"}}]}, \"finish_reason\": null}]}\n\n")
+		fmt.Fprint(w, "event: json\ndata: {\"choices\": [{\"delta\": {}, \"finish_reason\": \"tool_calls\"}]}\n\nevent: done\ndata: {}\n\n")
+	}))
+	defer server.Close()
+
+	var calls [][]types.ToolCallDefinition
+	var results [][]types.ToolResultDefinition
+	opts := &StreamRequestOptions{
+		BaseURL: server.URL + "/",
+		Tools:   []types.ToolDefinition{{Type: "function", Function: types.FunctionDefinition{Name: "get_weather"}}},
+		ToolExecutables: []ToolExecutable{{Name: "get_weather", Execute: func(ctx context.Context, args string) (string, error) {
+			return "Sunny, 22C", nil
+		}}},
+		OnToolsExecuted: func(c []types.ToolCallDefinition, r []types.ToolResultDefinition) {
+			calls = append(calls, c)
+			results = append(results, r)
+		},
+	}
+	for range StreamRequest(context.Background(), newTestQueryRequest("Weather in Paris?"), "testbot", opts) {
+	}
+
+	wantCalls := []types.ToolCallDefinition{{ID: "call_1", Type: "function", Function: types.FunctionCallDefinition{Name: "get_weather", Arguments: `{"location": "Paris"}`}}}
+	wantResults := []types.ToolResultDefinition{{Role: "tool", ToolCallID: "call_1", Name: "get_weather", Content: "Sunny, 22C"}}
+	if len(calls) != 1 || !reflect.DeepEqual(calls[0], wantCalls) {
+		t.Errorf("Expected one callback with %+v, got %+v", wantCalls, calls)
+	}
+	if len(results) != 1 || !reflect.DeepEqual(results[0], wantResults) {
+		t.Errorf("Expected one callback with %+v, got %+v", wantResults, results)
+	}
+}
+
+func TestStreamRequest_AggregatedToolCallsWithExecutables(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]any
+		json.NewDecoder(r.Body).Decode(&payload)
+		w.Header().Set("Content-Type", "text/event-stream")
+		if payload["tool_results"] != nil {
+			fmt.Fprint(w, "event: text\ndata: {\"text\": \"It's sunny\"}\n\nevent: done\ndata: {}\n\n")
+			return
+		}
+		fmt.Fprint(w, "event: json\ndata: {\"choices\": [{\"delta\": {\"tool_calls\": [{\"index\": 0, \"id\": \"call_1\", \"type\": \"function\", \"function\": {\"name\": \"get_weather\", \"arguments\": \"{\\\"location\\\":\"}}]}, \"finish_reason\": null}]}\n\n")
+		fmt.Fprint(w, "event: json\ndata: {\"choices\": [{\"delta\": {\"tool_calls\": [{\"index\": 0, \"function\": {\"arguments\": \"\\\"Paris\\\"}\"}}]}, \"finish_reason\": null}]}\n\n")
+		fmt.Fprint(w, "event: json\ndata: {\"choices\": [{\"delta\": {}, \"finish_reason\": \"tool_calls\"}]}\n\nevent: done\ndata: {}\n\n")
+	}))
+	defer server.Close()
+
+	opts := &StreamRequestOptions{
+		BaseURL: server.URL + "/",
+		Tools:   []types.ToolDefinition{{Type: "function", Function: types.FunctionDefinition{Name: "get_weather"}}},
+		ToolExecutables: []ToolExecutable{{Name: "get_weather", Execute: func(ctx context.Context, args string) (string, error) {
+			return "Sunny", nil
+		}}},
+	}
+
+	var aggregated []types.ToolCallDefinition
+	var text strings.Builder
+	for msg := range StreamRequest(context.Background(), newTestQueryRequest("Weather in Paris?"), "testbot", opts) {
+		if len(msg.AggregatedToolCalls) > 0 {
+			if text.Len() > 0 {
+				t.Errorf("Expected the tool calls before the final answer")
+			}
+			aggregated = append(aggregated, msg.AggregatedToolCalls...)
+		}
+		text.WriteString(msg.Text)
+	}
+
+	want := []types.ToolCallDefinition{{ID: "call_1", Type: "function", Function: types.FunctionCallDefinition{Name: "get_weather", Arguments: `{"location":"Paris"}`}}}
+	if !reflect.DeepEqual(aggregated, want) {
+		t.Errorf("Expected aggregated call %+v, got %+v", want, aggregated)
+	}
+
+	final, err := GetFinalResponse(context.Background(), newTestQueryRequest("Weather in Paris?"), "testbot", "", opts)
+	if err != nil || final != "It's sunny" {
+		t.Errorf("Expected the tool calls to be excluded from the final text, got %q, %v", final, err)
+	}
+}
+
+func TestStreamRequest_EmptyBotName(t *testing.T) {
+	var paths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "event: text\ndata: {\"text\": \"Hello\"}\n\nevent: done\ndata: {}\n\n")
+	}))
+	defer server.Close()
+
+	_, err := GetFinalResponse(context.Background(), newTestQueryRequest("hi"), "", "key", &StreamRequestOptions{BaseURL: server.URL + "/"})
+	if !IsBotErrorNoRetry(err) || !strings.Contains(err.Error(), "bot name is empty") {
+		t.Errorf("Expected a BotErrorNoRetry for an empty bot name, got %v", err)
+	}
+	for msg := range GetBotResponse(context.Background(), []types.ProtocolMessage{{Role: "user", Content: "hi"}}, "", "key", &StreamRequestOptions{BaseURL: server.URL + "/"}) {
+		t.Errorf("Expected no responses for an empty bot name, got %+v", msg)
+	}
+	if len(paths) != 0 {
+		t.Errorf("Expected no requests, got %v", paths)
+	}
+
+	text, err := GetFinalResponse(context.Background(), newTestQueryRequest("hi"), "", "key", &StreamRequestOptions{BaseURL: server.URL + "/", DefaultBotName: "Fallback"})
+	if err != nil || text != "Hello" {
+		t.Fatalf("Expected the default bot to answer, got %q, %v", text, err)
+	}
+	if len(paths) != 1 || paths[0] != "/Fallback" {
+		t.Errorf("Expected a request to /Fallback, got %v", paths)
+	}
+}
+
+func TestExecuteTools_ValidateToolArgs(t *testing.T) {
+	var executed []string
+	opts := &StreamRequestOptions{
+		Tools: []types.ToolDefinition{{
+			Type: "function",
+			Function: types.FunctionDefinition{
+				Name: "get_weather",
+				Parameters: types.ParametersDefinition{
+					Type:       "object",
+					Properties: map[string]any{"location": map[string]any{"type": "string"}, "unit": map[string]any{"type": "string"}},
+					Required:   []string{"location", "unit"},
+				},
+			},
+		}},
+		ToolExecutables: []ToolExecutable{{Name: "get_weather", Execute: func(ctx context.Context, args string) (string, error) {
+			executed = append(executed, args)
+			return "sunny", nil
+		}}},
+		MaxConcurrentTools: 1,
+		ValidateToolArgs:   true,
+	}
+	call := func(id, args string) types.ToolCallDefinition {
+		return types.ToolCallDefinition{ID: id, Type: "function", Function: types.FunctionCallDefinition{Name: "get_weather", Arguments: args}}
+	}
+
+	results, err := executeTools(context.Background(), opts, []types.ToolCallDefinition{
+		call("valid", `{"location": "Paris", "unit": "C"}`),
+		call("missing", `{"unit": "C"}`),
+		call("invalid", `{"location": "Par`),
+	})
+	if err != nil {
+		t.Fatalf("executeTools failed: %v", err)
+	}
+	if !reflect.DeepEqual(executed, []string{`{"location": "Paris", "unit": "C"}`}) {
+		t.Errorf("Expected only the valid call to run, got %v", executed)
+	}
+	if results[0].Content != "sunny" {
+		t.Errorf("Unexpected result for valid args: %q", results[0].Content)
+	}
+	if results[1].Content != "error: invalid arguments for get_weather: missing required fields: location" {
+		t.Errorf("Unexpected result for missing fields: %q", results[1].Content)
+	}
+	if !strings.HasPrefix(results[2].Content, "error: invalid arguments for get_weather: arguments are not a valid JSON object") {
+		t.Errorf("Unexpected result for invalid JSON: %q", results[2].Content)
+	}
+}
+
+func TestUploadMultipleFiles(t *testing.T) {
+	var running, maxRunning int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for {
+			m := atomic.LoadInt32(&maxRunning)
+			if n <= m || atomic.CompareAndSwapInt32(&maxRunning, m, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+
+		r.ParseMultipartForm(1 << 20)
+		name := r.MultipartForm.File["file"][0].Filename
+		if strings.HasPrefix(name, "bad") {
+			http.Error(w, "rejected", http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintf(w, `{"attachment_url": "https://example.com/%s", "mime_type": "text/plain"}`, name)
+	}))
+	defer server.Close()
+
+	names := []string{"a.txt", "bad1.txt", "c.txt", "d.txt", "bad2.txt"}
+	var files []*UploadFileOptions
+	for _, name := range names {
+		files = append(files, &UploadFileOptions{APIKey: "key", File: strings.NewReader(name), FileName: name, BaseURL: server.URL})
+	}
+
+	attachments, err := UploadMultipleFiles(context.Background(), files, 2)
+	if len(attachments) != len(names) {
+		t.Fatalf("Expected %d entries, got %d", len(names), len(attachments))
+	}
+	for i, name := range names {
+		if strings.HasPrefix(name, "bad") {
+			if attachments[i] != nil {
+				t.Errorf("Expected no attachment for %s, got %+v", name, attachments[i])
+			}
+			continue
+		}
+		if attachments[i] == nil || attachments[i].URL != "https://example.com/"+name {
+			t.Errorf("Expected attachment %d for %s in order, got %+v", i, name, attachments[i])
+		}
+	}
+	if err == nil || !strings.Contains(err.Error(), "file 1 (bad1.txt)") || !strings.Contains(err.Error(), "file 4 (bad2.txt)") {
+		t.Errorf("Expected both failures in the error, got %v", err)
+	}
+	var uploadErr *AttachmentUploadError
+	if !errors.As(err, &uploadErr) || uploadErr.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected the upload errors to be unwrappable, got %v", err)
+	}
+	if got := atomic.LoadInt32(&maxRunning); got != 2 {
+		t.Errorf("Expected at most 2 concurrent uploads, got %d", got)
+	}
+}
+
+func TestUploadFile_OnProgress(t *testing.T) {
+	var failures atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		if failures.Add(-1) >= 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, `{"attachment_url": "https://example.com/big.bin", "mime_type": "application/octet-stream"}`)
+	}))
+	defer server.Close()
+
+	content := strings.Repeat("x", 100*1024)
+	upload := func(file io.Reader) (calls, completions int, last, total int64) {
+		_, err := UploadFile(context.Background(), &UploadFileOptions{
+			APIKey:   "key",
+			File:     file,
+			FileName: "big.bin",
+			BaseURL:  server.URL,
+			clock:    &fakeClock{},
+			OnProgress: func(written, size int64) {
+				if written <= last {
+					t.Errorf("Progress did not advance: %d after %d", written, last)
+				}
+				calls++
+				if written == int64(len(content)) {
+					completions++
+				}
+				last, total = written, size
+			},
+		})
+		if err != nil {
+			t.Fatalf("Upload failed: %v", err)
+		}
+		return calls, completions, last, total
+	}
+
+	// Progress counts the file bytes sent, not the multipart framing
+	calls, completions, last, total := upload(strings.NewReader(content))
+	if calls < 2 {
+		t.Errorf("Expected incremental progress, got %d calls", calls)
+	}
+	if last != int64(len(content)) || total != int64(len(content)) || completions != 1 {
+		t.Errorf("Expected final progress %d/%d once, got %d/%d (%d times)", len(content), len(content), last, total, completions)
+	}
+
+	// A reader without a size reports -1
+	_, _, last, total = upload(io.MultiReader(strings.NewReader(content)))
+	if last != int64(len(content)) || total != -1 {
+		t.Errorf("Expected final progress %d/-1, got %d/%d", len(content), last, total)
+	}
+
+	// Retries don't restart from zero or report the final count again
+	failures.Store(1)
+	_, completions, last, _ = upload(strings.NewReader(content))
+	if last != int64(len(content)) || completions != 1 {
+		t.Errorf("Expected the final count to be reported once across retries, got %d (%d times)", last, completions)
+	}
+}
+
+func TestUploadFile_ContentType(t *testing.T) {
+	var partType, formType string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/") {
+			r.ParseMultipartForm(1 << 20)
+			partType = r.MultipartForm.File["file"][0].Header.Get("Content-Type")
+		} else {
+			r.ParseForm()
+			formType = r.PostForm.Get("content_type")
+		}
+		fmt.Fprint(w, `{"attachment_url": "https://example.com/f", "mime_type": "text/plain"}`)
+	}))
+	defer server.Close()
+
+	upload := func(opts *UploadFileOptions) {
+		t.Helper()
+		opts.APIKey, opts.BaseURL = "key", server.URL
+		if _, err := UploadFile(context.Background(), opts); err != nil {
+			t.Fatalf("Upload failed: %v", err)
+		}
+	}
+
+	upload(&UploadFileOptions{File: strings.NewReader("a,b\n1,2\n"), FileName: "data.csv", ContentType: "text/csv"})
+	if partType != "text/csv" {
+		t.Errorf("Expected the explicit content type, got %q", partType)
+	}
+
+	upload(&UploadFileOptions{File: strings.NewReader("a,b\n1,2\n"), FileName: "data.csv"})
+	if partType != "application/octet-stream" {
+		t.Errorf("Expected the default content type for a plain reader, got %q", partType)
+	}
+
+	path := filepath.Join(t.TempDir(), "doc")
+	if err := os.WriteFile(path, []byte("%PDF-1.4\n%âãÏÓ\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	upload(&UploadFileOptions{File: f, FileName: "doc"})
+	if partType != "application/pdf" {
+		t.Errorf("Expected the content type to be detected from the file, got %q", partType)
+	}
+
+	upload(&UploadFileOptions{FileURL: "https://example.com/doc", FileName: "doc", ContentType: "application/pdf"})
+	if formType != "application/pdf" {
+		t.Errorf("Expected the content type form field, got %q", formType)
+	}
+}
+
+// countingReader counts the bytes read from r
+type countingReader struct {
+	r    io.Reader
+	read int64
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.read += int64(n)
+	return n, err
+}
+
+func TestUploadFile_MaxSize(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		fmt.Fprint(w, `{"attachment_url": "https://example.com/f.bin", "mime_type": "application/octet-stream"}`)
+	}))
+	defer server.Close()
+
+	const limit = 1024
+	file := &countingReader{r: strings.NewReader(strings.Repeat("x", 1024*1024))}
+	_, err := UploadFile(context.Background(), &UploadFileOptions{
+		APIKey:   "key",
+		File:     file,
+		FileName: "f.bin",
+		BaseURL:  server.URL,
+		MaxSize:  limit,
+	})
+	var uploadErr *AttachmentUploadError
+	if !errors.As(err, &uploadErr) {
+		t.Fatalf("Expected AttachmentUploadError, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "1024") || !strings.Contains(err.Error(), "exceeds") {
+		t.Errorf("Expected the error to state the exceeded limit, got %q", err)
+	}
+	if file.read > limit+1 {
+		t.Errorf("Expected reading to stop at the limit, read %d bytes", file.read)
+	}
+	if got := atomic.LoadInt32(&requests); got != 0 {
+		t.Errorf("Expected no upload request, got %d", got)
+	}
+
+	// A file of exactly MaxSize bytes is uploaded
+	_, err = UploadFile(context.Background(), &UploadFileOptions{
+		APIKey:   "key",
+		File:     strings.NewReader(strings.Repeat("x", limit)),
+		FileName: "f.bin",
+		BaseURL:  server.URL,
+		MaxSize:  limit,
+	})
+	if err != nil {
+		t.Errorf("Expected a file at the limit to upload, got %v", err)
+	}
+}
+
+func TestGetFinalResponse_ErrorTypePredicates(t *testing.T) {
+	predicates := map[types.ErrorType]func(error) bool{
+		types.ErrorInsufficientFund:          IsInsufficientFund,
+		types.ErrorUserMessageTooLong:        IsUserMessageTooLong,
+		types.ErrorUserCausedError:           IsUserCausedError,
+		types.ErrorPrivacyAuthorizationError: IsPrivacyAuthorizationError,
+	}
+
+	for errorType := range predicates {
+		t.Run(errorType, func(t *testing.T) {
+			server := mockSSEServer([]string{
+				fmt.Sprintf("event: error\ndata: {\"allow_retry\": false, \"text\": \"failed\", \"error_type\": %q}\n\n", errorType),
+			})
+			defer server.Close()
+
+			var reported error
+			_, err := GetFinalResponse(context.Background(), newTestQueryRequest("hi"), "testbot", "key", &StreamRequestOptions{
+				BaseURL: server.URL + "/",
+				OnError: func(err error) { reported = err },
+			})
+			if err == nil {
+				t.Fatal("Expected an error")
+			}
+			if reported != err {
+				t.Errorf("Expected OnError to get the returned error, got %v", reported)
+			}
+			if got := ErrorTypeOf(err); got != errorType {
+				t.Errorf("Expected error type %q, got %q", errorType, got)
+			}
+			for other, is := range predicates {
+				if is(err) != (other == errorType) {
+					t.Errorf("Predicate for %q returned %v", other, is(err))
+				}
+			}
+		})
+	}
+
+	// Retryable errors keep their type after the last try
+	server := mockSSEServer([]string{
+		"event: error\ndata: {\"text\": \"no funds\", \"error_type\": \"insufficient_fund\"}\n\n",
+	})
+	defer server.Close()
+	_, err := GetFinalResponse(context.Background(), newTestQueryRequest("hi"), "testbot", "key", &StreamRequestOptions{
+		BaseURL:  server.URL + "/",
+		NumTries: 2,
+		clock:    &fakeClock{},
+	})
+	if !IsInsufficientFund(err) {
+		t.Errorf("Expected an insufficient_fund error, got %v", err)
+	}
+	if IsInsufficientFund(fmt.Errorf("insufficient_fund")) {
+		t.Error("Expected plain errors not to match")
+	}
+}
+
+func TestUploadFile_InlineRefAndName(t *testing.T) {
+	response := `{"attachment_url": "https://example.com/a.png", "mime_type": "image/png", "inline_ref": "img1", "name": "chart.png"}`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, response)
+	}))
+	defer server.Close()
+
+	upload := func() *types.Attachment {
+		att, err := UploadFile(context.Background(), &UploadFileOptions{
+			APIKey:   "key",
+			File:     strings.NewReader("data"),
+			FileName: "local.png",
+			BaseURL:  server.URL,
+		})
+		if err != nil {
+			t.Fatalf("Upload failed: %v", err)
+		}
+		return att
+	}
+
+	att := upload()
+	if att.InlineRef == nil || *att.InlineRef != "img1" {
+		t.Errorf("Expected inline_ref 'img1', got %v", att.InlineRef)
+	}
+	if att.Name != "chart.png" {
+		t.Errorf("Expected name from the response, got %q", att.Name)
+	}
+
+	// Without them, the option's name is used and InlineRef stays nil
+	response = `{"attachment_url": "https://example.com/a.png", "mime_type": "image/png"}`
+	att = upload()
+	if att.InlineRef != nil {
+		t.Errorf("Expected no inline_ref, got %q", *att.InlineRef)
+	}
+	if att.Name != "local.png" {
+		t.Errorf("Expected name 'local.png', got %q", att.Name)
+	}
+}
+
+func TestValidateRequest(t *testing.T) {
+	hot, cold := 3.0, 0.5
+	validTool := types.ToolDefinition{Type: "function", Function: types.FunctionDefinition{
+		Name:       "get_weather",
+		Parameters: types.ParametersDefinition{Type: "object"},
+	}}
+
+	tests := []struct {
+		name    string
+		modify  func(req *types.QueryRequest, opts *StreamRequestOptions)
+		botName string
+		wantErr string
+	}{
+		{name: "valid", botName: "bot"},
+		{name: "empty bot name", wantErr: "bot name is empty"},
+		{
+			name:    "bad base URL",
+			botName: "bot",
+			modify:  func(req *types.QueryRequest, opts *StreamRequestOptions) { opts.BaseURL = "api.poe.com/bot/" },
+			wantErr: "invalid BaseURL",
+		},
+		{
+			name:    "no messages",
+			botName: "bot",
+			modify:  func(req *types.QueryRequest, opts *StreamRequestOptions) { req.Query = nil },
+			wantErr: "no messages",
+		},
+		{
+			name:    "invalid role",
+			botName: "bot",
+			modify: func(req *types.QueryRequest, opts *StreamRequestOptions) {
+				req.Query = append(req.Query, types.ProtocolMessage{Role: "assistant", Content: "hi"})
+			},
+			wantErr: `message 1: invalid role "assistant"`,
+		},
+		{
+			name:    "invalid tool",
+			botName: "bot",
+			modify: func(req *types.QueryRequest, opts *StreamRequestOptions) {
+				bad := validTool
+				bad.Type = "plugin"
+				opts.Tools = []types.ToolDefinition{validTool, bad}
+			},
+			wantErr: "unsupported type",
+		},
+		{
+			name:    "temperature out of range",
+			botName: "bot",
+			modify:  func(req *types.QueryRequest, opts *StreamRequestOptions) { req.Temperature = &hot },
+			wantErr: "temperature 3",
+		},
+		{
+			name:    "valid generation params",
+			botName: "bot",
+			modify: func(req *types.QueryRequest, opts *StreamRequestOptions) {
+				req.Temperature = &cold
+				req.LogitBias = map[string]float64{"42": -100}
+				req.StopSequences = []string{"\n\n"}
+				opts.Tools = []types.ToolDefinition{validTool}
+			},
+		},
+		{
+			name:    "logit bias out of range",
+			botName: "bot",
+			modify: func(req *types.QueryRequest, opts *StreamRequestOptions) {
+				req.LogitBias = map[string]float64{"42": 150}
+			},
+			wantErr: "logit bias 150",
+		},
+		{
+			name:    "empty stop sequence",
+			botName: "bot",
+			modify:  func(req *types.QueryRequest, opts *StreamRequestOptions) { req.StopSequences = []string{"END", ""} },
+			wantErr: "stop sequence 1 is empty",
+		},
+		{
+			name:    "first error wins",
+			botName: "bot",
+			modify: func(req *types.QueryRequest, opts *StreamRequestOptions) {
+				req.Query = nil
+				req.Temperature = &hot
+			},
+			wantErr: "no messages",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := newTestQueryRequest("hi")
+			opts := &StreamRequestOptions{}
+			if tt.modify != nil {
+				tt.modify(req, opts)
+			}
+			err := ValidateRequest(req, tt.botName, opts)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("Expected no error, got %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Expected error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestStreamRequest_ValidateRequestOption(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "event: text\ndata: {\"text\": \"ok\"}\n\nevent: done\ndata: {}\n\n")
+	}))
+	defer server.Close()
+
+	req := newTestQueryRequest("hi")
+	req.Query[0].Role = "robot"
+
+	// Off by default: the request is sent as is
+	for range StreamRequest(context.Background(), req, "testbot", &StreamRequestOptions{BaseURL: server.URL + "/"}) {
+	}
+	if got := atomic.LoadInt32(&requests); got != 1 {
+		t.Fatalf("Expected the request to be sent without validation, got %d requests", got)
+	}
+
+	opts := &StreamRequestOptions{BaseURL: server.URL + "/", ValidateRequest: true}
+	for range StreamRequest(context.Background(), req, "testbot", opts) {
+	}
+	if got := atomic.LoadInt32(&requests); got != 1 {
+		t.Errorf("Expected the invalid request not to be sent, got %d requests", got)
+	}
+	// GetFinalResponse validates once, through StreamRequest
+	var reported []error
+	opts.OnError = func(err error) { reported = append(reported, err) }
+	_, err := GetFinalResponse(context.Background(), req, "testbot", "key", opts)
+	if err == nil || !strings.Contains(err.Error(), "invalid role") {
+		t.Errorf("Expected GetFinalResponse to return the validation error, got %v", err)
+	}
+	if len(reported) != 1 || reported[0] != err {
+		t.Errorf("Expected the validation error to be reported once, got %v", reported)
+	}
+
+	// A bot at the root path has no name to validate
+	responses, err := QueryBotURL(context.Background(), server.URL, []types.ProtocolMessage{{Role: "user", Content: "hi"}},
+		&StreamRequestOptions{ValidateRequest: true})
+	if err != nil || len(responses) == 0 || responses[0].Text != "ok" {
+		t.Errorf("Expected a validated request to a root bot to succeed, got %v, %v", responses, err)
+	}
+}
+
+func TestStreamRequest_ReportsSetupErrors(t *testing.T) {
+	server := mockSSEServer([]string{"event: done\ndata: {}\n\n"})
+	defer server.Close()
+
+	bad := newTestQueryRequest("hi")
+	bad.Query[0].Role = "robot"
+	tests := []struct {
+		name    string
+		botName string
+		req     *types.QueryRequest
+		opts    StreamRequestOptions
+		want    string
+	}{
+		{"invalid base URL", "testbot", newTestQueryRequest("hi"), StreamRequestOptions{BaseURL: "not a url"}, "invalid BaseURL"},
+		{"empty bot name", "", newTestQueryRequest("hi"), StreamRequestOptions{BaseURL: server.URL + "/"}, "bot name is empty"},
+		{"invalid request", "testbot", bad, StreamRequestOptions{BaseURL: server.URL + "/", ValidateRequest: true}, "invalid role"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var reported []error
+			opts := tt.opts
+			opts.OnError = func(err error) { reported = append(reported, err) }
+			for range StreamRequest(context.Background(), tt.req, tt.botName, &opts) {
+			}
+			if len(reported) != 1 || !strings.Contains(reported[0].Error(), tt.want) {
+				t.Errorf("Expected one error containing %q, got %v", tt.want, reported)
+			}
+		})
+	}
+}
+
+func TestStreamRequest_LargeEventLine(t *testing.T) {
+	text := strings.Repeat("a", 100*1024)
+	server := mockSSEServer([]string{
+		fmt.Sprintf("event: text\ndata: {\"text\": %q}\n\n", text),
+		"event: done\ndata: {}\n\n",
+	})
+	defer server.Close()
+
+	var got strings.Builder
+	for msg := range StreamRequest(context.Background(), newTestQueryRequest("hi"), "testbot", &StreamRequestOptions{BaseURL: server.URL + "/"}) {
+		got.WriteString(msg.Text)
+	}
+	if got.String() != text {
+		t.Errorf("Expected %d bytes of text, got %d", len(text), got.Len())
+	}
+}
@@ -0,0 +1,15 @@
+package client
+
+import "time"
+
+// clock abstracts time so retry and backoff logic can be tested without real sleeps
+type clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+// realClock is the default clock backed by the time package
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
@@ -30,6 +30,15 @@
 //	}
 //	finalText, err := client.GetFinalResponse(ctx, req, "GPT-4o", apiKey, nil)
 //
+// # Client
+//
+// For long-lived use, create a Client that holds default options and a shared
+// HTTP client, and close it when done:
+//
+//	c := client.NewClient(apiKey, nil)
+//	defer c.Close()
+//	text, err := c.GetFinalResponse(ctx, req, "GPT-4o")
+//
 // # Tool Calling
 //
 // Define tools and executables for OpenAI-compatible function calling:
@@ -97,6 +106,23 @@
 //	}
 //	attachment, err := client.UploadFile(ctx, opts)
 //
+// # Streamed Attachments
+//
+// A bot may stream or update an attachment by emitting several file events
+// with the same inline_ref. The client merges each update into the previous
+// attachment with that inline_ref (fields missing from the update are kept),
+// so every emitted PartialResponse carries the current state of the file.
+// Use CoalesceAttachments to collapse the collected attachments into one
+// entry per inline_ref:
+//
+//	var attachments []types.Attachment
+//	for msg := range ch {
+//	    if msg.Attachment != nil {
+//	        attachments = append(attachments, *msg.Attachment)
+//	    }
+//	}
+//	attachments = client.CoalesceAttachments(attachments)
+//
 // # Settings Sync
 //
 // Sync bot settings with the Poe API:
@@ -145,7 +171,8 @@
 //
 // The client handles these Server-Sent Event types:
 //   - text: Regular response text
-//   - replace_response: Replace previous response
+//   - replace_response: Replace previous response (empty text clears it;
+//     see PartialResponse.IsClearResponse)
 //   - suggested_reply: Suggested reply button
 //   - file: File attachment
 //   - json: Arbitrary JSON data
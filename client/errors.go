@@ -1,11 +1,22 @@
 package client
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/n0madic/go-poe/types"
+)
 
 // BotError is raised when there is an error communicating with the bot
 type BotError struct {
 	Message string
 	Cause   error
+	// ErrorType is the error_type of the bot's error event, if any
+	ErrorType types.ErrorType
+	// unavailable marks transport errors and 5xx responses, which count as
+	// circuit breaker failures
+	unavailable bool
 }
 
 func (e *BotError) Error() string {
@@ -28,9 +39,65 @@ func IsBotErrorNoRetry(err error) bool {
 	return ok
 }
 
+// ErrorTypeOf returns the error_type of the bot error event behind err, or ""
+func ErrorTypeOf(err error) types.ErrorType {
+	var noRetry *BotErrorNoRetry
+	if errors.As(err, &noRetry) {
+		return noRetry.ErrorType
+	}
+	var botErr *BotError
+	if errors.As(err, &botErr) {
+		return botErr.ErrorType
+	}
+	return ""
+}
+
+// IsInsufficientFund reports whether err is a bot error of type
+// insufficient_fund, e.g. so the user can be asked to top up
+func IsInsufficientFund(err error) bool {
+	return ErrorTypeOf(err) == types.ErrorInsufficientFund
+}
+
+// IsUserMessageTooLong reports whether err is a bot error of type
+// user_message_too_long
+func IsUserMessageTooLong(err error) bool {
+	return ErrorTypeOf(err) == types.ErrorUserMessageTooLong
+}
+
+// IsUserCausedError reports whether err is a bot error of type
+// user_caused_error
+func IsUserCausedError(err error) bool {
+	return ErrorTypeOf(err) == types.ErrorUserCausedError
+}
+
+// IsPrivacyAuthorizationError reports whether err is a bot error of type
+// privacy_authorization_error
+func IsPrivacyAuthorizationError(err error) bool {
+	return ErrorTypeOf(err) == types.ErrorPrivacyAuthorizationError
+}
+
+// rejectedResponseError reports a complete response rejected by
+// StreamRequestOptions.ShouldRetryResponse
+type rejectedResponseError struct {
+	hadText     bool
+	attachments *AttachmentIndex
+}
+
+func (e *rejectedResponseError) Error() string { return "response rejected by ShouldRetryResponse" }
+
 // AttachmentUploadError is raised when there is an error uploading an attachment
 type AttachmentUploadError struct {
-	Message string
+	Message    string
+	StatusCode int // HTTP status of the upload response, 0 if none was received
 }
 
 func (e *AttachmentUploadError) Error() string { return e.Message }
+
+// Retryable reports whether the upload may succeed on a later attempt.
+// Client errors (4xx other than 429) are permanent.
+func (e *AttachmentUploadError) Retryable() bool {
+	if e.StatusCode == http.StatusTooManyRequests {
+		return true
+	}
+	return e.StatusCode < 400 || e.StatusCode >= 500
+}
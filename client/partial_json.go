@@ -0,0 +1,74 @@
+package client
+
+import "strings"
+
+// ParsePartialToolArguments leniently parses the arguments of a tool call that
+// are still being streamed. args is the concatenation of the argument deltas
+// received so far; the result holds the top-level fields whose values are
+// already complete. Fields still being written, including partially streamed
+// strings, objects and arrays, are left out until they are finished. The
+// result is empty (never nil) if no field is complete yet.
+func ParsePartialToolArguments(args string) map[string]any {
+	result := make(map[string]any)
+	trimmed := strings.TrimSpace(args)
+	if !strings.HasPrefix(trimmed, "{") {
+		return result
+	}
+	if jsonUnmarshal([]byte(trimmed), &result) == nil {
+		return result
+	}
+
+	// Find the end of the last complete top-level member
+	depth := 0
+	inString, escaped := false, false
+	inValue := false // a top-level value is being read
+	lastComplete := -1
+	for i := 0; i < len(trimmed); i++ {
+		c := trimmed[i]
+		if inString {
+			switch {
+			case escaped:
+				escaped = false
+			case c == '\\':
+				escaped = true
+			case c == '"':
+				inString = false
+				if depth == 1 && inValue {
+					lastComplete = i + 1
+				}
+			}
+			continue
+		}
+		switch c {
+		case '"':
+			inString = true
+		case '{', '[':
+			depth++
+		case '}', ']':
+			depth--
+			if depth == 1 && inValue {
+				lastComplete = i + 1
+			}
+		case ':':
+			if depth == 1 {
+				inValue = true
+			}
+		case ',':
+			if depth == 1 {
+				if inValue {
+					lastComplete = i
+				}
+				inValue = false
+			}
+		}
+	}
+	if lastComplete < 0 {
+		return result
+	}
+
+	partial := make(map[string]any)
+	if jsonUnmarshal([]byte(trimmed[:lastComplete]+"}"), &partial) != nil {
+		return result
+	}
+	return partial
+}
@@ -0,0 +1,67 @@
+package client
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/n0madic/go-poe/types"
+)
+
+// Client holds default options and an HTTP client shared across requests.
+// It is safe for concurrent use. Call Close when the client is no longer needed.
+// The package-level functions remain available for one-off calls.
+type Client struct {
+	opts StreamRequestOptions
+}
+
+// NewClient creates a Client using apiKey and the given default options.
+// opts may be nil. The options are copied; later changes to opts have no effect.
+func NewClient(apiKey string, opts *StreamRequestOptions) *Client {
+	c := &Client{}
+	if opts != nil {
+		c.opts = *opts
+	}
+	if apiKey != "" {
+		c.opts.APIKey = apiKey
+	}
+	c.opts.defaults()
+	return c
+}
+
+// HTTPClient returns the HTTP client used for all requests
+func (c *Client) HTTPClient() *http.Client { return c.opts.HTTPClient }
+
+// options returns a per-request copy of the default options
+func (c *Client) options() *StreamRequestOptions {
+	opts := c.opts
+	return &opts
+}
+
+// Stream streams a response from botName, like StreamRequest
+func (c *Client) Stream(ctx context.Context, req *types.QueryRequest, botName string) <-chan *types.PartialResponse {
+	return StreamRequest(ctx, req, botName, c.options())
+}
+
+// GetFinalResponse collects the full response text from botName, like GetFinalResponse
+func (c *Client) GetFinalResponse(ctx context.Context, req *types.QueryRequest, botName string) (string, error) {
+	return GetFinalResponse(ctx, req, botName, "", c.options())
+}
+
+// Upload uploads a file, like UploadFile. The client's API key and HTTP client
+// are used unless set in opts.
+func (c *Client) Upload(ctx context.Context, opts *UploadFileOptions) (*types.Attachment, error) {
+	uploadOpts := *opts
+	if uploadOpts.APIKey == "" {
+		uploadOpts.APIKey = c.opts.APIKey
+	}
+	if uploadOpts.HTTPClient == nil {
+		uploadOpts.HTTPClient = c.opts.HTTPClient
+	}
+	return UploadFile(ctx, &uploadOpts)
+}
+
+// Close releases resources held by the client, such as idle connections
+func (c *Client) Close() error {
+	c.opts.HTTPClient.CloseIdleConnections()
+	return nil
+}
@@ -3,30 +3,57 @@ package client
 import (
 	"bytes"
 	"context"
-	"encoding/json"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
+	"strings"
 
 	"github.com/n0madic/go-poe/sse"
 	"github.com/n0madic/go-poe/types"
 )
 
+// httpClient returns the HTTP client for a bot call under the redirect policy
+func (o *StreamRequestOptions) httpClient() *http.Client {
+	switch o.RedirectPolicy {
+	case RedirectDisallow:
+		c := *o.HTTPClient
+		c.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+		return &c
+	case RedirectKeepHeaders:
+		c := *o.HTTPClient
+		c.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxRedirects {
+				return fmt.Errorf("stopped after %d redirects", maxRedirects)
+			}
+			for k, v := range via[0].Header {
+				if _, ok := req.Header[k]; !ok {
+					req.Header[k] = v
+				}
+			}
+			return nil
+		}
+		return &c
+	default:
+		return o.HTTPClient
+	}
+}
+
+// maxEventLineBytes is the longest SSE line accepted from a bot, so that a
+// large JSON payload on one data line doesn't abort the stream
+const maxEventLineBytes = 1 << 20
+
 // performQueryRequest sends a query and parses SSE responses into the channel
 func performQueryRequest(
 	ctx context.Context,
-	httpClient *http.Client,
+	opts *StreamRequestOptions,
 	url string,
-	payload map[string]any,
+	body []byte,
+	hasTools bool,
 	headers map[string]string,
 	ch chan<- *types.PartialResponse,
 ) error {
-	body, err := json.Marshal(payload)
-	if err != nil {
-		return &BotError{Message: fmt.Sprintf("failed to marshal request: %v", err)}
-	}
-
 	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
 	if err != nil {
 		return &BotError{Message: fmt.Sprintf("failed to create request: %v", err)}
@@ -38,47 +65,91 @@ func performQueryRequest(
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Accept", "text/event-stream")
 
-	resp, err := httpClient.Do(req)
+	if opts.OnRequestStart != nil {
+		opts.OnRequestStart(url)
+	}
+
+	resp, err := opts.httpClient().Do(req)
 	if err != nil {
-		return &BotError{Message: fmt.Sprintf("HTTP request failed: %v", err), Cause: err}
+		return &BotError{Message: fmt.Sprintf("HTTP request failed: %v", err), Cause: err, unavailable: true}
 	}
 	defer resp.Body.Close()
 
-	reader := sse.NewReader(resp.Body)
+	if resp.StatusCode >= 500 {
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return &BotError{
+			Message:     fmt.Sprintf("bot responded with %s: %s", resp.Status, strings.TrimSpace(string(respBody))),
+			unavailable: true,
+		}
+	}
+
+	if opts.RedirectPolicy == RedirectDisallow && resp.StatusCode >= 300 && resp.StatusCode < 400 {
+		return &BotErrorNoRetry{BotError{
+			Message: fmt.Sprintf("bot call redirected with status %d to %q; redirects are disabled", resp.StatusCode, resp.Header.Get("Location")),
+		}}
+	}
+
+	// Read events in a goroutine so that cancelling ctx stops the loop
+	// between events even while a read is blocked
+	stop := make(chan struct{})
+	defer close(stop)
+	events := readEvents(sse.NewReaderSize(resp.Body, maxEventLineBytes), stop)
 	var chunks []string
 	eventCount := 0
 	errorReported := false
-	hasTools := payload["tools"] != nil
+	// Attachments streamed in several file events are coalesced by inline_ref
+	inlineAttachments := NewAttachmentIndex()
+	// Last text chunk per index, for DedupeConsecutiveIdenticalChunks
+	lastText := make(map[int]string)
 
 	for {
-		event, err := reader.ReadEvent()
+		var result readResult
+		select {
+		case <-ctx.Done():
+			return &BotError{Message: fmt.Sprintf("request cancelled: %v", ctx.Err()), Cause: ctx.Err()}
+		case result = <-events:
+		}
+		event, err := result.event, result.err
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
-			return &BotError{Message: fmt.Sprintf("SSE read error: %v", err), Cause: err}
+			return &BotError{Message: fmt.Sprintf("SSE read error: %v", err), Cause: err, unavailable: true}
 		}
 
 		eventCount++
+		if opts.OnRawEvent != nil {
+			opts.OnRawEvent(event)
+		}
 
-		// Parse index from data if present
+		// Parse index and full_prompt from data if present
 		var index *int
+		var fullPrompt *string
 		if event.Data != "" {
 			var dataMap map[string]any
-			if json.Unmarshal([]byte(event.Data), &dataMap) == nil {
+			if jsonUnmarshal([]byte(event.Data), &dataMap) == nil {
 				if idx, ok := dataMap["index"]; ok {
 					if idxFloat, ok := idx.(float64); ok {
 						idxInt := int(idxFloat)
 						index = &idxInt
 					}
 				}
+				if fp, ok := dataMap["full_prompt"].(string); ok {
+					fullPrompt = &fp
+				}
 			}
 		}
 
 		switch event.Event {
 		case "done":
 			if len(chunks) == 0 && !errorReported && !hasTools {
-				log.Printf("Bot returned no text in response")
+				types.Logf(ctx, "Bot returned no text in response")
+			}
+			if opts.ShouldRetryResponse != nil && opts.ShouldRetryResponse(chunks) {
+				return &rejectedResponseError{hadText: len(chunks) > 0, attachments: inlineAttachments}
+			}
+			if opts.CollectAttachments {
+				ch <- &types.PartialResponse{RawResponse: inlineAttachments}
 			}
 			return nil
 
@@ -87,8 +158,25 @@ func performQueryRequest(
 			if err != nil {
 				return err
 			}
+			if opts.DedupeConsecutiveIdenticalChunks {
+				key := unindexed
+				if index != nil {
+					key = *index
+				}
+				if prev, ok := lastText[key]; ok && prev == text && text != "" {
+					continue
+				}
+				lastText[key] = text
+			}
 			chunks = append(chunks, text)
-			ch <- &types.PartialResponse{Text: text, Index: index}
+			ch <- &types.PartialResponse{Text: text, Index: index, FullPrompt: fullPrompt}
+
+		case "thinking":
+			text, err := getJSONStringField(event.Data, "text")
+			if err != nil {
+				return err
+			}
+			ch <- &types.PartialResponse{Text: text, IsThinking: true, Index: index}
 
 		case "replace_response":
 			text, err := getJSONStringField(event.Data, "text")
@@ -96,29 +184,37 @@ func performQueryRequest(
 				return err
 			}
 			chunks = nil
+			if text != "" {
+				chunks = append(chunks, text)
+			}
+			if index != nil {
+				delete(lastText, *index)
+			} else {
+				clear(lastText)
+			}
 			ch <- &types.PartialResponse{Text: text, IsReplaceResponse: true, Index: index}
 
 		case "file":
 			var dataMap map[string]any
-			if err := json.Unmarshal([]byte(event.Data), &dataMap); err != nil {
+			if err := jsonUnmarshal([]byte(event.Data), &dataMap); err != nil {
 				return &BotErrorNoRetry{BotError{Message: "Invalid JSON in file event"}}
 			}
 			fileURL, _ := dataMap["url"].(string)
 			contentType, _ := dataMap["content_type"].(string)
 			name, _ := dataMap["name"].(string)
-			var inlineRef *string
+			attachment := types.Attachment{
+				URL:         fileURL,
+				ContentType: contentType,
+				Name:        name,
+			}
 			if ref, ok := dataMap["inline_ref"].(string); ok {
-				inlineRef = &ref
+				attachment.InlineRef = &ref
+				attachment = inlineAttachments.Add(attachment)
 			}
 			ch <- &types.PartialResponse{
-				Text: "",
-				Attachment: &types.Attachment{
-					URL:         fileURL,
-					ContentType: contentType,
-					Name:        name,
-					InlineRef:   inlineRef,
-				},
-				Index: index,
+				Text:       "",
+				Attachment: &attachment,
+				Index:      index,
 			}
 
 		case "suggested_reply":
@@ -126,18 +222,37 @@ func performQueryRequest(
 			if err != nil {
 				return err
 			}
+			label, _ := getJSONStringField(event.Data, "label")
 			ch <- &types.PartialResponse{
-				Text:             text,
-				IsSuggestedReply: true,
-				Index:            index,
+				Text:                text,
+				IsSuggestedReply:    true,
+				SuggestedReplyLabel: label,
+				Index:               index,
 			}
 
 		case "json":
-			var data map[string]any
-			if err := json.Unmarshal([]byte(event.Data), &data); err != nil {
+			var value any
+			if err := jsonUnmarshal([]byte(event.Data), &value); err != nil {
 				return &BotErrorNoRetry{BotError{Message: "Invalid JSON in json event"}}
 			}
-			ch <- &types.PartialResponse{Text: "", Data: data, Index: index}
+			msg := &types.PartialResponse{Text: "", Index: index}
+			switch v := value.(type) {
+			case map[string]any:
+				msg.Data = v
+			case []any:
+				msg.DataArray = v
+			default:
+				return &BotErrorNoRetry{BotError{Message: "json event data must be an object or an array"}}
+			}
+			ch <- msg
+
+		case "data":
+			metadata, err := getJSONStringField(event.Data, "metadata")
+			if err != nil {
+				return err
+			}
+			// Sent like meta, with RawResponse carrying the DataResponse
+			ch <- &types.PartialResponse{RawResponse: &types.DataResponse{Metadata: metadata}, Index: index}
 
 		case "meta":
 			if eventCount != 1 {
@@ -145,21 +260,35 @@ func performQueryRequest(
 				continue
 			}
 			var dataMap map[string]any
-			if err := json.Unmarshal([]byte(event.Data), &dataMap); err != nil {
+			if err := jsonUnmarshal([]byte(event.Data), &dataMap); err != nil {
 				errorReported = true
 				continue
 			}
 			linkify, _ := dataMap["linkify"].(bool)
 			suggestedReplies, _ := dataMap["suggested_replies"].(bool)
+			refetchSettings, _ := dataMap["refetch_settings"].(bool)
 			contentType := "text/markdown"
 			if ct, ok := dataMap["content_type"].(string); ok {
 				contentType = ct
 			}
+			var extra map[string]any
+			for k, v := range dataMap {
+				switch k {
+				case "linkify", "suggested_replies", "refetch_settings", "content_type", "index":
+					continue
+				}
+				if extra == nil {
+					extra = make(map[string]any)
+				}
+				extra[k] = v
+			}
 			meta := &types.MetaResponse{
 				PartialResponse:  types.PartialResponse{Text: ""},
 				Linkify:          linkify,
 				SuggestedReplies: suggestedReplies,
 				ContentType:      types.ContentType(contentType),
+				RefetchSettings:  refetchSettings,
+				Extra:            extra,
 			}
 			// Send meta as a PartialResponse with RawResponse carrying the meta info
 			ch <- &types.PartialResponse{
@@ -170,35 +299,68 @@ func performQueryRequest(
 
 		case "error":
 			var dataMap map[string]any
-			if err := json.Unmarshal([]byte(event.Data), &dataMap); err != nil {
-				return &BotError{Message: event.Data}
+			if err := jsonUnmarshal([]byte(event.Data), &dataMap); err != nil {
+				// Plain-text error from a non-conforming server
+				botErr := BotError{Message: strings.TrimSpace(event.Data)}
+				if opts.NoRetryOnPlainTextError {
+					return &BotErrorNoRetry{botErr}
+				}
+				return &botErr
 			}
 			allowRetry := true
 			if ar, ok := dataMap["allow_retry"].(bool); ok {
 				allowRetry = ar
 			}
+			errorType, _ := dataMap["error_type"].(string)
+			botErr := BotError{Message: event.Data, ErrorType: errorType}
 			if allowRetry {
-				return &BotError{Message: event.Data}
+				return &botErr
 			}
-			return &BotErrorNoRetry{BotError{Message: event.Data}}
+			return &BotErrorNoRetry{botErr}
 
 		case "ping":
 			continue
 
 		default:
-			log.Printf("Unknown event type: %s", event.Event)
+			types.Logf(ctx, "Unknown event type: %s", event.Event)
 			errorReported = true
 			continue
 		}
 	}
 
-	log.Printf("Bot exited without sending 'done' event")
+	types.Logf(ctx, "Bot exited without sending 'done' event")
 	return nil
 }
 
+// readResult is an event or error read from an SSE stream
+type readResult struct {
+	event sse.Event
+	err   error
+}
+
+// readEvents reads events from reader until an error, including io.EOF, or
+// until stop is closed
+func readEvents(reader *sse.Reader, stop <-chan struct{}) <-chan readResult {
+	results := make(chan readResult)
+	go func() {
+		for {
+			event, err := reader.ReadEvent()
+			select {
+			case results <- readResult{event, err}:
+			case <-stop:
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return results
+}
+
 func getJSONStringField(data, field string) (string, error) {
 	var dataMap map[string]any
-	if err := json.Unmarshal([]byte(data), &dataMap); err != nil {
+	if err := jsonUnmarshal([]byte(data), &dataMap); err != nil {
 		return "", &BotErrorNoRetry{BotError{Message: fmt.Sprintf("Invalid JSON in event: %s", data)}}
 	}
 	text, ok := dataMap[field].(string)
@@ -2,33 +2,139 @@ package client
 
 import (
 	"bytes"
-	"encoding/json"
+	"context"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/n0madic/go-poe/types"
 )
 
+// maxConcurrentSettingsSyncs bounds the concurrent requests of SyncAllBotSettings
+const maxConcurrentSettingsSyncs = 8
+
 // SyncBotSettings syncs bot settings with the Poe API
 func SyncBotSettings(botName, accessKey string, settings map[string]any, baseURL string) error {
+	return SyncBotSettingsWithOptions(context.Background(), &SyncSettingsOptions{
+		BotName:   botName,
+		AccessKey: accessKey,
+		Settings:  settings,
+		BaseURL:   baseURL,
+	})
+}
+
+// SyncSettingsOptions configures SyncBotSettingsWithOptions.
+// A nil Settings fetches the settings from the bot server instead.
+type SyncSettingsOptions struct {
+	BotName   string
+	AccessKey string
+	Settings  map[string]any
+	BaseURL   string
+	// HTTPClient sends the request (default: a client with a 60s timeout)
+	HTTPClient *http.Client
+}
+
+// SyncBotSettingsWithOptions syncs bot settings with the Poe API. The request
+// is aborted when ctx is cancelled.
+func SyncBotSettingsWithOptions(ctx context.Context, opts *SyncSettingsOptions) error {
+	return syncBotSettings(ctx, opts)
+}
+
+// BotSettingsEntry describes one bot for SyncAllBotSettings.
+// A nil Settings fetches the settings from the bot server instead.
+type BotSettingsEntry struct {
+	BotName   string
+	AccessKey string
+	Settings  map[string]any
+	BaseURL   string
+}
+
+// SyncAllBotSettings syncs the settings of several bots concurrently and
+// returns the error of each entry at its index in entries (nil on success),
+// so entries sharing a bot name keep their own results
+func SyncAllBotSettings(ctx context.Context, entries []BotSettingsEntry) []error {
+	results := make([]error, len(entries))
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, maxConcurrentSettingsSyncs)
+
+	for i, entry := range entries {
+		wg.Add(1)
+		go func(i int, entry BotSettingsEntry) {
+			defer wg.Done()
+			var err error
+			select {
+			case sem <- struct{}{}:
+				err = syncBotSettings(ctx, &SyncSettingsOptions{
+					BotName:   entry.BotName,
+					AccessKey: entry.AccessKey,
+					Settings:  entry.Settings,
+					BaseURL:   entry.BaseURL,
+				})
+				<-sem
+			case <-ctx.Done():
+				err = ctx.Err()
+			}
+			results[i] = err
+		}(i, entry)
+	}
+	wg.Wait()
+	return results
+}
+
+// FetchBotSettings fetches the settings Poe has stored for a bot through
+// fetch_settings and decodes them. An empty response body gives a zero
+// SettingsResponse.
+func FetchBotSettings(ctx context.Context, botName, accessKey, baseURL string) (*types.SettingsResponse, error) {
+	body, err := doSyncSettings(ctx, &SyncSettingsOptions{
+		BotName:   botName,
+		AccessKey: accessKey,
+		BaseURL:   baseURL,
+	})
+	if err != nil {
+		return nil, err
+	}
+	settings := &types.SettingsResponse{}
+	if len(bytes.TrimSpace(body)) == 0 {
+		return settings, nil
+	}
+	if err := jsonUnmarshal(body, settings); err != nil {
+		return nil, &BotError{Message: fmt.Sprintf("failed to parse settings for bot %s", botName), Cause: err}
+	}
+	return settings, nil
+}
+
+func syncBotSettings(ctx context.Context, opts *SyncSettingsOptions) error {
+	_, err := doSyncSettings(ctx, opts)
+	return err
+}
+
+// doSyncSettings sends the settings in opts with update_settings, or calls
+// fetch_settings if they are nil, and returns the response body
+func doSyncSettings(ctx context.Context, opts *SyncSettingsOptions) ([]byte, error) {
+	botName, settings, baseURL := opts.BotName, opts.Settings, opts.BaseURL
 	if baseURL == "" {
 		baseURL = defaultBaseURL
 	}
+	if err := validateBaseURL(baseURL); err != nil {
+		return nil, err
+	}
+	baseURL = strings.TrimRight(baseURL, "/") + "/"
 
 	var syncURL string
 	var body io.Reader
 	var contentType string
 
 	escapedName := url.PathEscape(botName)
-	escapedKey := url.PathEscape(accessKey)
+	escapedKey := url.PathEscape(opts.AccessKey)
 	if settings != nil {
 		syncURL = fmt.Sprintf("%supdate_settings/%s/%s/%s", baseURL, escapedName, escapedKey, types.ProtocolVersion)
-		data, err := json.Marshal(settings)
+		data, err := jsonMarshal(settings)
 		if err != nil {
-			return &BotError{Message: fmt.Sprintf("failed to marshal settings: %v", err)}
+			return nil, &BotError{Message: fmt.Sprintf("failed to marshal settings: %v", err)}
 		}
 		body = bytes.NewReader(data)
 		contentType = "application/json"
@@ -38,29 +144,34 @@ func SyncBotSettings(botName, accessKey string, settings map[string]any, baseURL
 		contentType = ""
 	}
 
-	req, err := http.NewRequest(http.MethodPost, syncURL, body)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, syncURL, body)
 	if err != nil {
-		return &BotError{Message: fmt.Sprintf("failed to create request: %v", err)}
+		return nil, &BotError{Message: fmt.Sprintf("failed to create request: %v", err)}
 	}
 	if contentType != "" {
 		req.Header.Set("Content-Type", contentType)
 	}
 
-	client := &http.Client{Timeout: 60 * time.Second}
+	client := opts.HTTPClient
+	if client == nil {
+		client = &http.Client{Timeout: 60 * time.Second}
+	}
 	resp, err := client.Do(req)
 	if err != nil {
 		msg := fmt.Sprintf("timeout syncing settings for bot %s", botName)
 		if settings == nil {
 			msg += ". Check that the bot server is running."
 		}
-		return &BotError{Message: msg, Cause: err}
+		return nil, &BotError{Message: msg, Cause: err}
 	}
 	defer resp.Body.Close()
 
+	respBody, err := io.ReadAll(resp.Body)
 	if resp.StatusCode != http.StatusOK {
-		respBody, _ := io.ReadAll(resp.Body)
-		return &BotError{Message: fmt.Sprintf("error syncing settings for bot %s: %s", botName, string(respBody))}
+		return nil, &BotError{Message: fmt.Sprintf("error syncing settings for bot %s: %s", botName, string(respBody))}
 	}
-
-	return nil
+	if err != nil {
+		return nil, &BotError{Message: fmt.Sprintf("failed to read settings response for bot %s", botName), Cause: err}
+	}
+	return respBody, nil
 }
@@ -2,26 +2,63 @@ package client
 
 import (
 	"context"
-	"encoding/json"
-	"log"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
 
 	"github.com/n0madic/go-poe/types"
 )
 
-// streamRequestWithTools handles the two-pass tool execution flow
+// streamRequestWithTools handles the tool execution flow. Each round streams a
+// response, executes the tool calls it requests and adds the calls and their
+// results to the payload, for up to MaxToolRounds rounds. The response to the
+// last round's results is streamed as is.
 func streamRequestWithTools(ctx context.Context, req *types.QueryRequest, botName string, opts *StreamRequestOptions, ch chan<- *types.PartialResponse) {
-	// First pass: collect tool call deltas
-	firstPassCh := make(chan *types.PartialResponse, 64)
-	aggregatedToolCalls := make(map[int]*types.ToolCallDefinition)
+	var toolCalls []types.ToolCallDefinition
+	var toolResults []types.ToolResultDefinition
+
+	for round := 0; round < opts.MaxToolRounds; round++ {
+		payload := buildPayload(req, opts.Tools, toolCalls, toolResults)
+		roundCalls := streamToolRound(ctx, botName, opts, payload, ch)
+
+		// If no tool executables, exit early
+		if len(opts.ToolExecutables) == 0 || len(roundCalls) == 0 {
+			return
+		}
+
+		// Surface the calls the model decided on before running them
+		ch <- &types.PartialResponse{AggregatedToolCalls: roundCalls}
+
+		roundResults, err := executeTools(ctx, opts, roundCalls)
+		if err != nil {
+			types.Logf(ctx, "Error executing tools: %v", err)
+			return
+		}
+		if opts.OnToolsExecuted != nil {
+			opts.OnToolsExecuted(roundCalls, roundResults)
+		}
+		toolCalls = append(toolCalls, roundCalls...)
+		toolResults = append(toolResults, roundResults...)
+	}
 
-	payload := buildPayload(req, opts.Tools, nil, nil)
+	// Final pass: send tool results back to LLM
+	finalPayload := buildPayload(req, opts.Tools, toolCalls, toolResults)
+	streamRequestBaseWithPayload(ctx, botName, opts, finalPayload, ch)
+}
+
+// streamToolRound streams one response, forwarding text to ch, and returns
+// the tool calls it requests, aggregated from their deltas
+func streamToolRound(ctx context.Context, botName string, opts *StreamRequestOptions, payload map[string]any, ch chan<- *types.PartialResponse) []types.ToolCallDefinition {
+	passCh := make(chan *types.PartialResponse, 64)
+	aggregatedToolCalls := make(map[int]*types.ToolCallDefinition)
 
 	go func() {
-		defer close(firstPassCh)
-		streamRequestBaseWithPayload(ctx, botName, opts, payload, firstPassCh)
+		defer close(passCh)
+		streamRequestBaseWithPayload(ctx, botName, opts, payload, passCh)
 	}()
 
-	for msg := range firstPassCh {
+	for msg := range passCh {
 		if msg.Data == nil || msg.Data["choices"] == nil {
 			ch <- msg
 			continue
@@ -41,6 +78,13 @@ func streamRequestWithTools(ctx context.Context, req *types.QueryRequest, botNam
 
 		// Check finish reason
 		if choice["finish_reason"] != nil {
+			if choice["finish_reason"] == "tool_calls" && len(opts.ToolExecutables) == 0 && opts.AggregateToolCallsWithoutExecutables && len(aggregatedToolCalls) > 0 {
+				ch <- &types.PartialResponse{
+					AggregatedToolCalls: sortedToolCalls(aggregatedToolCalls),
+					Index:               msg.Index,
+				}
+				aggregatedToolCalls = make(map[int]*types.ToolCallDefinition)
+			}
 			continue
 		}
 
@@ -59,15 +103,15 @@ func streamRequestWithTools(ctx context.Context, req *types.QueryRequest, botNam
 			// Parse tool call deltas
 			var deltas []types.ToolCallDefinitionDelta
 			for _, tcRaw := range toolCallsList {
-				tcBytes, _ := json.Marshal(tcRaw)
+				tcBytes, _ := jsonMarshal(tcRaw)
 				var delta types.ToolCallDefinitionDelta
-				if json.Unmarshal(tcBytes, &delta) == nil {
+				if jsonUnmarshal(tcBytes, &delta) == nil {
 					deltas = append(deltas, delta)
 				}
 			}
 
-			// If no executables, yield raw deltas
-			if len(opts.ToolExecutables) == 0 {
+			// If no executables, yield raw deltas unless asked to aggregate
+			if len(opts.ToolExecutables) == 0 && !opts.AggregateToolCallsWithoutExecutables {
 				ch <- &types.PartialResponse{
 					Text:      "",
 					ToolCalls: deltas,
@@ -101,59 +145,157 @@ func streamRequestWithTools(ctx context.Context, req *types.QueryRequest, botNam
 		}
 	}
 
-	// If no tool executables, exit early
-	if len(opts.ToolExecutables) == 0 {
-		return
-	}
+	return sortedToolCalls(aggregatedToolCalls)
+}
 
-	// Execute tools
-	toolCalls := make([]types.ToolCallDefinition, 0, len(aggregatedToolCalls))
-	for _, tc := range aggregatedToolCalls {
-		toolCalls = append(toolCalls, *tc)
+// sortedToolCalls returns the aggregated tool calls ordered by their index
+func sortedToolCalls(aggregated map[int]*types.ToolCallDefinition) []types.ToolCallDefinition {
+	indices := make([]int, 0, len(aggregated))
+	for i := range aggregated {
+		indices = append(indices, i)
 	}
+	sort.Ints(indices)
+	toolCalls := make([]types.ToolCallDefinition, 0, len(indices))
+	for _, i := range indices {
+		toolCalls = append(toolCalls, *aggregated[i])
+	}
+	return toolCalls
+}
 
-	if len(toolCalls) == 0 {
-		return
+// executeTools runs tool functions and collects results in the order of
+// toolCalls. At most opts.MaxConcurrentTools tools run at once: 0 or 1 runs
+// them one after another and a negative value means no limit. Tool calls
+// without a matching executable are skipped.
+func executeTools(ctx context.Context, opts *StreamRequestOptions, toolCalls []types.ToolCallDefinition) ([]types.ToolResultDefinition, error) {
+	execMap := make(map[string]ToolExecutable)
+	for _, exec := range opts.ToolExecutables {
+		execMap[exec.Name] = exec
 	}
 
-	toolResults, err := executeTools(ctx, opts.ToolExecutables, toolCalls)
-	if err != nil {
-		log.Printf("Error executing tools: %v", err)
-		return
+	results := make([]*types.ToolResultDefinition, len(toolCalls))
+	maxConcurrent := opts.MaxConcurrentTools
+	if maxConcurrent == 0 || maxConcurrent == 1 {
+		for i, tc := range toolCalls {
+			results[i] = executeTool(ctx, opts, execMap, tc)
+		}
+	} else {
+		if maxConcurrent < 0 {
+			maxConcurrent = len(toolCalls)
+		}
+		sem := make(chan struct{}, maxConcurrent)
+		var wg sync.WaitGroup
+		for i, tc := range toolCalls {
+			wg.Add(1)
+			sem <- struct{}{}
+			go func(i int, tc types.ToolCallDefinition) {
+				defer wg.Done()
+				defer func() { <-sem }()
+				results[i] = executeTool(ctx, opts, execMap, tc)
+			}(i, tc)
+		}
+		wg.Wait()
 	}
 
-	// Second pass: send tool results back to LLM
-	secondPayload := buildPayload(req, opts.Tools, toolCalls, toolResults)
-	streamRequestBaseWithPayload(ctx, botName, opts, secondPayload, ch)
+	var ordered []types.ToolResultDefinition
+	for _, result := range results {
+		if result != nil {
+			ordered = append(ordered, *result)
+		}
+	}
+	return ordered, nil
 }
 
-// executeTools runs tool functions and collects results
-func executeTools(ctx context.Context, executables []ToolExecutable, toolCalls []types.ToolCallDefinition) ([]types.ToolResultDefinition, error) {
-	execMap := make(map[string]ToolExecutable)
-	for _, exec := range executables {
-		execMap[exec.Name] = exec
+// toolTimeoutContent is the result content of a tool that exceeded ToolTimeout
+const toolTimeoutContent = "error: tool execution timed out"
+
+// executeTool runs a single tool call, giving up after opts.ToolTimeout if it
+// is positive. It returns nil if there is no executable.
+func executeTool(ctx context.Context, opts *StreamRequestOptions, execMap map[string]ToolExecutable, tc types.ToolCallDefinition) *types.ToolResultDefinition {
+	exec, ok := execMap[tc.Function.Name]
+	if !ok {
+		types.Logf(ctx, "Tool executable not found: %s", tc.Function.Name)
+		return nil
 	}
 
-	var results []types.ToolResultDefinition
-	for _, tc := range toolCalls {
-		exec, ok := execMap[tc.Function.Name]
-		if !ok {
-			log.Printf("Tool executable not found: %s", tc.Function.Name)
-			continue
+	result := &types.ToolResultDefinition{
+		Role:       "tool",
+		ToolCallID: tc.ID,
+		Name:       tc.Function.Name,
+	}
+	if opts.ValidateToolArgs {
+		if err := validateToolArgs(opts.Tools, tc); err != nil {
+			types.Logf(ctx, "Tool %s called with invalid arguments: %v", tc.Function.Name, err)
+			result.Content = fmt.Sprintf("error: invalid arguments for %s: %v", tc.Function.Name, err)
+			return result
 		}
+	}
 
-		content, err := exec.Execute(ctx, tc.Function.Arguments)
-		if err != nil {
-			log.Printf("Tool execution error for %s: %v", tc.Function.Name, err)
-			content = err.Error()
+	timeout := opts.ToolTimeout
+	if timeout <= 0 {
+		result.Content = callTool(ctx, exec, tc)
+		return result
+	}
+
+	// Run the tool in its own goroutine so that an executable ignoring its
+	// context cannot block the request
+	toolCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	done := make(chan string, 1)
+	go func() { done <- callTool(toolCtx, exec, tc) }()
+
+	select {
+	case result.Content = <-done:
+	case <-toolCtx.Done():
+		if ctx.Err() != nil {
+			result.Content = "error: " + ctx.Err().Error()
+		} else {
+			types.Logf(ctx, "Tool %s timed out after %v", tc.Function.Name, timeout)
+			result.Content = toolTimeoutContent
 		}
+	}
+	return result
+}
 
-		results = append(results, types.ToolResultDefinition{
-			Role:       "tool",
-			ToolCallID: tc.ID,
-			Name:       tc.Function.Name,
-			Content:    content,
-		})
+// callTool calls the executable. Errors and panics become the result content.
+func callTool(ctx context.Context, exec ToolExecutable, tc types.ToolCallDefinition) (content string) {
+	defer func() {
+		if r := recover(); r != nil {
+			types.Logf(ctx, "Tool %s panicked: %v", tc.Function.Name, r)
+			content = fmt.Sprintf("tool %s panicked: %v", tc.Function.Name, r)
+		}
+	}()
+
+	content, err := exec.Execute(ctx, tc.Function.Arguments)
+	if err != nil {
+		types.Logf(ctx, "Tool execution error for %s: %v", tc.Function.Name, err)
+		content = err.Error()
+	}
+	return content
+}
+
+// validateToolArgs checks that the arguments of tc are a JSON object holding
+// every required property of the matching tool definition
+func validateToolArgs(tools []types.ToolDefinition, tc types.ToolCallDefinition) error {
+	args := map[string]any{}
+	if strings.TrimSpace(tc.Function.Arguments) != "" {
+		if err := jsonUnmarshal([]byte(tc.Function.Arguments), &args); err != nil {
+			return fmt.Errorf("arguments are not a valid JSON object: %v", err)
+		}
+	}
+	for _, tool := range tools {
+		if tool.Function.Name != tc.Function.Name {
+			continue
+		}
+		var missing []string
+		for _, name := range tool.Function.Parameters.Required {
+			if _, ok := args[name]; !ok {
+				missing = append(missing, name)
+			}
+		}
+		if len(missing) > 0 {
+			return fmt.Errorf("missing required fields: %s", strings.Join(missing, ", "))
+		}
+		break
 	}
-	return results, nil
+	return nil
 }
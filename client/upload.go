@@ -3,13 +3,16 @@ package client
 import (
 	"bytes"
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"mime/multipart"
 	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/n0madic/go-poe/types"
@@ -28,6 +31,28 @@ type UploadFileOptions struct {
 	BaseURL        string
 	ExtraHeaders   map[string]string
 	HTTPClient     *http.Client
+	// FileFieldName names the multipart form field holding the file
+	// (default: "file")
+	FileFieldName string
+	// URLFieldName and FileNameFieldName name the form fields used with
+	// FileURL (default: "download_url" and "download_filename")
+	URLFieldName      string
+	FileNameFieldName string
+	// ContentType is sent as the type of the file: in the multipart part
+	// header, or as the content_type form field with FileURL. If empty and
+	// File is an *os.File, it is detected from the file's first 512 bytes.
+	ContentType string
+	// OnProgress is called as the file is sent in the request body, with the
+	// file bytes sent so far and the file size, or -1 if File does not report
+	// one (it should have a Size() int64 method or be an *os.File). Progress
+	// never goes back: a retry reports again only once it passes the bytes
+	// already reported, so the final count, the file length, is reported once.
+	OnProgress func(bytesWritten, totalBytes int64)
+	// MaxSize is the largest File in bytes that is uploaded; reading stops
+	// with an error once it is exceeded (default: 0, no limit)
+	MaxSize int64
+
+	clock clock // overridden in tests
 }
 
 func (o *UploadFileOptions) defaults() {
@@ -43,6 +68,18 @@ func (o *UploadFileOptions) defaults() {
 	if o.HTTPClient == nil {
 		o.HTTPClient = &http.Client{Timeout: 120 * time.Second}
 	}
+	if o.FileFieldName == "" {
+		o.FileFieldName = "file"
+	}
+	if o.URLFieldName == "" {
+		o.URLFieldName = "download_url"
+	}
+	if o.FileNameFieldName == "" {
+		o.FileNameFieldName = "download_filename"
+	}
+	if o.clock == nil {
+		o.clock = realClock{}
+	}
 }
 
 // UploadFile uploads a file to Poe and returns an Attachment
@@ -58,35 +95,72 @@ func UploadFile(ctx context.Context, opts *UploadFileOptions) (*types.Attachment
 	}
 
 	opts.defaults()
+	if err := validateBaseURL(opts.BaseURL); err != nil {
+		return nil, err
+	}
 	endpoint := strings.TrimRight(opts.BaseURL, "/") + "/file_upload_3RD_PARTY_POST"
 
+	// Buffer the file once so that retries resend the full content
+	var fileData []byte
+	fileSize := int64(-1)
+	if opts.File != nil {
+		fileSize = readerSize(opts.File)
+		src := opts.File
+		if opts.MaxSize > 0 {
+			// Read one byte past the limit to tell an exact fit from an overflow
+			src = io.LimitReader(src, opts.MaxSize+1)
+		}
+		data, err := io.ReadAll(src)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read file: %w", err)
+		}
+		if opts.MaxSize > 0 && int64(len(data)) > opts.MaxSize {
+			return nil, &AttachmentUploadError{Message: fmt.Sprintf("file exceeds the maximum upload size of %d bytes", opts.MaxSize)}
+		}
+		fileData = data
+	}
+
+	var progress *uploadProgress
+	if opts.OnProgress != nil {
+		progress = &uploadProgress{total: fileSize, onProgress: opts.OnProgress}
+	}
+
 	var lastErr error
 	for attempt := 0; attempt < opts.NumTries; attempt++ {
-		att, err := doUpload(ctx, opts, endpoint)
+		att, err := doUpload(ctx, opts, endpoint, fileData, progress)
 		if err == nil {
 			return att, nil
 		}
 		lastErr = err
-		log.Printf("Upload attempt %d/%d failed: %v", attempt+1, opts.NumTries, err)
+		types.Logf(ctx, "Upload attempt %d/%d failed: %v", attempt+1, opts.NumTries, err)
+		var uploadErr *AttachmentUploadError
+		if errors.As(err, &uploadErr) && !uploadErr.Retryable() {
+			return nil, err
+		}
 		if attempt < opts.NumTries-1 {
 			select {
 			case <-ctx.Done():
 				return nil, ctx.Err()
-			case <-time.After(opts.RetrySleepTime):
+			case <-opts.clock.After(opts.RetrySleepTime):
 			}
 		}
 	}
 	return nil, lastErr
 }
 
-func doUpload(ctx context.Context, opts *UploadFileOptions, endpoint string) (*types.Attachment, error) {
+func doUpload(ctx context.Context, opts *UploadFileOptions, endpoint string, fileData []byte, progress *uploadProgress) (*types.Attachment, error) {
 	var req *http.Request
 	var err error
 
 	if opts.FileURL != "" {
 		// URL mode: POST form data
-		form := strings.NewReader(fmt.Sprintf("download_url=%s&download_filename=%s", opts.FileURL, opts.FileName))
-		req, err = http.NewRequestWithContext(ctx, http.MethodPost, endpoint, form)
+		form := url.Values{}
+		form.Set(opts.URLFieldName, opts.FileURL)
+		form.Set(opts.FileNameFieldName, opts.FileName)
+		if opts.ContentType != "" {
+			form.Set("content_type", opts.ContentType)
+		}
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
 		if err != nil {
 			return nil, err
 		}
@@ -95,19 +169,27 @@ func doUpload(ctx context.Context, opts *UploadFileOptions, endpoint string) (*t
 		// File mode: multipart upload
 		var buf bytes.Buffer
 		writer := multipart.NewWriter(&buf)
-		part, err := writer.CreateFormFile("file", opts.FileName)
+		part, err := createFilePart(writer, opts, fileData)
 		if err != nil {
 			return nil, err
 		}
-		if _, err := io.Copy(part, opts.File); err != nil {
+		// The file follows the part header in the body
+		fileStart := int64(buf.Len())
+		if _, err := part.Write(fileData); err != nil {
 			return nil, err
 		}
 		writer.Close()
 
-		req, err = http.NewRequestWithContext(ctx, http.MethodPost, endpoint, &buf)
+		size := int64(buf.Len())
+		var body io.Reader = &buf
+		if progress != nil {
+			body = &progressReader{r: body, fileStart: fileStart, fileLen: int64(len(fileData)), progress: progress}
+		}
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, endpoint, body)
 		if err != nil {
 			return nil, err
 		}
+		req.ContentLength = size
 		req.Header.Set("Content-Type", writer.FormDataContentType())
 	}
 
@@ -126,12 +208,17 @@ func doUpload(ctx context.Context, opts *UploadFileOptions, endpoint string) (*t
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
 		return nil, &AttachmentUploadError{
-			Message: fmt.Sprintf("%d %s: %s", resp.StatusCode, resp.Status, string(body)),
+			Message:    fmt.Sprintf("%d %s: %s", resp.StatusCode, resp.Status, string(body)),
+			StatusCode: resp.StatusCode,
 		}
 	}
 
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, &AttachmentUploadError{Message: fmt.Sprintf("failed to read response: %v", err)}
+	}
 	var result map[string]any
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+	if err := jsonUnmarshal(respBody, &result); err != nil {
 		return nil, &AttachmentUploadError{Message: fmt.Sprintf("failed to parse response: %v", err)}
 	}
 
@@ -142,14 +229,133 @@ func doUpload(ctx context.Context, opts *UploadFileOptions, endpoint string) (*t
 		return nil, &AttachmentUploadError{Message: fmt.Sprintf("unexpected response format: %v", result)}
 	}
 
-	name := opts.FileName
+	name, _ := result["name"].(string)
+	if name == "" {
+		name = opts.FileName
+	}
 	if name == "" {
 		name = "file"
 	}
 
-	return &types.Attachment{
+	att := &types.Attachment{
 		URL:         attURL,
 		ContentType: mimeType,
 		Name:        name,
-	}, nil
+	}
+	if ref, ok := result["inline_ref"].(string); ok && ref != "" {
+		att.InlineRef = &ref
+	}
+	return att, nil
+}
+
+var quoteEscaper = strings.NewReplacer("\\", "\\\\", `"`, "\\\"")
+
+// createFilePart is multipart.Writer.CreateFormFile with the content type
+// taken from opts or detected for files instead of application/octet-stream
+func createFilePart(writer *multipart.Writer, opts *UploadFileOptions, fileData []byte) (io.Writer, error) {
+	contentType := opts.ContentType
+	if _, ok := opts.File.(*os.File); ok && contentType == "" {
+		// The file is already buffered, so sniffing doesn't move its reader
+		contentType = http.DetectContentType(fileData)
+	}
+	if contentType == "" {
+		return writer.CreateFormFile(opts.FileFieldName, opts.FileName)
+	}
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Disposition", fmt.Sprintf(`form-data; name="%s"; filename="%s"`,
+		quoteEscaper.Replace(opts.FileFieldName), quoteEscaper.Replace(opts.FileName)))
+	h.Set("Content-Type", contentType)
+	return writer.CreatePart(h)
+}
+
+// readerSize returns the size of r if it reports one, or -1
+func readerSize(r io.Reader) int64 {
+	switch v := r.(type) {
+	case interface{ Size() int64 }:
+		return v.Size()
+	case *os.File:
+		if info, err := v.Stat(); err == nil && info.Mode().IsRegular() {
+			return info.Size()
+		}
+	}
+	return -1
+}
+
+// uploadProgress passes the progress of an upload to OnProgress. It is
+// shared by the tries of the upload and only reports new highs.
+type uploadProgress struct {
+	mu         sync.Mutex
+	reported   int64
+	total      int64 // file size, or -1
+	onProgress func(bytesWritten, totalBytes int64)
+}
+
+func (p *uploadProgress) report(sent int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if sent > p.reported {
+		p.reported = sent
+		p.onProgress(sent, p.total)
+	}
+}
+
+// progressReader counts the file bytes of one try's request body as the
+// HTTP client reads them to send, skipping the multipart framing
+type progressReader struct {
+	r         io.Reader
+	read      int64
+	fileStart int64
+	fileLen   int64
+	progress  *uploadProgress
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if n > 0 {
+		p.read += int64(n)
+		if sent := min(p.read-p.fileStart, p.fileLen); sent > 0 {
+			p.progress.report(sent)
+		}
+	}
+	return n, err
+}
+
+// UploadMultipleFiles uploads files in parallel, at most concurrency at a time
+// (no limit if concurrency <= 0), each with its own options and retries as
+// in UploadFile. Attachments are returned in the order of files; failed
+// uploads leave a nil entry and are reported together in the error.
+func UploadMultipleFiles(ctx context.Context, files []*UploadFileOptions, concurrency int) ([]*types.Attachment, error) {
+	if concurrency <= 0 || concurrency > len(files) {
+		concurrency = len(files)
+	}
+	attachments := make([]*types.Attachment, len(files))
+	errs := make([]error, len(files))
+
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, opts := range files {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, opts *UploadFileOptions) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			att, err := UploadFile(ctx, opts)
+			if err != nil {
+				errs[i] = fmt.Errorf("file %d (%s): %w", i, uploadLabel(opts), err)
+				return
+			}
+			attachments[i] = att
+		}(i, opts)
+	}
+	wg.Wait()
+
+	return attachments, errors.Join(errs...)
+}
+
+// uploadLabel names an upload in error messages
+func uploadLabel(opts *UploadFileOptions) string {
+	if opts.FileName != "" {
+		return opts.FileName
+	}
+	return opts.FileURL
 }
@@ -0,0 +1,86 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/n0madic/go-poe/types"
+)
+
+// Bounds of the generation parameters checked by ValidateRequest
+const (
+	maxTemperature = 2.0
+	maxLogitBias   = 100.0
+)
+
+// validRoles are the message roles of the Poe protocol
+var validRoles = map[string]bool{"system": true, "user": true, "bot": true, "tool": true}
+
+// ValidateRequest checks a request before it is sent: the bot name, the
+// options' BaseURL, the messages, the tool definitions in opts and the
+// generation parameters. It returns the first problem found. StreamRequest
+// runs it first when StreamRequestOptions.ValidateRequest is set.
+func ValidateRequest(req *types.QueryRequest, botName string, opts *StreamRequestOptions) error {
+	if opts == nil {
+		opts = &StreamRequestOptions{}
+	}
+	if req == nil {
+		return errors.New("request is nil")
+	}
+	if _, err := opts.botName(botName); err != nil {
+		return err
+	}
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+	return validateQuery(req, opts)
+}
+
+// validateQuery checks the messages of req, the tool definitions in opts and
+// the generation parameters. StreamRequest runs it once the options and the
+// bot name have been checked.
+func validateQuery(req *types.QueryRequest, opts *StreamRequestOptions) error {
+	if req == nil {
+		return errors.New("request is nil")
+	}
+	if err := validateMessages(req.Query); err != nil {
+		return err
+	}
+	if err := types.ValidateToolDefinitions(opts.Tools); err != nil {
+		return err
+	}
+	return validateGenerationParams(req)
+}
+
+// validateMessages checks that there is at least one message and that every
+// message has a known role
+func validateMessages(messages []types.ProtocolMessage) error {
+	if len(messages) == 0 {
+		return errors.New("query has no messages")
+	}
+	for i, msg := range messages {
+		if !validRoles[msg.Role] {
+			return fmt.Errorf("message %d: invalid role %q", i, msg.Role)
+		}
+	}
+	return nil
+}
+
+// validateGenerationParams checks the temperature, logit bias and stop
+// sequences of req
+func validateGenerationParams(req *types.QueryRequest) error {
+	if t := req.Temperature; t != nil && (*t < 0 || *t > maxTemperature) {
+		return fmt.Errorf("temperature %v is out of range [0, %v]", *t, maxTemperature)
+	}
+	for token, bias := range req.LogitBias {
+		if bias < -maxLogitBias || bias > maxLogitBias {
+			return fmt.Errorf("logit bias %v for token %q is out of range [-%v, %v]", bias, token, maxLogitBias, maxLogitBias)
+		}
+	}
+	for i, stop := range req.StopSequences {
+		if stop == "" {
+			return fmt.Errorf("stop sequence %d is empty", i)
+		}
+	}
+	return nil
+}
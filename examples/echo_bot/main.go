@@ -51,9 +51,8 @@ func (b *EchoBot) GetResponse(ctx context.Context, req *types.QueryRequest) <-ch
 
 // GetSettings returns bot settings
 func (b *EchoBot) GetSettings(ctx context.Context, req *types.SettingsRequest) (*types.SettingsResponse, error) {
-	settings := types.NewSettingsResponse()
-	intro := "Hello! I'm EchoBot. I will echo back whatever you say to me."
-	settings.IntroductionMessage = &intro
+	settings := types.NewSettingsResponse().
+		SetIntroductionMessage("Hello! I'm EchoBot. I will echo back whatever you say to me.")
 	return settings, nil
 }
 
@@ -3,6 +3,7 @@ package models
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"time"
@@ -13,6 +14,9 @@ const (
 	defaultTimeout = 30 * time.Second
 )
 
+// ErrModelNotFound is returned by FetchByID when no model has the ID.
+var ErrModelNotFound = errors.New("models: model not found")
+
 // Options configures the Fetch request.
 type Options struct {
 	// BaseURL overrides the default API endpoint.
@@ -65,3 +69,18 @@ func Fetch(ctx context.Context, opts *Options) ([]Model, error) {
 
 	return result.Data, nil
 }
+
+// FetchByID retrieves the model list and returns the model whose ID equals id
+// exactly, or an error wrapping ErrModelNotFound if there is none.
+func FetchByID(ctx context.Context, id string, opts *Options) (*Model, error) {
+	models, err := Fetch(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	for i := range models {
+		if models[i].ID == id {
+			return &models[i], nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %q", ErrModelNotFound, id)
+}
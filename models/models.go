@@ -4,7 +4,11 @@
 // pricing, context window, architecture, reasoning config, and parameters.
 package models
 
-import "encoding/json"
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+)
 
 // ModelsResponse is the top-level response from the models API.
 type ModelsResponse struct {
@@ -89,3 +93,156 @@ type Parameter struct {
 	DefaultValue json.RawMessage `json:"default_value"`
 	Description  string          `json:"description,omitempty"`
 }
+
+// HasParameter reports whether the model accepts the parameter name.
+func (m Model) HasParameter(name string) bool {
+	_, ok := m.Parameter(name)
+	return ok
+}
+
+// Parameter returns the model's parameter with the given name.
+func (m Model) Parameter(name string) (*Parameter, bool) {
+	for i := range m.Parameters {
+		if m.Parameters[i].Name == name {
+			return &m.Parameters[i], true
+		}
+	}
+	return nil, false
+}
+
+// FilterParameters returns the entries of params that the model accepts,
+// dropping unsupported ones. params is not modified.
+func (m Model) FilterParameters(params map[string]any) map[string]any {
+	filtered := make(map[string]any, len(params))
+	for name, value := range params {
+		if m.HasParameter(name) {
+			filtered[name] = value
+		}
+	}
+	return filtered
+}
+
+// parsePrice parses a decimal price string, reporting false if it is nil or
+// malformed.
+func parsePrice(s *string) (float64, bool) {
+	if s == nil {
+		return 0, false
+	}
+	v, err := strconv.ParseFloat(*s, 64)
+	if err != nil {
+		return 0, false
+	}
+	return v, true
+}
+
+// PromptFloat returns the price per prompt token, if present and valid.
+// It is safe to call on nil pricing.
+func (p *Pricing) PromptFloat() (float64, bool) {
+	if p == nil {
+		return 0, false
+	}
+	return parsePrice(p.Prompt)
+}
+
+// CompletionFloat returns the price per completion token, if present and valid.
+func (p *Pricing) CompletionFloat() (float64, bool) {
+	if p == nil {
+		return 0, false
+	}
+	return parsePrice(p.Completion)
+}
+
+// ImageFloat returns the price per image, if present and valid.
+func (p *Pricing) ImageFloat() (float64, bool) {
+	if p == nil {
+		return 0, false
+	}
+	return parsePrice(p.Image)
+}
+
+// RequestFloat returns the price per request, if present and valid.
+func (p *Pricing) RequestFloat() (float64, bool) {
+	if p == nil {
+		return 0, false
+	}
+	return parsePrice(p.Request)
+}
+
+// InputCacheReadFloat returns the price per cached input token read, if
+// present and valid.
+func (p *Pricing) InputCacheReadFloat() (float64, bool) {
+	if p == nil {
+		return 0, false
+	}
+	return parsePrice(p.InputCacheRead)
+}
+
+// InputCacheWriteFloat returns the price per input token written to the
+// cache, if present and valid.
+func (p *Pricing) InputCacheWriteFloat() (float64, bool) {
+	if p == nil {
+		return 0, false
+	}
+	return parsePrice(p.InputCacheWrite)
+}
+
+// EstimateCost estimates the cost of a request from its prompt and completion
+// token counts. It reports false unless both the prompt and completion
+// prices are present and valid.
+func (m Model) EstimateCost(promptTokens, completionTokens int) (float64, bool) {
+	prompt, ok := m.Pricing.PromptFloat()
+	if !ok {
+		return 0, false
+	}
+	completion, ok := m.Pricing.CompletionFloat()
+	if !ok {
+		return 0, false
+	}
+	return float64(promptTokens)*prompt + float64(completionTokens)*completion, true
+}
+
+// FilterByInputModality returns the models accepting the input modality,
+// e.g. "image", matched case-insensitively. models is not modified.
+func FilterByInputModality(models []Model, modality string) []Model {
+	return filterModels(models, func(m Model) bool {
+		return containsFold(m.Architecture.InputModalities, modality)
+	})
+}
+
+// FilterByOutputModality returns the models producing the output modality,
+// matched case-insensitively. models is not modified.
+func FilterByOutputModality(models []Model, modality string) []Model {
+	return filterModels(models, func(m Model) bool {
+		return containsFold(m.Architecture.OutputModalities, modality)
+	})
+}
+
+// FilterBySupportedFeature returns the models listing the feature, e.g.
+// "tools", in SupportedFeatures, matched case-insensitively. models is not
+// modified.
+func FilterBySupportedFeature(models []Model, feature string) []Model {
+	return filterModels(models, func(m Model) bool {
+		return containsFold(m.SupportedFeatures, feature)
+	})
+}
+
+// filterModels returns a new slice of the models for which keep is true.
+func filterModels(models []Model, keep func(Model) bool) []Model {
+	filtered := make([]Model, 0, len(models))
+	for _, m := range models {
+		if keep(m) {
+			filtered = append(filtered, m)
+		}
+	}
+	return filtered
+}
+
+// containsFold reports whether values contains s, ignoring case.
+func containsFold(values []string, s string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -3,8 +3,11 @@ package models
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"math"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 )
 
@@ -239,6 +242,47 @@ func TestModelTypes(t *testing.T) {
 	}
 }
 
+func TestModelParameters(t *testing.T) {
+	m := Model{
+		ID: "test-model",
+		Parameters: []Parameter{
+			{
+				Name:         "thinking_budget",
+				Schema:       json.RawMessage(`{"type":"number","minimum":0,"maximum":31999}`),
+				DefaultValue: json.RawMessage(`0`),
+			},
+			{
+				Name:   "temperature",
+				Schema: json.RawMessage(`{"type":"number","minimum":0,"maximum":2}`),
+			},
+		},
+	}
+
+	if !m.HasParameter("thinking_budget") || !m.HasParameter("temperature") {
+		t.Error("expected thinking_budget and temperature to be supported")
+	}
+	if m.HasParameter("top_k") {
+		t.Error("expected top_k to be unsupported")
+	}
+
+	p, ok := m.Parameter("temperature")
+	if !ok || p.Name != "temperature" || string(p.Schema) != `{"type":"number","minimum":0,"maximum":2}` {
+		t.Errorf("unexpected parameter: %+v, %v", p, ok)
+	}
+	if _, ok := m.Parameter("top_k"); ok {
+		t.Error("expected no top_k parameter")
+	}
+
+	proposed := map[string]any{"temperature": 0.7, "top_k": 40, "thinking_budget": 1024}
+	filtered := m.FilterParameters(proposed)
+	if len(filtered) != 2 || filtered["temperature"] != 0.7 || filtered["thinking_budget"] != 1024 {
+		t.Errorf("unexpected filtered parameters: %v", filtered)
+	}
+	if len(proposed) != 3 {
+		t.Error("expected proposed parameters to be left unchanged")
+	}
+}
+
 func TestFetchCustomOptions(t *testing.T) {
 	var receivedHeaders http.Header
 	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -301,3 +345,121 @@ func TestFetchCancelledContext(t *testing.T) {
 		t.Fatal("expected error for cancelled context")
 	}
 }
+
+func TestFetchByID(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"object":"list","data":[
+			{"id":"GPT-4o","owned_by":"OpenAI"},
+			{"id":"Claude-Sonnet-4","owned_by":"Anthropic"}
+		]}`))
+	}))
+	defer srv.Close()
+
+	model, err := FetchByID(context.Background(), "Claude-Sonnet-4", &Options{BaseURL: srv.URL})
+	if err != nil {
+		t.Fatalf("FetchByID() error: %v", err)
+	}
+	if model.ID != "Claude-Sonnet-4" || model.OwnedBy != "Anthropic" {
+		t.Errorf("unexpected model: %+v", model)
+	}
+
+	// Matching is exact, so a differently cased ID is not found
+	for _, id := range []string{"gpt-4o", "Gemini"} {
+		model, err = FetchByID(context.Background(), id, &Options{BaseURL: srv.URL})
+		if !errors.Is(err, ErrModelNotFound) {
+			t.Errorf("FetchByID(%q) error = %v, want ErrModelNotFound", id, err)
+		}
+		if model != nil {
+			t.Errorf("FetchByID(%q) = %+v, want nil", id, model)
+		}
+	}
+}
+
+func TestPricing(t *testing.T) {
+	str := func(s string) *string { return &s }
+
+	priced := Model{ID: "text-model", Pricing: &Pricing{
+		Prompt:         str("0.000003"),
+		Completion:     str("0.000015"),
+		InputCacheRead: str("0.0000003"),
+	}}
+	if v, ok := priced.Pricing.PromptFloat(); !ok || v != 0.000003 {
+		t.Errorf("PromptFloat() = %v, %v", v, ok)
+	}
+	if v, ok := priced.Pricing.InputCacheReadFloat(); !ok || v != 0.0000003 {
+		t.Errorf("InputCacheReadFloat() = %v, %v", v, ok)
+	}
+	if _, ok := priced.Pricing.ImageFloat(); ok {
+		t.Error("expected no image price")
+	}
+	cost, ok := priced.EstimateCost(1000, 500)
+	if want := 1000*0.000003 + 500*0.000015; !ok || math.Abs(cost-want) > 1e-12 {
+		t.Errorf("EstimateCost() = %v, %v, want %v", cost, ok, want)
+	}
+
+	// Image generation models have null token pricing
+	imageGen := Model{ID: "image-model", Pricing: &Pricing{Image: str("0.04")}}
+	if v, ok := imageGen.Pricing.ImageFloat(); !ok || v != 0.04 {
+		t.Errorf("ImageFloat() = %v, %v", v, ok)
+	}
+	if _, ok := imageGen.EstimateCost(1000, 500); ok {
+		t.Error("expected no estimate without token prices")
+	}
+
+	unpriced := Model{ID: "free-model"}
+	if _, ok := unpriced.Pricing.PromptFloat(); ok {
+		t.Error("expected nil pricing to have no prompt price")
+	}
+	if _, ok := unpriced.EstimateCost(1, 1); ok {
+		t.Error("expected no estimate for nil pricing")
+	}
+
+	malformed := Model{ID: "bad-model", Pricing: &Pricing{Prompt: str("$0.01"), Completion: str("0.00001")}}
+	if _, ok := malformed.Pricing.PromptFloat(); ok {
+		t.Error("expected malformed price to be rejected")
+	}
+	if _, ok := malformed.EstimateCost(1, 1); ok {
+		t.Error("expected no estimate with a malformed price")
+	}
+}
+
+func TestFilters(t *testing.T) {
+	fixture := []Model{
+		{ID: "text", Architecture: Architecture{InputModalities: []string{"text"}, OutputModalities: []string{"text"}}},
+		{ID: "vision", Architecture: Architecture{InputModalities: []string{"text", "image"}, OutputModalities: []string{"text"}}, SupportedFeatures: []string{"tools"}},
+		{ID: "image-gen", Architecture: Architecture{InputModalities: []string{"text"}, OutputModalities: []string{"Image"}}},
+		{ID: "agent", Architecture: Architecture{InputModalities: []string{"text"}, OutputModalities: []string{"text"}}, SupportedFeatures: []string{"Tools", "web_search"}},
+	}
+	ids := func(models []Model) string {
+		var out []string
+		for _, m := range models {
+			out = append(out, m.ID)
+		}
+		return strings.Join(out, ",")
+	}
+
+	tests := []struct {
+		name string
+		got  []Model
+		want string
+	}{
+		{"input text", FilterByInputModality(fixture, "text"), "text,vision,image-gen,agent"},
+		{"input image", FilterByInputModality(fixture, "IMAGE"), "vision"},
+		{"output image", FilterByOutputModality(fixture, "image"), "image-gen"},
+		{"feature tools", FilterBySupportedFeature(fixture, "tools"), "vision,agent"},
+		{"feature missing", FilterBySupportedFeature(fixture, "audio"), ""},
+	}
+	for _, tt := range tests {
+		if got := ids(tt.got); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	// The result is a new slice
+	filtered := FilterByInputModality(fixture, "text")
+	filtered[0].ID = "changed"
+	if fixture[0].ID != "text" {
+		t.Error("expected the input slice to be left unchanged")
+	}
+}
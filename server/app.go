@@ -3,20 +3,27 @@ package server
 import (
 	"bytes"
 	"context"
-	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/n0madic/go-poe/types"
 )
 
-// FindAccessKey checks param, then POE_ACCESS_KEY env
+// shutdownTimeout bounds graceful shutdown in RunContext
+const shutdownTimeout = 10 * time.Second
+
+// FindAccessKey checks param, then POE_ACCESS_KEY env, then the file named by
+// POE_ACCESS_KEY_FILE env, as with mounted Docker secrets
 func FindAccessKey(accessKey string) string {
 	if accessKey != "" {
 		return strings.TrimSpace(accessKey)
@@ -24,6 +31,14 @@ func FindAccessKey(accessKey string) string {
 	if envKey := os.Getenv("POE_ACCESS_KEY"); envKey != "" {
 		return strings.TrimSpace(envKey)
 	}
+	if keyFile := os.Getenv("POE_ACCESS_KEY_FILE"); keyFile != "" {
+		data, err := os.ReadFile(keyFile)
+		if err != nil {
+			log.Printf("Warning: failed to read POE_ACCESS_KEY_FILE: %v", err)
+			return ""
+		}
+		return strings.TrimSpace(string(data))
+	}
 	return ""
 }
 
@@ -40,7 +55,7 @@ func syncBotSettings(botName, accessKey string, settings map[string]any, baseURL
 	escapedKey := url.PathEscape(accessKey)
 	if settings != nil {
 		syncURL = fmt.Sprintf("%supdate_settings/%s/%s/%s", baseURL, escapedName, escapedKey, types.ProtocolVersion)
-		data, err := json.Marshal(settings)
+		data, err := jsonMarshal(settings)
 		if err != nil {
 			return fmt.Errorf("failed to marshal settings: %w", err)
 		}
@@ -73,8 +88,114 @@ func syncBotSettings(botName, accessKey string, settings map[string]any, baseURL
 	return nil
 }
 
+// syncSettingsForBot fetches the bot's settings and syncs them with the Poe API
+func syncSettingsForBot(ctx context.Context, bot PoeBot, baseURL string) error {
+	settings, err := bot.GetSettings(ctx, &types.SettingsRequest{
+		BaseRequest: types.BaseRequest{
+			Version: types.ProtocolVersion,
+			Type:    types.RequestTypeSettings,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to get settings: %w", err)
+	}
+	settingsMap, err := settings.ToMap()
+	if err != nil {
+		return fmt.Errorf("failed to convert settings: %w", err)
+	}
+	return syncBotSettings(bot.BotName(), bot.AccessKey(), settingsMap, baseURL)
+}
+
+// AppOptions configures the handlers created by MakeAppWithOptions and
+// HandlerWithOptions. The zero value uses the defaults.
+type AppOptions struct {
+	// CorrelationIDHeader is the inbound header read for a correlation ID
+	// (default: X-Correlation-ID). The ID is stored in the request context,
+	// where CorrelationID returns it and the client package forwards it on
+	// dependency calls made with that context.
+	CorrelationIDHeader string
+	// RequestIDHeader is the inbound header read for a request ID (default:
+	// X-Request-ID); a random ID is generated when it is missing. The ID is
+	// echoed in the response header of the same name and attached to every
+	// log line written for the request, including those of client calls made
+	// with its context.
+	RequestIDHeader string
+	// HealthCheckPath is the path of the liveness endpoint registered by
+	// MakeAppWithOptions (default: /healthz), answering GET requests with
+	// {"status":"ok"} without authentication. It is skipped when a bot uses
+	// the same path, and the default is also skipped when a bot serves "/",
+	// which would otherwise lose /healthz to the more specific pattern; set
+	// the path explicitly to register it alongside such a bot.
+	HealthCheckPath string
+	// DisableHealthCheck skips registering the liveness endpoint
+	DisableHealthCheck bool
+	// MaxRequestBodyBytes caps the size of request bodies read by bot
+	// handlers (default: 8 MB, negative means no limit); larger requests are
+	// rejected with 413 Request Entity Too Large
+	MaxRequestBodyBytes int64
+	// DebugErrors includes the recovered value in the error event sent when
+	// answering a query panics and the bot has no panic handler. It exposes
+	// internals to users, so only enable it during development.
+	DebugErrors bool
+}
+
+// defaultMaxRequestBodyBytes is the default AppOptions.MaxRequestBodyBytes
+const defaultMaxRequestBodyBytes = 8 << 20
+
+func (o *AppOptions) defaults() {
+	if o.CorrelationIDHeader == "" {
+		o.CorrelationIDHeader = types.DefaultCorrelationIDHeader
+	}
+	if o.RequestIDHeader == "" {
+		o.RequestIDHeader = "X-Request-ID"
+	}
+	if o.HealthCheckPath == "" {
+		o.HealthCheckPath = "/healthz"
+	}
+	if o.MaxRequestBodyBytes == 0 {
+		o.MaxRequestBodyBytes = defaultMaxRequestBodyBytes
+	}
+}
+
+// Handler returns an http.Handler serving a single bot at any path, for
+// serverless platforms and gateways that route or rewrite paths themselves.
+// Unlike MakeApp it ignores bot.Path() and does not sync settings on startup;
+// Poe still fetches them with a settings request.
+func Handler(bot PoeBot) http.Handler {
+	return HandlerWithOptions(bot, nil)
+}
+
+// HandlerWithOptions is Handler configured by opts
+func HandlerWithOptions(bot PoeBot, opts *AppOptions) http.Handler {
+	return botHandler(bot, opts)
+}
+
+// healthCheckHandler reports that the server is up
+func healthCheckHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, `{"status":"ok"}`)
+}
+
 // MakeApp creates an http.Handler that serves one or more PoeBot instances
+// and a liveness endpoint at /healthz (unless a bot serves "/")
 func MakeApp(bots ...PoeBot) http.Handler {
+	return MakeAppWithOptions(nil, bots...)
+}
+
+// MakeAppWithOptions is MakeApp configured by opts
+func MakeAppWithOptions(opts *AppOptions, bots ...PoeBot) http.Handler {
+	var o AppOptions
+	if opts != nil {
+		o = *opts
+	}
+	defaultHealthCheckPath := o.HealthCheckPath == ""
+	o.defaults()
 	mux := http.NewServeMux()
 
 	// Validate unique paths
@@ -85,28 +206,19 @@ func MakeApp(bots ...PoeBot) http.Handler {
 		}
 		paths[bot.Path()] = true
 	}
+	// A bot at "/" keeps the default path
+	if !o.DisableHealthCheck && !paths[o.HealthCheckPath] && !(defaultHealthCheckPath && paths["/"]) {
+		mux.HandleFunc(o.HealthCheckPath, healthCheckHandler)
+	}
 
 	for _, bot := range bots {
-		handler := botHandler(bot)
+		handler := botHandler(bot, &o)
 		mux.Handle(bot.Path(), handler)
 
 		// Sync settings on startup if bot has name and access key
 		if bot.BotName() != "" && bot.AccessKey() != "" {
 			go func(b PoeBot) {
-				settings, err := b.GetSettings(context.Background(), &types.SettingsRequest{
-					BaseRequest: types.BaseRequest{
-						Version: types.ProtocolVersion,
-						Type:    types.RequestTypeSettings,
-					},
-				})
-				if err != nil {
-					log.Printf("Error getting settings for %s: %v", b.BotName(), err)
-					return
-				}
-				settingsMap := make(map[string]any)
-				data, _ := json.Marshal(settings)
-				json.Unmarshal(data, &settingsMap)
-				if err := syncBotSettings(b.BotName(), b.AccessKey(), settingsMap, ""); err != nil {
+				if err := syncSettingsForBot(context.Background(), b, ""); err != nil {
 					log.Printf("Error syncing settings for %s: %v", b.BotName(), err)
 				}
 			}(bot)
@@ -118,17 +230,122 @@ func MakeApp(bots ...PoeBot) http.Handler {
 	return mux
 }
 
-// Run creates the app and starts an HTTP server
+// portFromEnv returns the port from POE_BOT_PORT or PORT, in that order
+func portFromEnv() (int, bool) {
+	for _, name := range []string{"POE_BOT_PORT", "PORT"} {
+		value := strings.TrimSpace(os.Getenv(name))
+		if value == "" {
+			continue
+		}
+		port, err := strconv.Atoi(value)
+		if err != nil || port <= 0 || port > 65535 {
+			log.Printf("Warning: ignoring invalid %s value %q", name, value)
+			continue
+		}
+		return port, true
+	}
+	return 0, false
+}
+
+// Run creates the app and starts an HTTP server.
+// The port is taken from the -p/--port flag, then the POE_BOT_PORT or PORT
+// environment variables, and defaults to 8080.
 func Run(bots ...PoeBot) {
 	port := flag.Int("p", 8080, "port to listen on")
 	flag.IntVar(port, "port", 8080, "port to listen on")
 	flag.Parse()
 
-	handler := MakeApp(bots...)
+	portSet := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "p" || f.Name == "port" {
+			portSet = true
+		}
+	})
+	if !portSet {
+		if envPort, ok := portFromEnv(); ok {
+			*port = envPort
+		}
+	}
 
 	addr := fmt.Sprintf(":%d", *port)
-	log.Printf("Starting Poe bot server on %s", addr)
-	if err := http.ListenAndServe(addr, handler); err != nil {
+	if err := RunContext(context.Background(), addr, bots...); err != nil {
 		log.Fatalf("Server error: %v", err)
 	}
 }
+
+// RunContext creates the app and serves it on addr until ctx is cancelled,
+// then shuts the server down gracefully. It does not parse flags, so it can
+// be used by applications with their own configuration.
+func RunContext(ctx context.Context, addr string, bots ...PoeBot) error {
+	return runServer(ctx, ServerConfig{Addr: addr}, bots...)
+}
+
+// ServerConfig configures RunWithConfig
+type ServerConfig struct {
+	// Addr is the address to listen on (default ":8080")
+	Addr string
+	// TLSCertFile and TLSKeyFile serve HTTPS when both are set
+	TLSCertFile string
+	TLSKeyFile  string
+	// ReadHeaderTimeout bounds the time to read request headers, guarding
+	// against slow clients holding connections open (0 means no limit)
+	ReadHeaderTimeout time.Duration
+	// App configures the served app (nil means the defaults)
+	App *AppOptions
+}
+
+// RunWithConfig creates the app and serves it as configured by cfg, over
+// HTTPS when a certificate and key are given. Unlike Run it does not parse
+// flags.
+func RunWithConfig(cfg ServerConfig, bots ...PoeBot) error {
+	if cfg.Addr == "" {
+		cfg.Addr = ":8080"
+	}
+	return runServer(context.Background(), cfg, bots...)
+}
+
+// runServer listens on cfg.Addr and serves the app until ctx is cancelled
+func runServer(ctx context.Context, cfg ServerConfig, bots ...PoeBot) error {
+	if (cfg.TLSCertFile == "") != (cfg.TLSKeyFile == "") {
+		return errors.New("both TLSCertFile and TLSKeyFile must be set to serve HTTPS")
+	}
+	useTLS := cfg.TLSCertFile != ""
+	addr := cfg.Addr
+	if addr == "" {
+		addr = ":http"
+		if useTLS {
+			addr = ":https"
+		}
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return serve(ctx, ln, cfg, MakeAppWithOptions(cfg.App, bots...))
+}
+
+// serve serves handler on ln until ctx is cancelled, then shuts the server
+// down gracefully
+func serve(ctx context.Context, ln net.Listener, cfg ServerConfig, handler http.Handler) error {
+	srv := &http.Server{Handler: handler, ReadHeaderTimeout: cfg.ReadHeaderTimeout}
+
+	errCh := make(chan error, 1)
+	go func() {
+		if cfg.TLSCertFile != "" {
+			log.Printf("Starting Poe bot server on %s (TLS)", ln.Addr())
+			errCh <- srv.ServeTLS(ln, cfg.TLSCertFile, cfg.TLSKeyFile)
+			return
+		}
+		log.Printf("Starting Poe bot server on %s", ln.Addr())
+		errCh <- srv.Serve(ln)
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		return srv.Shutdown(shutdownCtx)
+	}
+}
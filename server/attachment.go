@@ -1,64 +1,106 @@
 package server
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"mime"
+	"net/http"
 	"strings"
+	"time"
 
 	"github.com/n0madic/go-poe/types"
 )
 
+// AttachmentTemplates are the fmt templates used to turn parsed attachment
+// content into messages. Each takes the attachment name and its content.
+// Empty fields fall back to the types package defaults.
+type AttachmentTemplates struct {
+	TextTemplate  string // text files and PDFs, default types.TextAttachmentTemplate
+	URLTemplate   string // web pages, default types.URLAttachmentTemplate
+	ImageTemplate string // image descriptions, default types.ImageVisionAttachmentTemplate
+}
+
+// withDefaults fills empty templates with the defaults
+func (t AttachmentTemplates) withDefaults() AttachmentTemplates {
+	if t.TextTemplate == "" {
+		t.TextTemplate = types.TextAttachmentTemplate
+	}
+	if t.URLTemplate == "" {
+		t.URLTemplate = types.URLAttachmentTemplate
+	}
+	if t.ImageTemplate == "" {
+		t.ImageTemplate = types.ImageVisionAttachmentTemplate
+	}
+	return t
+}
+
+// insertBotAttachmentMessages inserts attachment messages with the bot's
+// templates if it is an AttachmentTemplater
+func insertBotAttachmentMessages(bot PoeBot, req *types.QueryRequest) *types.QueryRequest {
+	var templates AttachmentTemplates
+	if t, ok := bot.(AttachmentTemplater); ok {
+		templates = t.AttachmentTemplates()
+	}
+	return InsertAttachmentMessagesWithTemplates(req, templates)
+}
+
 // InsertAttachmentMessages inserts messages containing attachment contents before the last user message.
 func InsertAttachmentMessages(req *types.QueryRequest) *types.QueryRequest {
+	return InsertAttachmentMessagesWithTemplates(req, AttachmentTemplates{})
+}
+
+// InsertAttachmentMessagesWithTemplates is InsertAttachmentMessages with custom templates.
+//
+// Attachments of tool-role messages, such as a generated image returned by a
+// tool, are appended to the tool message's own content instead, so tool
+// results stay in place in the conversation.
+func InsertAttachmentMessagesWithTemplates(req *types.QueryRequest, templates AttachmentTemplates) *types.QueryRequest {
 	if len(req.Query) == 0 {
 		return req
 	}
+	templates = templates.withDefaults()
+
+	query := make([]types.ProtocolMessage, len(req.Query))
+	copy(query, req.Query)
+	for i, msg := range query {
+		if msg.Role != "tool" {
+			continue
+		}
+		for _, attachment := range msg.Attachments {
+			if content, _, ok := formatAttachment(attachment, templates); ok {
+				query[i].Content += "\n\n" + content
+			}
+		}
+	}
 
-	lastMessage := req.Query[len(req.Query)-1]
+	lastMessage := query[len(query)-1]
 	var textAttachmentMessages []types.ProtocolMessage
 	var imageAttachmentMessages []types.ProtocolMessage
 
-	for _, attachment := range lastMessage.Attachments {
-		if attachment.ParsedContent == nil || *attachment.ParsedContent == "" {
-			continue
-		}
-		parsedContent := *attachment.ParsedContent
-
-		if attachment.ContentType == "text/html" {
-			content := fmt.Sprintf(types.URLAttachmentTemplate, attachment.Name, parsedContent)
-			textAttachmentMessages = append(textAttachmentMessages, types.ProtocolMessage{
-				Role:    "user",
-				Sender:  &types.Sender{},
-				Content: content,
-			})
-		} else if strings.HasPrefix(attachment.ContentType, "text/") || attachment.ContentType == "application/pdf" {
-			content := fmt.Sprintf(types.TextAttachmentTemplate, attachment.Name, parsedContent)
-			textAttachmentMessages = append(textAttachmentMessages, types.ProtocolMessage{
-				Role:    "user",
-				Sender:  &types.Sender{},
-				Content: content,
-			})
-		} else if strings.Contains(attachment.ContentType, "image") {
-			var filename, description string
-			parts := strings.SplitN(parsedContent, "***", 2)
-			if len(parts) == 2 {
-				filename = parts[0]
-				description = parts[1]
+	if lastMessage.Role != "tool" {
+		for _, attachment := range lastMessage.Attachments {
+			content, isImage, ok := formatAttachment(attachment, templates)
+			if !ok {
+				continue
+			}
+			msg := types.ProtocolMessage{
+				Role:      "user",
+				Sender:    &types.Sender{},
+				Content:   content,
+				Timestamp: lastMessage.Timestamp,
+			}
+			if isImage {
+				imageAttachmentMessages = append(imageAttachmentMessages, msg)
 			} else {
-				filename = attachment.Name
-				description = parsedContent
+				textAttachmentMessages = append(textAttachmentMessages, msg)
 			}
-			content := fmt.Sprintf(types.ImageVisionAttachmentTemplate, filename, description)
-			imageAttachmentMessages = append(imageAttachmentMessages, types.ProtocolMessage{
-				Role:    "user",
-				Sender:  &types.Sender{},
-				Content: content,
-			})
 		}
 	}
 
 	// Build new query: original messages (minus last) + text attachments + image attachments + last message
-	newQuery := make([]types.ProtocolMessage, 0, len(req.Query)+len(textAttachmentMessages)+len(imageAttachmentMessages))
-	newQuery = append(newQuery, req.Query[:len(req.Query)-1]...)
+	newQuery := make([]types.ProtocolMessage, 0, len(query)+len(textAttachmentMessages)+len(imageAttachmentMessages))
+	newQuery = append(newQuery, query[:len(query)-1]...)
 	newQuery = append(newQuery, textAttachmentMessages...)
 	newQuery = append(newQuery, imageAttachmentMessages...)
 	newQuery = append(newQuery, lastMessage)
@@ -69,12 +111,41 @@ func InsertAttachmentMessages(req *types.QueryRequest) *types.QueryRequest {
 	return &newReq
 }
 
+// formatAttachment renders the parsed content of an attachment with the
+// matching template. ok is false if the attachment has no parsed content or
+// an unsupported content type.
+func formatAttachment(attachment types.Attachment, templates AttachmentTemplates) (content string, isImage, ok bool) {
+	if attachment.ParsedContent == nil || *attachment.ParsedContent == "" {
+		return "", false, false
+	}
+	parsedContent := *attachment.ParsedContent
+
+	if attachment.ContentType == "text/html" {
+		return fmt.Sprintf(templates.URLTemplate, attachment.Name, parsedContent), false, true
+	} else if strings.HasPrefix(attachment.ContentType, "text/") || attachment.ContentType == "application/pdf" {
+		return fmt.Sprintf(templates.TextTemplate, attachment.Name, parsedContent), false, true
+	} else if strings.Contains(attachment.ContentType, "image") {
+		var filename, description string
+		parts := strings.SplitN(parsedContent, "***", 2)
+		if len(parts) == 2 {
+			filename = parts[0]
+			description = parts[1]
+		} else {
+			filename = attachment.Name
+			description = parsedContent
+		}
+		return fmt.Sprintf(templates.ImageTemplate, filename, description), true, true
+	}
+	return "", false, false
+}
+
 // MakePromptAuthorRoleAlternated merges consecutive same-role messages.
+// Tool-role messages are never merged, since each one is a separate tool result.
 func MakePromptAuthorRoleAlternated(messages []types.ProtocolMessage) []types.ProtocolMessage {
 	var result []types.ProtocolMessage
 
 	for _, msg := range messages {
-		if len(result) > 0 && msg.Role == result[len(result)-1].Role {
+		if len(result) > 0 && msg.Role != "tool" && msg.Role == result[len(result)-1].Role {
 			prev := result[len(result)-1]
 			newContent := prev.Content + "\n\n" + msg.Content
 
@@ -104,3 +175,99 @@ func MakePromptAuthorRoleAlternated(messages []types.ProtocolMessage) []types.Pr
 
 	return result
 }
+
+// DefaultAttachmentSizeLimit is the download limit used when no per-type limit matches
+const DefaultAttachmentSizeLimit int64 = 50 << 20
+
+// AttachmentTooLargeError is returned when an attachment exceeds its size limit
+type AttachmentTooLargeError struct {
+	URL         string
+	ContentType string
+	Limit       int64
+}
+
+func (e *AttachmentTooLargeError) Error() string {
+	return fmt.Sprintf("attachment %s (%s) exceeds size limit of %d bytes", e.URL, e.ContentType, e.Limit)
+}
+
+// FetchAttachmentOptions configures FetchAttachmentContent
+type FetchAttachmentOptions struct {
+	// SizeLimits maps content types to maximum sizes in bytes. Keys may be exact
+	// ("image/png") or wildcards ("image/*", "*").
+	SizeLimits map[string]int64
+	// DefaultSizeLimit applies when no key in SizeLimits matches
+	// (default DefaultAttachmentSizeLimit)
+	DefaultSizeLimit int64
+	HTTPClient       *http.Client
+}
+
+// sizeLimit returns the limit for a content type: exact match, then
+// "type/*", then "*", then the default
+func (o *FetchAttachmentOptions) sizeLimit(contentType string) int64 {
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil {
+		contentType = mediaType
+	}
+	if limit, ok := o.SizeLimits[contentType]; ok {
+		return limit
+	}
+	if major, _, ok := strings.Cut(contentType, "/"); ok {
+		if limit, ok := o.SizeLimits[major+"/*"]; ok {
+			return limit
+		}
+	}
+	if limit, ok := o.SizeLimits["*"]; ok {
+		return limit
+	}
+	if o.DefaultSizeLimit > 0 {
+		return o.DefaultSizeLimit
+	}
+	return DefaultAttachmentSizeLimit
+}
+
+// FetchAttachmentContent downloads an attachment, enforcing the size limit for
+// its content type. The download is aborted with *AttachmentTooLargeError as
+// soon as the limit is known to be exceeded, either from Content-Length or
+// while reading the body.
+func FetchAttachmentContent(ctx context.Context, att types.Attachment, opts *FetchAttachmentOptions) ([]byte, error) {
+	if opts == nil {
+		opts = &FetchAttachmentOptions{}
+	}
+	httpClient := opts.HTTPClient
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: 120 * time.Second}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, att.URL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create attachment request: %w", err)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download attachment %s: %w", att.URL, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to download attachment %s: status %d", att.URL, resp.StatusCode)
+	}
+
+	contentType := att.ContentType
+	if contentType == "" {
+		contentType = resp.Header.Get("Content-Type")
+	}
+	limit := opts.sizeLimit(contentType)
+	tooLarge := &AttachmentTooLargeError{URL: att.URL, ContentType: contentType, Limit: limit}
+
+	if resp.ContentLength > limit {
+		return nil, tooLarge
+	}
+	// Read one byte past the limit to detect oversized bodies without buffering them
+	data, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read attachment %s: %w", att.URL, err)
+	}
+	if int64(len(data)) > limit {
+		return nil, tooLarge
+	}
+	return data, nil
+}
@@ -2,6 +2,12 @@ package server
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+	"unicode"
 
 	"github.com/n0madic/go-poe/types"
 )
@@ -28,16 +34,153 @@ type PoeBot interface {
 	OnError(ctx context.Context, req *types.ReportErrorRequest) error
 }
 
+// StateStore is implemented by bots that persist per-conversation state
+// around GetResponse, see ConversationState. BasePoeBot implements it with
+// no state.
+type StateStore interface {
+	// LoadState loads per-conversation state before GetResponse is called
+	LoadState(conversationID string) (map[string]any, error)
+	// SaveState persists per-conversation state after the response completes
+	SaveState(conversationID string, state map[string]any) error
+}
+
+// OutputLimiter is implemented by bots that cap the emitted response text.
+// BasePoeBot implements it, see SetMaxOutputChars.
+type OutputLimiter interface {
+	// MaxOutputChars returns the cap on emitted response text (0 means unlimited)
+	MaxOutputChars() int
+}
+
+// KeyAcceptor is implemented by bots that accept further access keys besides
+// AccessKey. BasePoeBot implements it, see AddAcceptedKey.
+type KeyAcceptor interface {
+	// AcceptedKeys returns further access keys that authenticate requests,
+	// e.g. the old key while rotating to a new one
+	AcceptedKeys() []string
+}
+
+// IndexPager is implemented by bots that replace the page served on GET
+// requests. BasePoeBot implements it, see SetIndexHTML.
+type IndexPager interface {
+	// IndexHTML returns the page served on GET requests ("" means
+	// DefaultIndexHTML)
+	IndexHTML() string
+}
+
+// TextOverflower is implemented by bots that upload response text past an
+// inline cap as a file. BasePoeBot implements it, see SetMaxInlineTextBytes
+// and SetTextUploader.
+type TextOverflower interface {
+	// MaxInlineTextBytes returns the size of response text sent inline before
+	// the rest is uploaded as a file (0 means unlimited)
+	MaxInlineTextBytes() int
+	// TextUploader returns the uploader for the text past the cap (nil
+	// means the cap is not applied)
+	TextUploader() TextUploader
+}
+
+// AttachmentTemplater is implemented by bots that override the templates used
+// to insert attachment messages. BasePoeBot implements it, see
+// SetAttachmentTemplates.
+type AttachmentTemplater interface {
+	// AttachmentTemplates returns the templates used to insert attachment messages
+	AttachmentTemplates() AttachmentTemplates
+}
+
+// TextCoalescer is implemented by bots that coalesce text events before they
+// are sent. BasePoeBot implements it, see SetTextBuffer.
+type TextCoalescer interface {
+	// TextBuffer returns how text events are coalesced before being sent
+	TextBuffer() TextBuffer
+}
+
+// DoneEventEmitter is implemented by bots that may send the done event
+// themselves. Other bots always get it sent automatically. BasePoeBot
+// implements it, see SetEmitDoneEvent.
+type DoneEventEmitter interface {
+	// ShouldEmitDoneEvent returns whether the done event is sent automatically
+	// after GetResponse finishes. If false, the bot sends it with a DoneResponse.
+	ShouldEmitDoneEvent() bool
+}
+
+// PanicReporter is implemented by bots that customize the error event sent
+// when answering a query panics. BasePoeBot implements it, see
+// SetPanicHandler.
+type PanicReporter interface {
+	// PanicHandler returns the handler for panics while answering a query
+	// (nil means DefaultPanicHandler)
+	PanicHandler() PanicHandler
+}
+
 // BasePoeBot provides a default implementation of PoeBot that can be embedded
 type BasePoeBot struct {
 	path                           string
 	accessKey                      string
+	acceptedKeys                   []string
 	botName                        string
 	shouldInsertAttachmentMessages bool
+	maxOutputChars                 int
+	maxInlineTextBytes             int
+	textUploader                   TextUploader
+	attachmentTemplates            AttachmentTemplates
+	textBuffer                     TextBuffer
+	disableAutoDone                bool
+	panicHandler                   PanicHandler
+	indexHTML                      string
+}
+
+// TextBuffer coalesces adjacent text chunks into fewer SSE events.
+// Buffered text is sent once Interval has passed since the first buffered
+// chunk, once MaxBytes are buffered, or before any other event, so event
+// order is preserved. A zero Interval sends every chunk immediately.
+//
+// With MarkdownSafe, text is only sent up to types.SafeMarkdownBoundary and an
+// unfinished construct such as "**bo" is held back until more text arrives.
+// Everything is sent at the end of the response or before any other event.
+type TextBuffer struct {
+	Interval     time.Duration
+	MaxBytes     int
+	MarkdownSafe bool
 }
 
-// NewBasePoeBot creates a new BasePoeBot with the given configuration
+// maxAccessKeyLength is an upper bound on plausible access key length
+const maxAccessKeyLength = 256
+
+// ValidateAccessKey checks that key looks like a plausible access key:
+// non-empty, no whitespace or control characters, not a file path,
+// and of reasonable length
+func ValidateAccessKey(key string) error {
+	if key == "" {
+		return errors.New("access key is empty")
+	}
+	if len(key) > maxAccessKeyLength {
+		return fmt.Errorf("access key is too long (%d characters)", len(key))
+	}
+	for _, r := range key {
+		if unicode.IsSpace(r) || unicode.IsControl(r) {
+			return errors.New("access key contains whitespace or control characters")
+		}
+	}
+	if strings.ContainsAny(key, `/\`) {
+		return errors.New("access key looks like a file path")
+	}
+	return nil
+}
+
+// warnInvalidAccessKey logs a warning for a non-empty implausible access key
+func warnInvalidAccessKey(key string) {
+	if key == "" {
+		return
+	}
+	if err := ValidateAccessKey(key); err != nil {
+		log.Printf("Warning: invalid access key: %v", err)
+	}
+}
+
+// NewBasePoeBot creates a new BasePoeBot with the given configuration.
+// A warning is logged if accessKey is set but fails ValidateAccessKey.
 func NewBasePoeBot(path, accessKey, botName string) *BasePoeBot {
+	warnInvalidAccessKey(accessKey)
 	return &BasePoeBot{
 		path:                           path,
 		accessKey:                      accessKey,
@@ -46,17 +189,73 @@ func NewBasePoeBot(path, accessKey, botName string) *BasePoeBot {
 	}
 }
 
-func (b *BasePoeBot) Path() string                         { return b.path }
-func (b *BasePoeBot) AccessKey() string                    { return b.accessKey }
-func (b *BasePoeBot) BotName() string                      { return b.botName }
-func (b *BasePoeBot) ShouldInsertAttachmentMessages() bool { return b.shouldInsertAttachmentMessages }
+func (b *BasePoeBot) Path() string                             { return b.path }
+func (b *BasePoeBot) AccessKey() string                        { return b.accessKey }
+func (b *BasePoeBot) AcceptedKeys() []string                   { return b.acceptedKeys }
+func (b *BasePoeBot) BotName() string                          { return b.botName }
+func (b *BasePoeBot) ShouldInsertAttachmentMessages() bool     { return b.shouldInsertAttachmentMessages }
+func (b *BasePoeBot) MaxOutputChars() int                      { return b.maxOutputChars }
+func (b *BasePoeBot) MaxInlineTextBytes() int                  { return b.maxInlineTextBytes }
+func (b *BasePoeBot) TextUploader() TextUploader               { return b.textUploader }
+func (b *BasePoeBot) AttachmentTemplates() AttachmentTemplates { return b.attachmentTemplates }
+func (b *BasePoeBot) TextBuffer() TextBuffer                   { return b.textBuffer }
+func (b *BasePoeBot) ShouldEmitDoneEvent() bool                { return !b.disableAutoDone }
+func (b *BasePoeBot) PanicHandler() PanicHandler               { return b.panicHandler }
+func (b *BasePoeBot) IndexHTML() string                        { return b.indexHTML }
+
+// SetAccessKey sets the access key (used during app setup).
+// A warning is logged if key is set but fails ValidateAccessKey.
+func (b *BasePoeBot) SetAccessKey(key string) {
+	warnInvalidAccessKey(key)
+	b.accessKey = key
+}
 
-// SetAccessKey sets the access key (used during app setup)
-func (b *BasePoeBot) SetAccessKey(key string) { b.accessKey = key }
+// AddAcceptedKey accepts key for authentication besides the primary access
+// key, e.g. the previous key during rotation. Settings sync and uploads keep
+// using the primary key. A warning is logged if key fails ValidateAccessKey.
+func (b *BasePoeBot) AddAcceptedKey(key string) {
+	if key == "" {
+		return
+	}
+	warnInvalidAccessKey(key)
+	b.acceptedKeys = append(b.acceptedKeys, key)
+}
 
 // SetBotName sets the bot name (used during app setup)
 func (b *BasePoeBot) SetBotName(name string) { b.botName = name }
 
+// SetMaxOutputChars caps the total response text in characters.
+// Once reached, further text is dropped and a truncation notice is emitted.
+func (b *BasePoeBot) SetMaxOutputChars(n int) { b.maxOutputChars = n }
+
+// SetMaxInlineTextBytes caps the response text sent inline in bytes. Text
+// past the cap is uploaded with the uploader set by SetTextUploader once the
+// response ends and sent as a file, with a notice telling the user. Without
+// an uploader the cap is not applied.
+func (b *BasePoeBot) SetMaxInlineTextBytes(n int) { b.maxInlineTextBytes = n }
+
+// SetTextUploader sets the uploader for the text past MaxInlineTextBytes
+func (b *BasePoeBot) SetTextUploader(u TextUploader) { b.textUploader = u }
+
+// SetAttachmentTemplates overrides the templates used to insert attachment
+// messages. Empty templates keep the defaults.
+func (b *BasePoeBot) SetAttachmentTemplates(t AttachmentTemplates) { b.attachmentTemplates = t }
+
+// SetTextBuffer coalesces text chunks emitted by GetResponse, see TextBuffer
+func (b *BasePoeBot) SetTextBuffer(t TextBuffer) { b.textBuffer = t }
+
+// SetEmitDoneEvent controls whether the done event is sent automatically
+// (the default). When disabled, the bot is responsible for ending the response
+// with a DoneResponse, which is then written as soon as it is received.
+func (b *BasePoeBot) SetEmitDoneEvent(emit bool) { b.disableAutoDone = !emit }
+
+// SetPanicHandler customizes the error event sent when answering a query panics
+func (b *BasePoeBot) SetPanicHandler(h PanicHandler) { b.panicHandler = h }
+
+// SetIndexHTML replaces the landing page served on GET requests, e.g. to
+// brand a production deployment ("" restores DefaultIndexHTML)
+func (b *BasePoeBot) SetIndexHTML(html string) { b.indexHTML = html }
+
 // GetResponse default implementation yields "hello"
 func (b *BasePoeBot) GetResponse(ctx context.Context, req *types.QueryRequest) <-chan types.BotEvent {
 	ch := make(chan types.BotEvent, 1)
@@ -86,3 +285,13 @@ func (b *BasePoeBot) OnReaction(ctx context.Context, req *types.ReportReactionRe
 func (b *BasePoeBot) OnError(ctx context.Context, req *types.ReportErrorRequest) error {
 	return nil
 }
+
+// LoadState default returns no state
+func (b *BasePoeBot) LoadState(conversationID string) (map[string]any, error) {
+	return nil, nil
+}
+
+// SaveState default is a no-op
+func (b *BasePoeBot) SaveState(conversationID string, state map[string]any) error {
+	return nil
+}
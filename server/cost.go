@@ -3,10 +3,10 @@ package server
 import (
 	"bytes"
 	"context"
-	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"time"
 
 	"github.com/n0madic/go-poe/sse"
 	"github.com/n0madic/go-poe/types"
@@ -15,39 +15,95 @@ import (
 // CostRequestError is returned when a cost request fails
 type CostRequestError struct {
 	Message string
+	// Status is the status of the result event for an explicit failure other
+	// than insufficient funds
+	Status string
+	// Cause is the underlying error, e.g. when the stream breaks
+	Cause error
 }
 
-func (e *CostRequestError) Error() string { return e.Message }
+func (e *CostRequestError) Error() string {
+	if e.Cause != nil {
+		return fmt.Sprintf("%s: %v", e.Message, e.Cause)
+	}
+	return e.Message
+}
+
+func (e *CostRequestError) Unwrap() error { return e.Cause }
 
 // InsufficientFundError is returned when the user doesn't have enough funds
-type InsufficientFundError struct{}
+type InsufficientFundError struct {
+	// Status is the status of the result event, e.g. "insufficient_funds"
+	Status string
+}
 
 func (e *InsufficientFundError) Error() string { return "insufficient funds" }
 
+// insufficientFundStatuses are the result statuses reported as InsufficientFundError
+var insufficientFundStatuses = map[string]bool{
+	"insufficient_funds":        true,
+	types.ErrorInsufficientFund: true,
+}
+
+// CostRequestOptions configures CaptureCostWithOptions and AuthorizeCostWithOptions
+type CostRequestOptions struct {
+	// BaseURL of the Poe API (default: https://api.poe.com/)
+	BaseURL string
+	// HTTPClient sends the request (default: a client with a 60s timeout)
+	HTTPClient *http.Client
+}
+
+// defaultCostTimeout bounds cost requests sent with the default HTTP client
+const defaultCostTimeout = 60 * time.Second
+
+func (o *CostRequestOptions) defaults() {
+	if o.BaseURL == "" {
+		o.BaseURL = "https://api.poe.com/"
+	}
+	if o.HTTPClient == nil {
+		o.HTTPClient = &http.Client{Timeout: defaultCostTimeout}
+	}
+}
+
 // CaptureCost captures variable costs for monetized bot creators
 func CaptureCost(ctx context.Context, accessKey, botQueryID string, amounts []types.CostItem, baseURL string) error {
-	if baseURL == "" {
-		baseURL = "https://api.poe.com/"
-	}
-	url := fmt.Sprintf("%sbot/cost/%s/capture", baseURL, botQueryID)
-	return costRequestInner(ctx, accessKey, url, amounts)
+	return CaptureCostWithOptions(ctx, accessKey, botQueryID, amounts, &CostRequestOptions{BaseURL: baseURL})
 }
 
 // AuthorizeCost authorizes a cost for monetized bot creators
 func AuthorizeCost(ctx context.Context, accessKey, botQueryID string, amounts []types.CostItem, baseURL string) error {
-	if baseURL == "" {
-		baseURL = "https://api.poe.com/"
+	return AuthorizeCostWithOptions(ctx, accessKey, botQueryID, amounts, &CostRequestOptions{BaseURL: baseURL})
+}
+
+// CaptureCostWithOptions is CaptureCost with a configurable HTTP client
+func CaptureCostWithOptions(ctx context.Context, accessKey, botQueryID string, amounts []types.CostItem, opts *CostRequestOptions) error {
+	return costRequest(ctx, accessKey, botQueryID, "capture", amounts, opts)
+}
+
+// AuthorizeCostWithOptions is AuthorizeCost with a configurable HTTP client
+func AuthorizeCostWithOptions(ctx context.Context, accessKey, botQueryID string, amounts []types.CostItem, opts *CostRequestOptions) error {
+	return costRequest(ctx, accessKey, botQueryID, "authorize", amounts, opts)
+}
+
+func costRequest(ctx context.Context, accessKey, botQueryID, action string, amounts []types.CostItem, opts *CostRequestOptions) error {
+	var o CostRequestOptions
+	if opts != nil {
+		o = *opts
 	}
-	url := fmt.Sprintf("%sbot/cost/%s/authorize", baseURL, botQueryID)
-	return costRequestInner(ctx, accessKey, url, amounts)
+	o.defaults()
+	url := fmt.Sprintf("%sbot/cost/%s/%s", o.BaseURL, botQueryID, action)
+	return costRequestInner(ctx, o.HTTPClient, accessKey, url, amounts)
 }
 
-func costRequestInner(ctx context.Context, accessKey, url string, amounts []types.CostItem) error {
+func costRequestInner(ctx context.Context, client *http.Client, accessKey, url string, amounts []types.CostItem) error {
+	if err := types.ValidateCostItems(amounts); err != nil {
+		return fmt.Errorf("invalid cost items: %w", err)
+	}
 	data := map[string]any{
 		"amounts":    amounts,
 		"access_key": accessKey,
 	}
-	body, err := json.Marshal(data)
+	body, err := jsonMarshal(data)
 	if err != nil {
 		return fmt.Errorf("failed to marshal cost request: %w", err)
 	}
@@ -58,9 +114,9 @@ func costRequestInner(ctx context.Context, accessKey, url string, amounts []type
 	}
 	req.Header.Set("Content-Type", "application/json")
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := client.Do(req)
 	if err != nil {
-		return &CostRequestError{Message: fmt.Sprintf("HTTP error during cost request: %v", err)}
+		return &CostRequestError{Message: fmt.Sprintf("HTTP error during cost request: %v", err), Cause: err}
 	}
 	defer resp.Body.Close()
 
@@ -73,19 +129,41 @@ func costRequestInner(ctx context.Context, accessKey, url string, amounts []type
 
 	reader := sse.NewReader(resp.Body)
 	for {
+		if ctx.Err() != nil {
+			return &CostRequestError{Message: "cost request cancelled", Cause: ctx.Err()}
+		}
 		event, err := reader.ReadEvent()
+		if err == io.EOF {
+			return &CostRequestError{Message: "cost request ended without a result"}
+		}
 		if err != nil {
-			break
+			// Reading fails when ctx is cancelled mid-stream
+			if ctx.Err() != nil {
+				return &CostRequestError{Message: "cost request cancelled", Cause: ctx.Err()}
+			}
+			return &CostRequestError{Message: "failed to read cost request result", Cause: err}
 		}
 		if event.Event == "result" {
-			var eventData map[string]any
-			if err := json.Unmarshal([]byte(event.Data), &eventData); err == nil {
-				if status, ok := eventData["status"].(string); ok && status == "success" {
-					return nil
-				}
-			}
+			return costResult(event.Data)
 		}
 	}
+}
 
-	return &InsufficientFundError{}
+// costResult interprets the data of a result event
+func costResult(data string) error {
+	var eventData map[string]any
+	if err := jsonUnmarshal([]byte(data), &eventData); err != nil {
+		return &CostRequestError{Message: fmt.Sprintf("invalid cost result: %s", data), Cause: err}
+	}
+	status, ok := eventData["status"].(string)
+	switch {
+	case !ok:
+		return &CostRequestError{Message: fmt.Sprintf("cost result without status: %s", data)}
+	case status == "success":
+		return nil
+	case insufficientFundStatuses[status]:
+		return &InsufficientFundError{Status: status}
+	default:
+		return &CostRequestError{Message: fmt.Sprintf("cost request failed with status %q", status), Status: status}
+	}
 }
@@ -2,34 +2,98 @@ package server
 
 import (
 	"context"
-	"encoding/json"
+	"crypto/subtle"
+	"errors"
 	"io"
-	"log"
 	"net/http"
 	"strings"
 
 	"github.com/n0madic/go-poe/types"
 )
 
-// authenticate checks the Authorization: Bearer <key> header
-func authenticate(r *http.Request, accessKey string) bool {
-	if accessKey == "" {
+// authenticate checks the Authorization: Bearer <key> header against the
+// non-empty keys; with none, every request is accepted. The token is compared
+// with every key in constant time.
+func authenticate(r *http.Request, keys ...string) bool {
+	configured := false
+	for _, key := range keys {
+		if key != "" {
+			configured = true
+		}
+	}
+	if !configured {
 		return true
 	}
 	auth := r.Header.Get("Authorization")
 	if !strings.HasPrefix(auth, "Bearer ") {
 		return false
 	}
-	return strings.TrimPrefix(auth, "Bearer ") == accessKey
+	token := []byte(strings.TrimPrefix(auth, "Bearer "))
+	match := 0
+	for _, key := range keys {
+		if key != "" {
+			match |= subtle.ConstantTimeCompare(token, []byte(key))
+		}
+	}
+	return match == 1
+}
+
+// botKeys returns the primary and accepted access keys of bot
+func botKeys(bot PoeBot) []string {
+	keys := []string{bot.AccessKey()}
+	if a, ok := bot.(KeyAcceptor); ok {
+		keys = append(keys, a.AcceptedKeys()...)
+	}
+	return keys
+}
+
+// CorrelationID returns the correlation ID of the inbound request, or ""
+func CorrelationID(ctx context.Context) string {
+	return types.CorrelationIDFromContext(ctx)
+}
+
+// RequestID returns the ID of the inbound request, or ""
+func RequestID(ctx context.Context) string {
+	return types.RequestIDFromContext(ctx)
+}
+
+// BotQueryIDHeader is read to fill QueryRequest.BotQueryID when the request
+// body does not include a bot_query_id
+const BotQueryIDHeader = "X-Poe-Bot-Query-Id"
+
+type requestHeadersKey struct{}
+
+// RequestHeaders returns the headers of the inbound HTTP request, such as the
+// X-Poe-* metadata headers sent by Poe. The Authorization header is removed.
+// It returns nil outside a bot handler.
+func RequestHeaders(ctx context.Context) http.Header {
+	h, _ := ctx.Value(requestHeadersKey{}).(http.Header)
+	return h
 }
 
 // botHandler creates an http.Handler for a single bot
-func botHandler(bot PoeBot) http.Handler {
+func botHandler(bot PoeBot, opts *AppOptions) http.Handler {
+	var o AppOptions
+	if opts != nil {
+		o = *opts
+	}
+	o.defaults()
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("Received %s request to %s", r.Method, r.URL.Path)
+		requestID := r.Header.Get(o.RequestIDHeader)
+		if requestID == "" {
+			requestID = types.NewRequestID()
+		}
+		ctx := types.WithRequestID(r.Context(), requestID)
+		w.Header().Set(o.RequestIDHeader, requestID)
+
+		types.Logf(ctx, "Received %s request to %s", r.Method, r.URL.Path)
 
 		if r.Method == http.MethodGet {
-			handleIndex(w, r)
+			var html string
+			if p, ok := bot.(IndexPager); ok {
+				html = p.IndexHTML()
+			}
+			handleIndex(w, r, html)
 			return
 		}
 
@@ -38,15 +102,24 @@ func botHandler(bot PoeBot) http.Handler {
 			return
 		}
 
-		if !authenticate(r, bot.AccessKey()) {
-			log.Printf("Authentication failed for request to %s", r.URL.Path)
+		if !authenticate(r, botKeys(bot)...) {
+			types.Logf(ctx, "Authentication failed for request to %s", r.URL.Path)
 			http.Error(w, `{"detail":"Invalid access key"}`, http.StatusUnauthorized)
 			return
 		}
 
+		if o.MaxRequestBodyBytes > 0 {
+			r.Body = http.MaxBytesReader(w, r.Body, o.MaxRequestBodyBytes)
+		}
 		body, err := io.ReadAll(r.Body)
 		if err != nil {
-			log.Printf("Failed to read request body: %v", err)
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				types.Logf(ctx, "Request body to %s exceeds %d bytes", r.URL.Path, maxBytesErr.Limit)
+				http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			types.Logf(ctx, "Failed to read request body: %v", err)
 			http.Error(w, "Failed to read request body", http.StatusBadRequest)
 			return
 		}
@@ -54,30 +127,38 @@ func botHandler(bot PoeBot) http.Handler {
 
 		reqType, rawMsg, err := types.ParseRawRequest(body)
 		if err != nil {
-			log.Printf("Invalid JSON in request: %v", err)
+			types.Logf(ctx, "Invalid JSON in request: %v", err)
 			http.Error(w, "Invalid JSON", http.StatusBadRequest)
 			return
 		}
 
-		log.Printf("Processing request type: %s", reqType)
+		types.Logf(ctx, "Processing request type: %s", reqType)
 
-		ctx := r.Context()
+		headers := r.Header.Clone()
+		headers.Del("Authorization")
+		ctx = context.WithValue(ctx, requestHeadersKey{}, headers)
+		if id := r.Header.Get(o.CorrelationIDHeader); id != "" {
+			ctx = types.WithCorrelationID(ctx, id)
+		}
 
 		switch reqType {
 		case types.RequestTypeQuery:
 			var req types.QueryRequest
-			if err := json.Unmarshal(rawMsg, &req); err != nil {
+			if err := jsonUnmarshal(rawMsg, &req); err != nil {
 				http.Error(w, "Invalid query request", http.StatusBadRequest)
 				return
 			}
 			if bot.AccessKey() != "" {
 				req.AccessKey = bot.AccessKey()
 			}
-			handleQuery(ctx, w, bot, &req)
+			if req.BotQueryID == "" {
+				req.BotQueryID = r.Header.Get(BotQueryIDHeader)
+			}
+			handleQuery(ctx, w, bot, &req, o)
 
 		case types.RequestTypeSettings:
 			var req types.SettingsRequest
-			if err := json.Unmarshal(rawMsg, &req); err != nil {
+			if err := jsonUnmarshal(rawMsg, &req); err != nil {
 				http.Error(w, "Invalid settings request", http.StatusBadRequest)
 				return
 			}
@@ -85,36 +166,36 @@ func botHandler(bot PoeBot) http.Handler {
 
 		case types.RequestTypeReportFeedback:
 			var req types.ReportFeedbackRequest
-			if err := json.Unmarshal(rawMsg, &req); err != nil {
+			if err := jsonUnmarshal(rawMsg, &req); err != nil {
 				http.Error(w, "Invalid feedback request", http.StatusBadRequest)
 				return
 			}
 			if err := bot.OnFeedback(ctx, &req); err != nil {
-				log.Printf("Error handling feedback: %v", err)
+				types.Logf(ctx, "Error handling feedback: %v", err)
 			}
 			w.Header().Set("Content-Type", "application/json")
 			w.Write([]byte("{}"))
 
 		case types.RequestTypeReportReaction:
 			var req types.ReportReactionRequest
-			if err := json.Unmarshal(rawMsg, &req); err != nil {
+			if err := jsonUnmarshal(rawMsg, &req); err != nil {
 				http.Error(w, "Invalid reaction request", http.StatusBadRequest)
 				return
 			}
 			if err := bot.OnReaction(ctx, &req); err != nil {
-				log.Printf("Error handling reaction: %v", err)
+				types.Logf(ctx, "Error handling reaction: %v", err)
 			}
 			w.Header().Set("Content-Type", "application/json")
 			w.Write([]byte("{}"))
 
 		case types.RequestTypeReportError:
 			var req types.ReportErrorRequest
-			if err := json.Unmarshal(rawMsg, &req); err != nil {
+			if err := jsonUnmarshal(rawMsg, &req); err != nil {
 				http.Error(w, "Invalid error request", http.StatusBadRequest)
 				return
 			}
 			if err := bot.OnError(ctx, &req); err != nil {
-				log.Printf("Error handling error report: %v", err)
+				types.Logf(ctx, "Error handling error report: %v", err)
 			}
 			w.Header().Set("Content-Type", "application/json")
 			w.Write([]byte("{}"))
@@ -125,23 +206,34 @@ func botHandler(bot PoeBot) http.Handler {
 	})
 }
 
-func handleIndex(w http.ResponseWriter, r *http.Request) {
+// DefaultIndexHTML is the page served on GET requests to a bot unless the bot
+// sets its own with SetIndexHTML
+const DefaultIndexHTML = `<html><body><h1>Go Poe bot server</h1><p>Congratulations! Your server` +
+	` is running. To connect it to Poe, create a bot at <a` +
+	` href="https://poe.com/create_bot?server=1">https://poe.com/create_bot?server=1</a>.</p></body></html>`
+
+// handleIndex serves html, or DefaultIndexHTML if it is empty
+func handleIndex(w http.ResponseWriter, r *http.Request, html string) {
+	if html == "" {
+		html = DefaultIndexHTML
+	}
 	w.Header().Set("Content-Type", "text/html")
-	url := "https://poe.com/create_bot?server=1"
-	w.Write([]byte(
-		`<html><body><h1>Go Poe bot server</h1><p>Congratulations! Your server` +
-			` is running. To connect it to Poe, create a bot at <a` +
-			` href="` + url + `">` + url + `</a>.</p></body></html>`,
-	))
+	w.Write([]byte(html))
 }
 
 func handleSettings(ctx context.Context, w http.ResponseWriter, bot PoeBot, req *types.SettingsRequest) {
 	settings, err := bot.GetSettings(ctx, req)
 	if err != nil {
-		log.Printf("Error getting settings: %v", err)
+		types.Logf(ctx, "Error getting settings: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	data, err := jsonMarshal(settings)
+	if err != nil {
+		types.Logf(ctx, "Error encoding settings: %v", err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(settings)
+	w.Write(append(data, '\n'))
 }
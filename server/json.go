@@ -0,0 +1,9 @@
+package server
+
+import "github.com/n0madic/go-poe/types"
+
+// jsonMarshal and jsonUnmarshal route through the types.JSONMarshal and
+// types.JSONUnmarshal hooks
+func jsonMarshal(v any) ([]byte, error) { return types.JSONMarshal(v) }
+
+func jsonUnmarshal(data []byte, v any) error { return types.JSONUnmarshal(data, v) }
@@ -2,82 +2,513 @@ package server
 
 import (
 	"context"
-	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
+	"runtime/debug"
+	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/n0madic/go-poe/sse"
 	"github.com/n0madic/go-poe/types"
 )
 
-func handleQuery(ctx context.Context, w http.ResponseWriter, bot PoeBot, req *types.QueryRequest) {
+func handleQuery(ctx context.Context, w http.ResponseWriter, bot PoeBot, req *types.QueryRequest, opts AppOptions) {
 	// Insert attachment messages if configured
 	if bot.ShouldInsertAttachmentMessages() {
-		req = InsertAttachmentMessages(req)
+		req = insertBotAttachmentMessages(bot, req)
 	}
 
 	sseWriter := sse.NewWriter(w)
 
-	// Get response channel from bot
-	ch := bot.GetResponse(ctx, req)
+	store, _ := bot.(StateStore)
+	ctx, state, saveState := loadConversationState(ctx, store, req.ConversationID)
 
-	// Consume events and write SSE
-	func() {
-		defer func() {
-			if r := recover(); r != nil {
-				log.Printf("Panic in bot response: %v", r)
-				writeErrorEvent(sseWriter, "The bot encountered an unexpected issue.", false, nil)
+	// Get response channel from bot and write its events as SSE
+	cfg := streamConfig{
+		debugErrors: opts.DebugErrors,
+		onPanic: func(recovered any, stack []byte) {
+			types.Logf(ctx, "Panic in bot response: %v\n%s", recovered, stack)
+			if err := bot.OnError(ctx, panicErrorReport(req, recovered, stack)); err != nil {
+				types.Logf(ctx, "Error handling panic report: %v", err)
 			}
-		}()
-
-		for event := range ch {
-			switch e := event.(type) {
-			case *types.PartialResponse:
-				// If there's an attachment, emit file event first
-				if e.Attachment != nil {
-					writeFileEvent(sseWriter, e.Attachment)
+		},
+	}
+	if o, ok := bot.(TextOverflower); ok && o.TextUploader() != nil {
+		upload := o.TextUploader()
+		cfg.maxInlineTextBytes = o.MaxInlineTextBytes()
+		cfg.uploadOverflow = func(text string) (*types.Attachment, error) {
+			att, err := upload(ctx, bot.AccessKey(), overflowFileName, text)
+			if err != nil {
+				types.Logf(ctx, "Failed to upload overflowing response text, sending it inline: %v", err)
+			}
+			return att, err
+		}
+	}
+	if l, ok := bot.(OutputLimiter); ok {
+		cfg.maxOutputChars = l.MaxOutputChars()
+	}
+	if c, ok := bot.(TextCoalescer); ok {
+		cfg.textBuffer = c.TextBuffer()
+	}
+	if e, ok := bot.(DoneEventEmitter); ok {
+		cfg.manualDone = !e.ShouldEmitDoneEvent()
+	}
+	if p, ok := bot.(PanicReporter); ok {
+		cfg.panicHandler = p.PanicHandler()
+	}
+	ch := getResponse(ctx, bot, req, sseWriter, cfg)
+	doneData := writeEvents(sseWriter, ch, cfg)
+
+	if saveState {
+		if err := store.SaveState(req.ConversationID, state); err != nil {
+			types.Logf(ctx, "Error saving state for conversation %s: %v", req.ConversationID, err)
+		}
+	}
+
+	if !cfg.manualDone {
+		writeDoneEvent(sseWriter, doneData)
+	}
+}
+
+// PanicHandler turns a panic recovered while answering a query into the error
+// event sent to Poe. It receives the recovered value and the stack trace of
+// the panicking goroutine.
+type PanicHandler func(recovered any, stack []byte) (text string, allowRetry bool, errorType *string)
+
+// DefaultPanicHandler reports a generic, non-retryable error of type
+// bot_internal_error. The panic and its stack trace are logged whatever the
+// handler.
+func DefaultPanicHandler(recovered any, stack []byte) (string, bool, *string) {
+	errorType := types.ErrorBotInternalError
+	return "The bot encountered an unexpected issue.", false, &errorType
+}
+
+// debugPanicHandler is DefaultPanicHandler with the recovered value in the
+// error text, used with AppOptions.DebugErrors
+func debugPanicHandler(recovered any, stack []byte) (string, bool, *string) {
+	errorType := types.ErrorBotInternalError
+	return fmt.Sprintf("The bot encountered an unexpected issue: %v", recovered), false, &errorType
+}
+
+// panicErrorReport describes a panic while answering req for PoeBot.OnError
+func panicErrorReport(req *types.QueryRequest, recovered any, stack []byte) *types.ReportErrorRequest {
+	return &types.ReportErrorRequest{
+		BaseRequest: types.BaseRequest{Version: req.Version, Type: types.RequestTypeReportError},
+		Message:     fmt.Sprint(recovered),
+		Metadata: map[string]any{
+			"error_type":      types.ErrorBotInternalError,
+			"stack":           string(stack),
+			"conversation_id": req.ConversationID,
+			"message_id":      req.MessageID,
+		},
+	}
+}
+
+// writePanicEvent logs a recovered panic with its stack trace, or passes them
+// to cfg.onPanic, and reports it as an error event
+func writePanicEvent(w *sse.Writer, cfg streamConfig, recovered any) {
+	stack := debug.Stack()
+	if cfg.onPanic != nil {
+		cfg.onPanic(recovered, stack)
+	} else {
+		log.Printf("Panic in bot response: %v\n%s", recovered, stack)
+	}
+	handler := cfg.panicHandler
+	if handler == nil {
+		handler = DefaultPanicHandler
+		if cfg.debugErrors {
+			handler = debugPanicHandler
+		}
+	}
+	text, allowRetry, errorType := handler(recovered, stack)
+	writeErrorEvent(w, text, allowRetry, errorType)
+}
+
+// getResponse calls bot.GetResponse, reporting a panic as an error event and
+// returning a closed channel in that case
+func getResponse(ctx context.Context, bot PoeBot, req *types.QueryRequest, w *sse.Writer, cfg streamConfig) (ch <-chan types.BotEvent) {
+	defer func() {
+		if r := recover(); r != nil {
+			writePanicEvent(w, cfg, r)
+			closed := make(chan types.BotEvent)
+			close(closed)
+			ch = closed
+		}
+	}()
+	return bot.GetResponse(ctx, req)
+}
+
+// StreamEvents writes BotEvents from events to w as SSE until the channel is
+// closed, then emits the done event. It can bridge any event source to the
+// Poe protocol without implementing PoeBot.
+func StreamEvents(w http.ResponseWriter, events <-chan types.BotEvent) {
+	sseWriter := sse.NewWriter(w)
+	doneData := writeEvents(sseWriter, events, streamConfig{})
+	writeDoneEvent(sseWriter, doneData)
+}
+
+// streamConfig controls how BotEvents are written as SSE
+type streamConfig struct {
+	maxOutputChars     int
+	maxInlineTextBytes int
+	textBuffer         TextBuffer
+	// manualDone writes a DoneResponse as the done event when it is received
+	// instead of returning its payload
+	manualDone   bool
+	panicHandler PanicHandler
+	// debugErrors sends the recovered value when panicHandler is nil
+	debugErrors bool
+	// onPanic logs and reports a recovered panic (default: log.Printf)
+	onPanic func(recovered any, stack []byte)
+	// uploadOverflow uploads the text past maxInlineTextBytes as a file
+	uploadOverflow func(text string) (*types.Attachment, error)
+}
+
+// writeEvents consumes events and writes them as SSE, without the done event.
+// It returns the done payload set by a DoneResponse, if any.
+func writeEvents(sseWriter *sse.Writer, events <-chan types.BotEvent, cfg streamConfig) (doneData map[string]any) {
+	limiter := &outputLimiter{max: cfg.maxOutputChars}
+	overflow := &textOverflow{max: cfg.maxInlineTextBytes}
+	buffer := &textCoalescer{cfg: cfg.textBuffer, w: sseWriter}
+
+	defer func() {
+		if r := recover(); r != nil {
+			buffer.flush()
+			overflow.flush(sseWriter, cfg.uploadOverflow)
+			writePanicEvent(sseWriter, cfg, r)
+		}
+	}()
+
+	for {
+		var event types.BotEvent
+		select {
+		case e, ok := <-events:
+			if !ok {
+				buffer.flush()
+				overflow.flush(sseWriter, cfg.uploadOverflow)
+				return doneData
+			}
+			event = e
+		case <-buffer.timer():
+			buffer.flushReady()
+			continue
+		}
+
+		// Plain text is buffered; anything else flushes it first to keep order
+		if e, ok := event.(*types.PartialResponse); ok && e.Attachment == nil &&
+			!e.IsSuggestedReply && !e.IsThinking && !e.IsReplaceResponse {
+			if text, ok := limiter.take(e.Text); ok {
+				if text = overflow.take(text); text != "" {
+					buffer.add(text, e.Index, e.FullPrompt)
 				}
+			}
+			if limiter.truncated && !limiter.notified {
+				buffer.flush()
+				limiter.notify(sseWriter)
+			}
+			continue
+		}
+		buffer.flush()
+
+		switch e := event.(type) {
+		case *types.PartialResponse:
+			// If there's an attachment, emit file event first
+			if e.Attachment != nil {
+				writeFileEvent(sseWriter, e.Attachment)
+			}
 
-				if e.IsSuggestedReply {
-					writeSuggestedReplyEvent(sseWriter, e.Text)
-				} else if e.IsReplaceResponse {
-					writeReplaceResponseEvent(sseWriter, e.Text)
-				} else {
-					writeTextEvent(sseWriter, e.Text, e.Index)
+			if e.IsSuggestedReply {
+				writeSuggestedReplyEvent(sseWriter, e.Text, e.SuggestedReplyLabel)
+			} else if e.IsThinking {
+				writeThinkingEvent(sseWriter, e.Text, e.Index)
+			} else if e.IsReplaceResponse {
+				limiter.reset()
+				overflow.reset()
+				if text, ok := limiter.take(e.Text); ok {
+					writeReplaceResponseEvent(sseWriter, overflow.take(text))
+				}
+				limiter.notify(sseWriter)
+			} else {
+				if text, ok := limiter.take(e.Text); ok {
+					if text = overflow.take(text); text != "" {
+						writeTextEvent(sseWriter, text, e.Index, e.FullPrompt)
+					}
 				}
+				limiter.notify(sseWriter)
+			}
+
+		case *types.ErrorResponse:
+			writeErrorEvent(sseWriter, e.Text, e.AllowRetry, e.ErrorType)
 
-			case *types.ErrorResponse:
-				writeErrorEvent(sseWriter, e.Text, e.AllowRetry, e.ErrorType)
+		case *types.MetaResponse:
+			writeMetaEvent(sseWriter, e)
 
-			case *types.MetaResponse:
-				writeMetaEvent(sseWriter, e)
+		case *types.DataResponse:
+			writeDataEvent(sseWriter, e.Metadata)
 
-			case *types.DataResponse:
-				writeDataEvent(sseWriter, e.Metadata)
+		case *types.JSONResponse:
+			writeJSONEvent(sseWriter, e.Data)
+
+		case *types.DoneResponse:
+			if e.Index != nil {
+				writeIndexDoneEvent(sseWriter, *e.Index)
+			} else if cfg.manualDone {
+				// The overflow file must come before done, or clients drop it
+				overflow.flush(sseWriter, cfg.uploadOverflow)
+				writeDoneEvent(sseWriter, e.Data)
+			} else {
+				doneData = e.Data
 			}
 		}
-	}()
+	}
+}
+
+// textCoalescer merges adjacent text events according to a TextBuffer.
+// With a zero TextBuffer every chunk is written immediately.
+type textCoalescer struct {
+	cfg        TextBuffer
+	w          *sse.Writer
+	text       strings.Builder
+	index      *int
+	fullPrompt *string
+	pending    bool
+	deadline   *time.Timer
+}
 
-	// Always emit done event
-	writeDoneEvent(sseWriter)
+// add buffers a text chunk, writing out the buffer when it is full
+func (c *textCoalescer) add(text string, index *int, fullPrompt *string) {
+	if c.pending && !sameIndex(c.index, index) {
+		c.flush()
+	}
+	c.text.WriteString(text)
+	c.index = index
+	if fullPrompt != nil {
+		c.fullPrompt = fullPrompt
+	}
+	c.pending = true
+
+	if c.cfg.Interval <= 0 || (c.cfg.MaxBytes > 0 && c.text.Len() >= c.cfg.MaxBytes) {
+		c.flushReady()
+		return
+	}
+	if c.deadline == nil {
+		c.deadline = time.NewTimer(c.cfg.Interval)
+	}
 }
 
-func writeTextEvent(w *sse.Writer, text string, index *int) {
+// flushReady writes the buffered text that is ready to be sent: all of it, or
+// with MarkdownSafe only up to the last safe markdown boundary
+func (c *textCoalescer) flushReady() {
+	if !c.cfg.MarkdownSafe {
+		c.flush()
+		return
+	}
+	text := c.text.String()
+	n := types.SafeMarkdownBoundary(text)
+	if n == len(text) {
+		c.flush()
+		return
+	}
+	if c.deadline != nil {
+		c.deadline.Stop()
+		c.deadline = nil
+	}
+	if n > 0 {
+		writeTextEvent(c.w, text[:n], c.index, c.fullPrompt)
+		c.fullPrompt = nil
+		c.text.Reset()
+		c.text.WriteString(text[n:])
+	}
+	if c.cfg.Interval > 0 {
+		c.deadline = time.NewTimer(c.cfg.Interval)
+	}
+}
+
+// timer fires when buffered text is due; it is nil while nothing is buffered
+func (c *textCoalescer) timer() <-chan time.Time {
+	if c.deadline == nil {
+		return nil
+	}
+	return c.deadline.C
+}
+
+// flush writes buffered text as a single text event
+func (c *textCoalescer) flush() {
+	if c.deadline != nil {
+		c.deadline.Stop()
+		c.deadline = nil
+	}
+	if !c.pending {
+		return
+	}
+	writeTextEvent(c.w, c.text.String(), c.index, c.fullPrompt)
+	c.text.Reset()
+	c.index = nil
+	c.fullPrompt = nil
+	c.pending = false
+}
+
+func sameIndex(a, b *int) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// truncationNotice is appended once the bot's output reaches MaxOutputChars
+const truncationNotice = "\n\n[Output truncated]"
+
+// outputLimiter enforces a cap on the cumulative text emitted in a response
+type outputLimiter struct {
+	max       int
+	emitted   int
+	truncated bool
+	notified  bool
+}
+
+// take returns the part of text that still fits under the cap
+func (l *outputLimiter) take(text string) (string, bool) {
+	if l.max <= 0 {
+		return text, true
+	}
+	if l.truncated {
+		return "", false
+	}
+	n := utf8.RuneCountInString(text)
+	if l.emitted+n <= l.max {
+		l.emitted += n
+		return text, true
+	}
+	remaining := l.max - l.emitted
+	l.emitted = l.max
+	l.truncated = true
+	if remaining == 0 {
+		return "", false
+	}
+	cut := 0
+	for i := range text {
+		if remaining == 0 {
+			cut = i
+			break
+		}
+		remaining--
+	}
+	return text[:cut], true
+}
+
+// reset clears the counter when the response is replaced
+func (l *outputLimiter) reset() {
+	l.emitted = 0
+	l.truncated = false
+	l.notified = false
+}
+
+// notify emits the truncation notice once after the cap is hit
+func (l *outputLimiter) notify(w *sse.Writer) {
+	if l.truncated && !l.notified {
+		l.notified = true
+		writeTextEvent(w, truncationNotice, nil, nil)
+	}
+}
+
+// overflowNotice follows the file holding the text past MaxInlineTextBytes
+const overflowNotice = "\n\n[The rest of the response is in the attached file]"
+
+// overflowFileName names the uploaded file holding the overflowing text
+const overflowFileName = "response.txt"
+
+// TextUploader uploads text as a plain text file named fileName with the
+// bot's access key and returns the uploaded attachment, typically by calling
+// client.UploadFile
+type TextUploader func(ctx context.Context, accessKey, fileName, text string) (*types.Attachment, error)
+
+// textOverflow sends the response text inline up to a cap in bytes and keeps
+// the rest to be uploaded as a file
+type textOverflow struct {
+	max     int
+	emitted int
+	rest    strings.Builder
+}
+
+// take returns the part of text that is sent inline and keeps the rest
+func (o *textOverflow) take(text string) string {
+	if o.max <= 0 {
+		return text
+	}
+	if o.emitted+len(text) <= o.max {
+		o.emitted += len(text)
+		return text
+	}
+	cut := max(o.max-o.emitted, 0)
+	for cut > 0 && !utf8.RuneStart(text[cut]) {
+		cut--
+	}
+	o.emitted = o.max
+	o.rest.WriteString(text[cut:])
+	return text[:cut]
+}
+
+// reset drops the kept text when the response is replaced
+func (o *textOverflow) reset() {
+	o.emitted = 0
+	o.rest.Reset()
+}
+
+// flush uploads the kept text and sends it as a file event with a notice. If
+// the upload fails, the text is sent inline instead.
+func (o *textOverflow) flush(w *sse.Writer, upload func(string) (*types.Attachment, error)) {
+	if o.rest.Len() == 0 {
+		return
+	}
+	text := o.rest.String()
+	o.rest.Reset()
+	if upload == nil {
+		writeTextEvent(w, text, nil, nil)
+		return
+	}
+	att, err := upload(text)
+	if err != nil {
+		writeTextEvent(w, text, nil, nil)
+		return
+	}
+	writeFileEvent(w, att)
+	writeTextEvent(w, overflowNotice, nil, nil)
+}
+
+func writeTextEvent(w *sse.Writer, text string, index *int, fullPrompt *string) {
 	data := map[string]any{"text": text}
 	if index != nil {
 		data["index"] = *index
 	}
-	b, _ := json.Marshal(data)
+	if fullPrompt != nil {
+		data["full_prompt"] = *fullPrompt
+	}
+	b, _ := jsonMarshal(data)
 	w.WriteEvent(sse.Event{Event: "text", Data: string(b)})
 }
 
+func writeThinkingEvent(w *sse.Writer, text string, index *int) {
+	data := map[string]any{"text": text}
+	if index != nil {
+		data["index"] = *index
+	}
+	b, _ := jsonMarshal(data)
+	w.WriteEvent(sse.Event{Event: "thinking", Data: string(b)})
+}
+
 func writeReplaceResponseEvent(w *sse.Writer, text string) {
-	b, _ := json.Marshal(map[string]any{"text": text})
+	b, _ := jsonMarshal(map[string]any{"text": text})
 	w.WriteEvent(sse.Event{Event: "replace_response", Data: string(b)})
 }
 
-func writeSuggestedReplyEvent(w *sse.Writer, text string) {
-	b, _ := json.Marshal(map[string]any{"text": text})
+func writeSuggestedReplyEvent(w *sse.Writer, text, label string) {
+	data := map[string]any{"text": text}
+	if label != "" {
+		data["label"] = label
+	}
+	b, _ := jsonMarshal(data)
 	w.WriteEvent(sse.Event{Event: "suggested_reply", Data: string(b)})
 }
 
@@ -90,25 +521,43 @@ func writeFileEvent(w *sse.Writer, att *types.Attachment) {
 	if att.InlineRef != nil {
 		data["inline_ref"] = *att.InlineRef
 	}
-	b, _ := json.Marshal(data)
+	b, _ := jsonMarshal(data)
 	w.WriteEvent(sse.Event{Event: "file", Data: string(b)})
 }
 
 func writeMetaEvent(w *sse.Writer, meta *types.MetaResponse) {
-	b, _ := json.Marshal(map[string]any{
-		"content_type":      meta.ContentType,
-		"refetch_settings":  meta.RefetchSettings,
-		"linkify":           meta.Linkify,
-		"suggested_replies": meta.SuggestedReplies,
-	})
+	data := make(map[string]any, len(meta.Extra)+4)
+	for k, v := range meta.Extra {
+		data[k] = v
+	}
+	data["content_type"] = meta.ContentType
+	data["refetch_settings"] = meta.RefetchSettings
+	data["linkify"] = meta.Linkify
+	data["suggested_replies"] = meta.SuggestedReplies
+	b, _ := jsonMarshal(data)
 	w.WriteEvent(sse.Event{Event: "meta", Data: string(b)})
 }
 
 func writeDataEvent(w *sse.Writer, metadata string) {
-	b, _ := json.Marshal(map[string]any{"metadata": metadata})
+	b, _ := jsonMarshal(map[string]any{"metadata": metadata})
 	w.WriteEvent(sse.Event{Event: "data", Data: string(b)})
 }
 
+func writeJSONEvent(w *sse.Writer, data map[string]any) {
+	payload := "{}"
+	if len(data) > 0 {
+		if b, err := jsonMarshal(data); err == nil {
+			payload = string(b)
+		}
+	}
+	w.WriteEvent(sse.Event{Event: "json", Data: payload})
+}
+
+func writeIndexDoneEvent(w *sse.Writer, index int) {
+	b, _ := jsonMarshal(map[string]any{"event": types.IndexDoneEvent, "index": index})
+	w.WriteEvent(sse.Event{Event: "json", Data: string(b)})
+}
+
 func writeErrorEvent(w *sse.Writer, text string, allowRetry bool, errorType *string) {
 	data := map[string]any{"allow_retry": allowRetry}
 	if text != "" {
@@ -117,10 +566,16 @@ func writeErrorEvent(w *sse.Writer, text string, allowRetry bool, errorType *str
 	if errorType != nil {
 		data["error_type"] = *errorType
 	}
-	b, _ := json.Marshal(data)
+	b, _ := jsonMarshal(data)
 	w.WriteEvent(sse.Event{Event: "error", Data: string(b)})
 }
 
-func writeDoneEvent(w *sse.Writer) {
-	w.WriteEvent(sse.Event{Event: "done", Data: "{}"})
+func writeDoneEvent(w *sse.Writer, data map[string]any) {
+	payload := "{}"
+	if len(data) > 0 {
+		if b, err := jsonMarshal(data); err == nil {
+			payload = string(b)
+		}
+	}
+	w.WriteEvent(sse.Event{Event: "done", Data: payload})
 }
@@ -2,14 +2,30 @@ package server
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
 	"io"
+	"log"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/n0madic/go-poe/client"
 	"github.com/n0madic/go-poe/sse"
 	"github.com/n0madic/go-poe/types"
 )
@@ -38,7 +54,7 @@ func (b *testBot) GetResponse(ctx context.Context, req *types.QueryRequest) <-ch
 
 func TestHandlerReturnsHTMLOnGET(t *testing.T) {
 	bot := newTestBot("/", "", "", "test")
-	handler := botHandler(bot)
+	handler := botHandler(bot, nil)
 
 	req := httptest.NewRequest(http.MethodGet, "/", nil)
 	w := httptest.NewRecorder()
@@ -58,9 +74,35 @@ func TestHandlerReturnsHTMLOnGET(t *testing.T) {
 	}
 }
 
+func TestHandlerCustomIndexHTML(t *testing.T) {
+	bot := newTestBot("/", "secret", "", "test")
+	const page = "<html><body><h1>Acme Bot</h1></body></html>"
+	bot.SetIndexHTML(page)
+
+	w := httptest.NewRecorder()
+	botHandler(bot, nil).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status 200, got %d", w.Code)
+	}
+	if w.Body.String() != page {
+		t.Errorf("Expected the custom page, got: %s", w.Body.String())
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "text/html" {
+		t.Errorf("Expected text/html, got %q", ct)
+	}
+
+	bot.SetIndexHTML("")
+	w = httptest.NewRecorder()
+	botHandler(bot, nil).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Body.String() != DefaultIndexHTML {
+		t.Errorf("Expected the default page after reset, got: %s", w.Body.String())
+	}
+}
+
 func TestHandlerReturns401OnBadAuth(t *testing.T) {
 	bot := newTestBot("/", "secret123", "", "test")
-	handler := botHandler(bot)
+	handler := botHandler(bot, nil)
 
 	reqBody := `{"version":"1.2","type":"query","query":[{"role":"user","content":"hi"}],"user_id":"u1","conversation_id":"c1","message_id":"m1"}`
 	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(reqBody))
@@ -80,9 +122,116 @@ func TestHandlerReturns401OnBadAuth(t *testing.T) {
 	}
 }
 
+func TestAuthenticate(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		keys   []string
+		want   bool
+	}{
+		{"no keys", "", nil, true},
+		{"only empty keys", "", []string{"", ""}, true},
+		{"exact match", "Bearer secret123", []string{"secret123"}, true},
+		{"missing header", "", []string{"secret123"}, false},
+		{"no bearer prefix", "secret123", []string{"secret123"}, false},
+		{"wrong key", "Bearer secret124", []string{"secret123"}, false},
+		{"prefix of key", "Bearer secret", []string{"secret123"}, false},
+		{"key is prefix", "Bearer secret1234", []string{"secret123"}, false},
+		{"empty token", "Bearer ", []string{"secret123"}, false},
+		{"second key", "Bearer old", []string{"new", "old"}, true},
+		{"no key matches", "Bearer other", []string{"new", "old"}, false},
+		{"empty primary with accepted key", "Bearer old", []string{"", "old"}, true},
+		{"empty token against empty primary", "Bearer ", []string{"", "old"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/", nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			if got := authenticate(req, tt.keys...); got != tt.want {
+				t.Errorf("authenticate(%q, %q) = %v, want %v", tt.header, tt.keys, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandlerAcceptedKeys(t *testing.T) {
+	bot := newTestBot("/", "newkey", "", "test")
+	bot.AddAcceptedKey("oldkey")
+	bot.AddAcceptedKey("")
+	if keys := bot.AcceptedKeys(); len(keys) != 1 || keys[0] != "oldkey" {
+		t.Errorf("Expected [oldkey], got %q", keys)
+	}
+	handler := botHandler(bot, nil)
+
+	for key, want := range map[string]int{
+		"newkey":   http.StatusOK,
+		"oldkey":   http.StatusOK,
+		"wrongkey": http.StatusUnauthorized,
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"version":"1.2","type":"settings"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+key)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != want {
+			t.Errorf("Expected status %d for %s, got %d", want, key, w.Code)
+		}
+	}
+}
+
+// endlessReader yields filler bytes forever and counts how many were read
+type endlessReader struct {
+	read int64
+}
+
+func (r *endlessReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = ' '
+	}
+	r.read += int64(len(p))
+	return len(p), nil
+}
+
+func TestHandlerRejectsLargeBody(t *testing.T) {
+	handler := botHandler(newTestBot("/", "", "", "test"), &AppOptions{MaxRequestBodyBytes: 1024})
+	body := &endlessReader{}
+	req := httptest.NewRequest(http.MethodPost, "/", body)
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+
+	handler.ServeHTTP(w, req)
+
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected status 413, got %d", w.Code)
+	}
+	if body.read > 64*1024 {
+		t.Errorf("Expected reading to stop near the limit, read %d bytes", body.read)
+	}
+
+	// Requests within the limit are served
+	req = httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"version":"1.2","type":"settings"}`))
+	req.Header.Set("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status 200 within the limit, got %d", w.Code)
+	}
+
+	// A negative limit disables the cap
+	handler = botHandler(newTestBot("/", "", "", "test"), &AppOptions{MaxRequestBodyBytes: -1})
+	req = httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"version":"1.2","type":"settings"}`+strings.Repeat(" ", 2048)))
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status 200 without a limit, got %d", w.Code)
+	}
+}
+
 func TestHandlerReturns200OnValidSettingsRequest(t *testing.T) {
 	bot := newTestBot("/", "secret123", "testbot", "test")
-	handler := botHandler(bot)
+	handler := botHandler(bot, nil)
 
 	reqBody := `{"version":"1.2","type":"settings"}`
 	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(reqBody))
@@ -108,7 +257,7 @@ func TestHandlerReturns200OnValidSettingsRequest(t *testing.T) {
 
 func TestHandlerStreamsSSEForQueryRequest(t *testing.T) {
 	bot := newTestBot("/", "secret123", "testbot", "Hello world")
-	handler := botHandler(bot)
+	handler := botHandler(bot, nil)
 
 	reqBody := `{"version":"1.2","type":"query","query":[{"role":"user","content":"hi"}],"user_id":"u1","conversation_id":"c1","message_id":"m1"}`
 	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(reqBody))
@@ -174,6 +323,53 @@ func TestInsertAttachmentMessagesWithTextAttachment(t *testing.T) {
 	}
 }
 
+func TestInsertAttachmentMessagesWithCustomTemplates(t *testing.T) {
+	parsedContent := "Bonjour"
+	imageContent := "photo.jpg***A cat on a sofa"
+	req := &types.QueryRequest{
+		Query: []types.ProtocolMessage{
+			{
+				Role:    "user",
+				Content: "Traduis",
+				Attachments: []types.Attachment{
+					{Name: "file.txt", ContentType: "text/plain", ParsedContent: &parsedContent},
+					{Name: "photo.jpg", ContentType: "image/jpeg", ParsedContent: &imageContent},
+				},
+			},
+		},
+	}
+
+	bot := NewBasePoeBot("/", "", "")
+	bot.SetAttachmentTemplates(AttachmentTemplates{TextTemplate: "Fichier %s :\n%s"})
+
+	events := RunQueryForTest(&templateEchoBot{BasePoeBot: bot}, req)
+	if len(events) != 3 {
+		t.Fatalf("Expected 3 messages, got %d", len(events))
+	}
+	if got := events[0].(*types.PartialResponse).Text; got != "Fichier file.txt :\nBonjour" {
+		t.Errorf("Expected custom text template, got %q", got)
+	}
+	// Templates left empty keep the defaults
+	want := fmt.Sprintf(types.ImageVisionAttachmentTemplate, "photo.jpg", "A cat on a sofa")
+	if got := events[1].(*types.PartialResponse).Text; got != want {
+		t.Errorf("Expected default image template, got %q", got)
+	}
+}
+
+// templateEchoBot emits the content of every query message
+type templateEchoBot struct {
+	*BasePoeBot
+}
+
+func (b *templateEchoBot) GetResponse(ctx context.Context, req *types.QueryRequest) <-chan types.BotEvent {
+	ch := make(chan types.BotEvent, len(req.Query))
+	for _, msg := range req.Query {
+		ch <- &types.PartialResponse{Text: msg.Content}
+	}
+	close(ch)
+	return ch
+}
+
 func TestInsertAttachmentMessagesWithHTMLAttachment(t *testing.T) {
 	parsedContent := "<html><body>Web content</body></html>"
 	req := &types.QueryRequest{
@@ -309,6 +505,62 @@ func TestMakePromptAuthorRoleAlternatedMergesConsecutiveSameRole(t *testing.T) {
 	}
 }
 
+func TestMakePromptAuthorRoleAlternatedKeepsToolMessagesSeparate(t *testing.T) {
+	messages := []types.ProtocolMessage{
+		{Role: "user", Content: "Draw a cat"},
+		{Role: "tool", Content: "result 1", Attachments: []types.Attachment{{URL: "https://example.com/cat.png"}}},
+		{Role: "tool", Content: "result 2"},
+		{Role: "bot", Content: "Here it is"},
+	}
+
+	result := MakePromptAuthorRoleAlternated(messages)
+
+	if len(result) != 4 {
+		t.Fatalf("Expected 4 messages, got %d", len(result))
+	}
+	if result[1].Content != "result 1" || len(result[1].Attachments) != 1 || result[2].Content != "result 2" {
+		t.Errorf("Expected tool messages to stay separate, got %+v", result[1:3])
+	}
+}
+
+func TestInsertAttachmentMessagesWithToolAttachment(t *testing.T) {
+	description := "cat.png***A cat wearing a hat"
+	req := &types.QueryRequest{
+		Query: []types.ProtocolMessage{
+			{Role: "user", Content: "Draw a cat"},
+			{
+				Role:    "tool",
+				Content: "Generated image",
+				Attachments: []types.Attachment{
+					{Name: "cat.png", ContentType: "image/png", ParsedContent: &description},
+				},
+			},
+			{Role: "user", Content: "Describe it"},
+		},
+	}
+
+	result := InsertAttachmentMessages(req)
+
+	if len(result.Query) != 3 {
+		t.Fatalf("Expected no inserted messages, got %d messages", len(result.Query))
+	}
+	tool := result.Query[1]
+	if tool.Role != "tool" || !strings.HasPrefix(tool.Content, "Generated image\n\n") ||
+		!strings.Contains(tool.Content, "A cat wearing a hat") {
+		t.Errorf("Expected attachment content in the tool message, got %q", tool.Content)
+	}
+	if req.Query[1].Content != "Generated image" {
+		t.Error("Expected original request to be left unchanged")
+	}
+
+	// A trailing tool message is not preceded by inserted user messages
+	req.Query = req.Query[:2]
+	result = InsertAttachmentMessages(req)
+	if len(result.Query) != 2 || result.Query[1].Role != "tool" {
+		t.Errorf("Expected tool message to be handled in place, got %+v", result.Query)
+	}
+}
+
 func TestMakePromptAuthorRoleAlternatedDeduplicatesAttachmentsByURL(t *testing.T) {
 	messages := []types.ProtocolMessage{
 		{
@@ -360,7 +612,7 @@ func TestMakePromptAuthorRoleAlternatedDeduplicatesAttachmentsByURL(t *testing.T
 
 func TestHandlerReportFeedback(t *testing.T) {
 	bot := newTestBot("/", "secret123", "testbot", "test")
-	handler := botHandler(bot)
+	handler := botHandler(bot, nil)
 
 	reqBody := `{"version":"1.2","type":"report_feedback","message_id":"m1","user_id":"u1","conversation_id":"c1","feedback_type":"like"}`
 	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(reqBody))
@@ -382,7 +634,7 @@ func TestHandlerReportFeedback(t *testing.T) {
 
 func TestHandlerMethodNotAllowed(t *testing.T) {
 	bot := newTestBot("/", "", "", "test")
-	handler := botHandler(bot)
+	handler := botHandler(bot, nil)
 
 	req := httptest.NewRequest(http.MethodPut, "/", nil)
 	w := httptest.NewRecorder()
@@ -417,6 +669,107 @@ func TestFindAccessKey(t *testing.T) {
 	}
 }
 
+func TestFindAccessKeyFile(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "poe_access_key")
+	if err := os.WriteFile(keyFile, []byte("  filekey\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("POE_ACCESS_KEY", "")
+	t.Setenv("POE_ACCESS_KEY_FILE", keyFile)
+
+	if key := FindAccessKey(""); key != "filekey" {
+		t.Errorf("Expected 'filekey' from secrets file, got '%s'", key)
+	}
+
+	// POE_ACCESS_KEY takes precedence over the file
+	t.Setenv("POE_ACCESS_KEY", "envkey")
+	if key := FindAccessKey(""); key != "envkey" {
+		t.Errorf("Expected 'envkey' (env should override file), got '%s'", key)
+	}
+
+	// A missing file yields no key
+	t.Setenv("POE_ACCESS_KEY", "")
+	t.Setenv("POE_ACCESS_KEY_FILE", filepath.Join(t.TempDir(), "missing"))
+	if key := FindAccessKey(""); key != "" {
+		t.Errorf("Expected no key for a missing file, got '%s'", key)
+	}
+}
+
+func TestMakeAppHealthCheck(t *testing.T) {
+	app := MakeApp(newTestBot("/bot", "secret", "", "hi"))
+
+	// No Authorization header: the endpoint bypasses access-key auth
+	req := httptest.NewRequest(http.MethodGet, "/healthz", nil)
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Expected application/json, got %q", ct)
+	}
+	var status map[string]string
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil || status["status"] != "ok" {
+		t.Errorf("Expected {\"status\":\"ok\"}, got %s", w.Body.String())
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/healthz", nil)
+	w = httptest.NewRecorder()
+	app.ServeHTTP(w, req)
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected status 405 for POST, got %d", w.Code)
+	}
+}
+
+func TestMakeAppHealthCheckPath(t *testing.T) {
+	// A bot at the same path keeps it
+	reqBody := `{"version":"1.2","type":"query","query":[{"role":"user","content":"hi"}],"user_id":"u1","conversation_id":"c1","message_id":"m1"}`
+	app := MakeApp(newTestBot("/healthz", "", "", "from bot"))
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/healthz", strings.NewReader(reqBody)))
+	if !strings.Contains(w.Body.String(), "from bot") {
+		t.Errorf("Expected the bot to serve /healthz, got: %s", w.Body.String())
+	}
+
+	// A bot at the root keeps the default path
+	app = MakeApp(newTestBot("/", "", "", "from root"))
+	w = httptest.NewRecorder()
+	app.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/healthz", strings.NewReader(reqBody)))
+	if !strings.Contains(w.Body.String(), "from root") {
+		t.Errorf("Expected the root bot to serve /healthz, got: %s", w.Body.String())
+	}
+
+	// Unless the path is set explicitly
+	app = MakeAppWithOptions(&AppOptions{HealthCheckPath: "/healthz"}, newTestBot("/", "", "", "from root"))
+	w = httptest.NewRecorder()
+	app.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"ok"`) {
+		t.Errorf("Expected the explicit health check at /healthz, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// Renamed
+	app = MakeAppWithOptions(&AppOptions{HealthCheckPath: "/livez"}, newTestBot("/bot", "", "", "hi"))
+	w = httptest.NewRecorder()
+	app.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/livez", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"ok"`) {
+		t.Errorf("Expected the health check at /livez, got %d: %s", w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	app.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for the old path, got %d", w.Code)
+	}
+
+	// Disabled
+	app = MakeAppWithOptions(&AppOptions{DisableHealthCheck: true}, newTestBot("/bot", "", "", "hi"))
+	w = httptest.NewRecorder()
+	app.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 with the health check disabled, got %d", w.Code)
+	}
+}
+
 func TestMakeAppMultipleBots(t *testing.T) {
 	bot1 := newTestBot("/bot1", "", "", "response1")
 	bot2 := newTestBot("/bot2", "", "", "response2")
@@ -531,11 +884,11 @@ func TestWriteEventFunctions(t *testing.T) {
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		sseWriter := sse.NewWriter(w)
 
-		writeTextEvent(sseWriter, "test text", nil)
+		writeTextEvent(sseWriter, "test text", nil, nil)
 		index := 1
-		writeTextEvent(sseWriter, "indexed text", &index)
+		writeTextEvent(sseWriter, "indexed text", &index, nil)
 		writeReplaceResponseEvent(sseWriter, "replace")
-		writeSuggestedReplyEvent(sseWriter, "suggestion")
+		writeSuggestedReplyEvent(sseWriter, "suggestion", "")
 		writeFileEvent(sseWriter, &types.Attachment{
 			URL:         "http://example.com/file.txt",
 			ContentType: "text/plain",
@@ -545,7 +898,7 @@ func TestWriteEventFunctions(t *testing.T) {
 		writeDataEvent(sseWriter, "metadata")
 		errorType := "test_error"
 		writeErrorEvent(sseWriter, "error text", true, &errorType)
-		writeDoneEvent(sseWriter)
+		writeDoneEvent(sseWriter, nil)
 	}))
 	defer server.Close()
 
@@ -577,3 +930,1560 @@ func TestWriteEventFunctions(t *testing.T) {
 		}
 	}
 }
+
+// eventsBot emits a fixed sequence of BotEvents
+type eventsBot struct {
+	*BasePoeBot
+	events []types.BotEvent
+}
+
+func newEventsBot(events ...types.BotEvent) *eventsBot {
+	return &eventsBot{
+		BasePoeBot: NewBasePoeBot("/", "", ""),
+		events:     events,
+	}
+}
+
+func (b *eventsBot) GetResponse(ctx context.Context, req *types.QueryRequest) <-chan types.BotEvent {
+	ch := make(chan types.BotEvent)
+	go func() {
+		defer close(ch)
+		for _, e := range b.events {
+			ch <- e
+		}
+	}()
+	return ch
+}
+
+// serveQuery sends a query request to the handler and returns the SSE body
+func serveQuery(t *testing.T, handler http.Handler) string {
+	t.Helper()
+	reqBody := `{"version":"1.2","type":"query","query":[{"role":"user","content":"hi"}],"user_id":"u1","conversation_id":"c1","message_id":"m1"}`
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(reqBody))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+	return w.Body.String()
+}
+
+// readSSEEvents parses an SSE body into events
+func readSSEEvents(t *testing.T, body string) []sse.Event {
+	t.Helper()
+	reader := sse.NewReader(strings.NewReader(body))
+	var events []sse.Event
+	for {
+		event, err := reader.ReadEvent()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Failed to read SSE event: %v", err)
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+func TestHandlerMaxOutputChars(t *testing.T) {
+	bot := newEventsBot(
+		&types.PartialResponse{Text: "Hello "},
+		&types.PartialResponse{Text: "wonderful "},
+		&types.PartialResponse{Text: "world"},
+		&types.PartialResponse{Text: "Suggestion", IsSuggestedReply: true},
+	)
+	bot.SetMaxOutputChars(10)
+
+	events := readSSEEvents(t, serveQuery(t, botHandler(bot, nil)))
+
+	var text strings.Builder
+	var suggested, done bool
+	for _, e := range events {
+		switch e.Event {
+		case "text":
+			var data map[string]any
+			if err := json.Unmarshal([]byte(e.Data), &data); err != nil {
+				t.Fatalf("Invalid text event data: %v", err)
+			}
+			text.WriteString(data["text"].(string))
+		case "suggested_reply":
+			suggested = true
+		case "done":
+			done = true
+		}
+	}
+
+	expected := "Hello wond" + truncationNotice
+	if text.String() != expected {
+		t.Errorf("Expected text %q, got %q", expected, text.String())
+	}
+	if !suggested {
+		t.Error("Expected suggested reply to pass through the limit")
+	}
+	if !done {
+		t.Error("Expected done event after truncation")
+	}
+}
+
+func TestHandlerMaxInlineTextBytes(t *testing.T) {
+	var uploaded, apiKey string
+	uploadServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		apiKey = r.Header.Get("Authorization")
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			t.Errorf("Expected a file upload: %v", err)
+			return
+		}
+		data, _ := io.ReadAll(file)
+		uploaded = string(data)
+		fmt.Fprint(w, `{"attachment_url": "https://example.com/response.txt", "mime_type": "text/plain"}`)
+	}))
+	defer uploadServer.Close()
+
+	bot := newEventsBot(
+		&types.PartialResponse{Text: "Hello "},
+		&types.PartialResponse{Text: "wonderful "},
+		&types.PartialResponse{Text: "world"},
+	)
+	bot.SetAccessKey("botkey")
+	bot.SetMaxInlineTextBytes(10)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Set("Authorization", "Bearer botkey")
+		botHandler(bot, nil).ServeHTTP(w, r)
+	})
+
+	// Without an uploader the cap is not applied
+	var text strings.Builder
+	for _, e := range readSSEEvents(t, serveQuery(t, handler)) {
+		if e.Event == "file" {
+			t.Error("Expected no file event without an uploader")
+		}
+		if e.Event == "text" {
+			var data map[string]any
+			json.Unmarshal([]byte(e.Data), &data)
+			text.WriteString(data["text"].(string))
+		}
+	}
+	if text.String() != "Hello wonderful world" {
+		t.Errorf("Expected the full text inline without an uploader, got %q", text.String())
+	}
+
+	bot.SetTextUploader(func(ctx context.Context, accessKey, fileName, text string) (*types.Attachment, error) {
+		return client.UploadFile(ctx, &client.UploadFileOptions{
+			APIKey:   accessKey,
+			BaseURL:  uploadServer.URL,
+			File:     strings.NewReader(text),
+			FileName: fileName,
+		})
+	})
+	events := readSSEEvents(t, serveQuery(t, handler))
+
+	text.Reset()
+	var file map[string]any
+	for _, e := range events {
+		var data map[string]any
+		if e.Event == "text" || e.Event == "file" {
+			if err := json.Unmarshal([]byte(e.Data), &data); err != nil {
+				t.Fatalf("Invalid %s event data: %v", e.Event, err)
+			}
+		}
+		switch e.Event {
+		case "text":
+			text.WriteString(data["text"].(string))
+		case "file":
+			file = data
+		}
+	}
+
+	if expected := "Hello wond" + overflowNotice; text.String() != expected {
+		t.Errorf("Expected text %q, got %q", expected, text.String())
+	}
+	if uploaded != "erful world" {
+		t.Errorf("Expected the overflow to be uploaded, got %q", uploaded)
+	}
+	if apiKey != "botkey" {
+		t.Errorf("Expected upload with the bot's access key, got %q", apiKey)
+	}
+	if file == nil || file["url"] != "https://example.com/response.txt" {
+		t.Errorf("Expected a file event for the uploaded text, got %v", file)
+	}
+
+	// If the upload fails, the rest is sent inline
+	bot.SetTextUploader(func(ctx context.Context, accessKey, fileName, text string) (*types.Attachment, error) {
+		return nil, errors.New("upload failed")
+	})
+	events = readSSEEvents(t, serveQuery(t, handler))
+	text.Reset()
+	for _, e := range events {
+		if e.Event == "file" {
+			t.Error("Expected no file event when the upload fails")
+		}
+		if e.Event == "text" {
+			var data map[string]any
+			json.Unmarshal([]byte(e.Data), &data)
+			text.WriteString(data["text"].(string))
+		}
+	}
+	if text.String() != "Hello wonderful world" {
+		t.Errorf("Expected the full text inline, got %q", text.String())
+	}
+}
+
+func TestOverflowFlushedBeforeDoneAndPanic(t *testing.T) {
+	upload := func(text string) (*types.Attachment, error) {
+		return &types.Attachment{URL: "https://example.com/response.txt", ContentType: "text/plain"}, nil
+	}
+	stream := func(manualDone bool, events ...types.BotEvent) string {
+		ch := make(chan types.BotEvent, len(events))
+		for _, e := range events {
+			ch <- e
+		}
+		close(ch)
+		w := httptest.NewRecorder()
+		writeEvents(sse.NewWriter(w), ch, streamConfig{
+			maxInlineTextBytes: 5,
+			manualDone:         manualDone,
+			onPanic:            func(recovered any, stack []byte) {},
+			uploadOverflow:     upload,
+		})
+		var names []string
+		for _, e := range readSSEEvents(t, w.Body.String()) {
+			names = append(names, e.Event)
+		}
+		return strings.Join(names, " ")
+	}
+
+	// A bot sending its own done event
+	got := stream(true, &types.PartialResponse{Text: "Hello world"}, &types.DoneResponse{})
+	if got != "text file text done" {
+		t.Errorf("Expected the overflow file before done, got events %v", got)
+	}
+
+	// A panic while writing events
+	got = stream(false, &types.PartialResponse{Text: "Hello world"}, (*types.PartialResponse)(nil))
+	if got != "text file text error" {
+		t.Errorf("Expected the overflow file before the panic error, got events %v", got)
+	}
+}
+
+// statefulBot counts turns per conversation using an in-memory store
+type statefulBot struct {
+	*BasePoeBot
+	mu    sync.Mutex
+	store map[string]map[string]any
+}
+
+func (b *statefulBot) LoadState(conversationID string) (map[string]any, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	state := make(map[string]any)
+	for k, v := range b.store[conversationID] {
+		state[k] = v
+	}
+	return state, nil
+}
+
+func (b *statefulBot) SaveState(conversationID string, state map[string]any) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.store[conversationID] = state
+	return nil
+}
+
+func (b *statefulBot) GetResponse(ctx context.Context, req *types.QueryRequest) <-chan types.BotEvent {
+	ch := make(chan types.BotEvent, 1)
+	go func() {
+		defer close(ch)
+		state := ConversationState(ctx)
+		turns, _ := state["turns"].(int)
+		turns++
+		state["turns"] = turns
+		ch <- &types.PartialResponse{Text: fmt.Sprintf("turn %d", turns)}
+	}()
+	return ch
+}
+
+func TestHandlerConversationState(t *testing.T) {
+	bot := &statefulBot{
+		BasePoeBot: NewBasePoeBot("/", "", ""),
+		store:      make(map[string]map[string]any),
+	}
+	handler := botHandler(bot, nil)
+
+	serveQuery(t, handler)
+	body := serveQuery(t, handler)
+
+	if !strings.Contains(body, "turn 2") {
+		t.Errorf("Expected state to persist across queries, got: %s", body)
+	}
+	if turns := bot.store["c1"]["turns"]; turns != 2 {
+		t.Errorf("Expected saved turns=2 for conversation c1, got %v", turns)
+	}
+
+	// A bot that is not a StateStore gets fresh state on every query
+	plain := struct{ PoeBot }{bot}
+	if _, ok := PoeBot(plain).(StateStore); ok {
+		t.Fatal("Expected the wrapped bot not to be a StateStore")
+	}
+	body = serveQuery(t, botHandler(plain, nil))
+	if !strings.Contains(body, "turn 1") {
+		t.Errorf("Expected unsaved state without a StateStore, got: %s", body)
+	}
+	if turns := bot.store["c1"]["turns"]; turns != 2 {
+		t.Errorf("Expected the store to be untouched, got turns=%v", turns)
+	}
+}
+
+func TestConversationStateOutsideQuery(t *testing.T) {
+	if state := ConversationState(context.Background()); state != nil {
+		t.Errorf("Expected nil state outside a query, got %v", state)
+	}
+}
+
+func TestFullPromptRoundTrip(t *testing.T) {
+	prompt := "System: be helpful\nUser: hi"
+	bot := newEventsBot(&types.PartialResponse{Text: "Hello", FullPrompt: &prompt})
+	bot.path = "/bot"
+
+	ts := httptest.NewServer(MakeApp(bot))
+	defer ts.Close()
+
+	req := &types.QueryRequest{
+		BaseRequest: types.BaseRequest{Version: types.ProtocolVersion, Type: types.RequestTypeQuery},
+		Query:       []types.ProtocolMessage{{Role: "user", Content: "hi"}},
+	}
+	opts := &client.StreamRequestOptions{BaseURL: ts.URL + "/"}
+
+	var responses []*types.PartialResponse
+	for msg := range client.StreamRequest(context.Background(), req, "bot", opts) {
+		responses = append(responses, msg)
+	}
+
+	if len(responses) != 1 {
+		t.Fatalf("Expected 1 response, got %d", len(responses))
+	}
+	if responses[0].Text != "Hello" {
+		t.Errorf("Expected text 'Hello', got %q", responses[0].Text)
+	}
+	if responses[0].FullPrompt == nil || *responses[0].FullPrompt != prompt {
+		t.Errorf("Expected full prompt %q, got %v", prompt, responses[0].FullPrompt)
+	}
+}
+
+func TestPortFromEnv(t *testing.T) {
+	tests := []struct {
+		name     string
+		poePort  string
+		port     string
+		expected int
+		ok       bool
+	}{
+		{"none set", "", "", 0, false},
+		{"PORT only", "", "9000", 9000, true},
+		{"POE_BOT_PORT takes precedence", "9100", "9000", 9100, true},
+		{"invalid POE_BOT_PORT falls back", "abc", "9000", 9000, true},
+		{"out of range", "", "70000", 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("POE_BOT_PORT", tt.poePort)
+			t.Setenv("PORT", tt.port)
+			port, ok := portFromEnv()
+			if port != tt.expected || ok != tt.ok {
+				t.Errorf("Expected (%d, %v), got (%d, %v)", tt.expected, tt.ok, port, ok)
+			}
+		})
+	}
+}
+
+func TestRunContextStopsOnCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- RunContext(ctx, "127.0.0.1:0", newTestBot("/", "", "", "hi"))
+	}()
+
+	cancel()
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Errorf("Expected clean shutdown, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("RunContext did not return after cancel")
+	}
+}
+
+// writeSelfSignedCert writes a certificate for 127.0.0.1 and its key to dir
+func writeSelfSignedCert(t *testing.T, dir string) (certFile, keyFile string, cert *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "test"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err = x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile, cert
+}
+
+func TestServeTLS(t *testing.T) {
+	certFile, keyFile, cert := writeSelfSignedCert(t, t.TempDir())
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	cfg := ServerConfig{TLSCertFile: certFile, TLSKeyFile: keyFile, ReadHeaderTimeout: 5 * time.Second}
+	go func() {
+		errCh <- serve(ctx, ln, cfg, MakeApp(newTestBot("/", "", "", "hi")))
+	}()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	httpClient := &http.Client{
+		Timeout:   5 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+	}
+	resp, err := httpClient.Post("https://"+ln.Addr().String()+"/", "application/json",
+		strings.NewReader(`{"version":"1.2","type":"settings"}`))
+	if err != nil {
+		t.Fatalf("HTTPS settings request failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", resp.StatusCode, body)
+	}
+	if resp.TLS == nil {
+		t.Error("Expected a TLS connection")
+	}
+	var settings types.SettingsResponse
+	if err := json.Unmarshal(body, &settings); err != nil {
+		t.Errorf("Expected a settings response, got %s: %v", body, err)
+	}
+
+	cancel()
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Errorf("Expected clean shutdown, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("serve did not return after cancel")
+	}
+}
+
+func TestRunWithConfigRequiresCertAndKey(t *testing.T) {
+	err := RunWithConfig(ServerConfig{Addr: "127.0.0.1:0", TLSCertFile: "cert.pem"}, newTestBot("/", "", "", "hi"))
+	if err == nil || !strings.Contains(err.Error(), "TLSKeyFile") {
+		t.Errorf("Expected an error about the missing key, got %v", err)
+	}
+}
+
+// echoBot echoes the last message, like examples/echo_bot
+type echoBot struct {
+	*BasePoeBot
+}
+
+func (b *echoBot) GetResponse(ctx context.Context, req *types.QueryRequest) <-chan types.BotEvent {
+	ch := make(chan types.BotEvent, 2)
+	go func() {
+		defer close(ch)
+		if len(req.Query) == 0 {
+			ch <- &types.PartialResponse{Text: "No message received"}
+			return
+		}
+		ch <- &types.PartialResponse{Text: "You said: " + req.Query[len(req.Query)-1].Content}
+		ch <- &types.PartialResponse{Text: "Again?", IsSuggestedReply: true}
+	}()
+	return ch
+}
+
+func TestRunQueryForTest(t *testing.T) {
+	bot := &echoBot{BasePoeBot: NewBasePoeBot("/", "", "")}
+
+	events := RunQueryForTest(bot, &types.QueryRequest{
+		Query: []types.ProtocolMessage{{Role: "user", Content: "ping"}},
+	})
+
+	if len(events) != 2 {
+		t.Fatalf("Expected 2 events, got %d", len(events))
+	}
+	first, ok := events[0].(*types.PartialResponse)
+	if !ok || first.Text != "You said: ping" {
+		t.Errorf("Expected echo response, got %#v", events[0])
+	}
+	second, ok := events[1].(*types.PartialResponse)
+	if !ok || !second.IsSuggestedReply {
+		t.Errorf("Expected suggested reply, got %#v", events[1])
+	}
+}
+
+func TestCollectEvents(t *testing.T) {
+	ch := make(chan types.BotEvent, 2)
+	ch <- &types.PartialResponse{Text: "a"}
+	ch <- &types.DataResponse{Metadata: "m"}
+	close(ch)
+
+	events := CollectEvents(ch)
+	if len(events) != 2 {
+		t.Fatalf("Expected 2 events, got %d", len(events))
+	}
+	if _, ok := events[1].(*types.DataResponse); !ok {
+		t.Errorf("Expected DataResponse second, got %T", events[1])
+	}
+}
+
+func TestFetchAttachmentContentSizeLimits(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/big.txt":
+			// Streamed without Content-Length to exercise the body limit
+			w.Header().Set("Content-Type", "text/plain")
+			flusher := w.(http.Flusher)
+			chunk := strings.Repeat("a", 1024)
+			for i := 0; i < 64; i++ {
+				if _, err := io.WriteString(w, chunk); err != nil {
+					return
+				}
+				flusher.Flush()
+			}
+		case "/big.png":
+			w.Header().Set("Content-Type", "image/png")
+			w.Header().Set("Content-Length", "4096")
+			w.Write(make([]byte, 4096))
+		case "/small.txt":
+			w.Header().Set("Content-Type", "text/plain")
+			io.WriteString(w, "hello")
+		}
+	}))
+	defer ts.Close()
+
+	opts := &FetchAttachmentOptions{
+		SizeLimits: map[string]int64{
+			"text/*":    2048,
+			"image/png": 1024,
+		},
+	}
+	ctx := context.Background()
+
+	_, err := FetchAttachmentContent(ctx, types.Attachment{URL: ts.URL + "/big.txt", ContentType: "text/plain"}, opts)
+	var tooLarge *AttachmentTooLargeError
+	if !errors.As(err, &tooLarge) {
+		t.Fatalf("Expected AttachmentTooLargeError for text, got %v", err)
+	}
+	if tooLarge.Limit != 2048 {
+		t.Errorf("Expected text limit 2048, got %d", tooLarge.Limit)
+	}
+
+	_, err = FetchAttachmentContent(ctx, types.Attachment{URL: ts.URL + "/big.png", ContentType: "image/png"}, opts)
+	if !errors.As(err, &tooLarge) {
+		t.Fatalf("Expected AttachmentTooLargeError for image, got %v", err)
+	}
+	if tooLarge.Limit != 1024 {
+		t.Errorf("Expected image limit 1024, got %d", tooLarge.Limit)
+	}
+
+	// Content type falls back to the response header
+	data, err := FetchAttachmentContent(ctx, types.Attachment{URL: ts.URL + "/small.txt"}, opts)
+	if err != nil {
+		t.Fatalf("Expected small attachment to download, got %v", err)
+	}
+	if string(data) != "hello" {
+		t.Errorf("Expected 'hello', got %q", data)
+	}
+}
+
+// controlsBot returns settings with nested conditional parameter controls
+type controlsBot struct {
+	*BasePoeBot
+}
+
+func (b *controlsBot) GetSettings(ctx context.Context, req *types.SettingsRequest) (*types.SettingsResponse, error) {
+	settings := types.NewSettingsResponse()
+	defaultModel := "fast"
+	settings.ParameterControls = &types.ParameterControls{
+		APIVersion: "2",
+		Sections: []types.Section{{
+			Controls: []types.FullControl{
+				types.NewFullControl(types.DropDown{
+					Control:       "drop_down",
+					Label:         "Model",
+					ParameterName: "model",
+					DefaultValue:  &defaultModel,
+					Options:       []types.ValueNamePair{{Value: "fast", Name: "Fast"}, {Value: "smart", Name: "Smart"}},
+				}),
+				types.NewFullControl(types.ConditionallyRenderControls{
+					Control: "condition",
+					Condition: types.ComparatorCondition{
+						Comparator: "eq",
+						Left:       types.ParameterValue{ParameterName: "model"},
+						Right:      types.LiteralValue{Literal: "smart"},
+					},
+					Controls: []types.BaseControl{
+						types.NewBaseControl(types.Slider{
+							Control:       "slider",
+							Label:         "Depth",
+							ParameterName: "depth",
+							MinValue:      1,
+							MaxValue:      5,
+							Step:          1,
+						}),
+					},
+				}),
+			},
+		}},
+	}
+	return settings, nil
+}
+
+func TestSyncSettingsWithParameterControls(t *testing.T) {
+	var received map[string]any
+	var path string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		json.NewDecoder(r.Body).Decode(&received)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	bot := &controlsBot{BasePoeBot: NewBasePoeBot("/", "key", "controls")}
+	if err := syncSettingsForBot(context.Background(), bot, ts.URL+"/"); err != nil {
+		t.Fatalf("syncSettingsForBot failed: %v", err)
+	}
+	if path != "/update_settings/controls/key/"+types.ProtocolVersion {
+		t.Errorf("Unexpected sync path: %s", path)
+	}
+
+	pc, ok := received["parameter_controls"].(map[string]any)
+	if !ok {
+		t.Fatalf("Expected parameter_controls object, got %v", received["parameter_controls"])
+	}
+	sections := pc["sections"].([]any)
+	controls := sections[0].(map[string]any)["controls"].([]any)
+	if len(controls) != 2 {
+		t.Fatalf("Expected 2 controls, got %d", len(controls))
+	}
+	if controls[0].(map[string]any)["control"] != "drop_down" {
+		t.Errorf("Expected drop_down first, got %v", controls[0])
+	}
+
+	cond := controls[1].(map[string]any)
+	if cond["control"] != "condition" {
+		t.Errorf("Expected condition control, got %v", cond["control"])
+	}
+	condition := cond["condition"].(map[string]any)
+	if condition["left"].(map[string]any)["parameter_name"] != "model" {
+		t.Errorf("Expected left parameter 'model', got %v", condition["left"])
+	}
+	if condition["right"].(map[string]any)["literal"] != "smart" {
+		t.Errorf("Expected right literal 'smart', got %v", condition["right"])
+	}
+	nested := cond["controls"].([]any)
+	if len(nested) != 1 || nested[0].(map[string]any)["control"] != "slider" {
+		t.Errorf("Expected nested slider control, got %v", nested)
+	}
+
+	// The synced structure decodes back into typed controls
+	data, _ := json.Marshal(pc)
+	var decoded types.ParameterControls
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("Failed to decode synced controls: %v", err)
+	}
+	crc, ok := decoded.Sections[0].Controls[1].Underlying().(types.ConditionallyRenderControls)
+	if !ok {
+		t.Fatalf("Expected ConditionallyRenderControls, got %T", decoded.Sections[0].Controls[1].Underlying())
+	}
+	if _, ok := crc.Controls[0].Underlying().(types.Slider); !ok {
+		t.Errorf("Expected nested Slider, got %T", crc.Controls[0].Underlying())
+	}
+}
+
+func TestSuggestedReplyLabelRoundTrip(t *testing.T) {
+	bot := newEventsBot(
+		&types.PartialResponse{Text: "Tell me more about Paris", SuggestedReplyLabel: "More", IsSuggestedReply: true},
+		&types.PartialResponse{Text: "Thanks", IsSuggestedReply: true},
+	)
+	bot.path = "/bot"
+
+	ts := httptest.NewServer(MakeApp(bot))
+	defer ts.Close()
+
+	req := &types.QueryRequest{
+		BaseRequest: types.BaseRequest{Version: types.ProtocolVersion, Type: types.RequestTypeQuery},
+		Query:       []types.ProtocolMessage{{Role: "user", Content: "hi"}},
+	}
+	var replies []*types.PartialResponse
+	for msg := range client.StreamRequest(context.Background(), req, "bot", &client.StreamRequestOptions{BaseURL: ts.URL + "/"}) {
+		replies = append(replies, msg)
+	}
+
+	if len(replies) != 2 {
+		t.Fatalf("Expected 2 suggested replies, got %d", len(replies))
+	}
+	if replies[0].Text != "Tell me more about Paris" || replies[0].SuggestedReplyLabel != "More" {
+		t.Errorf("Expected labeled reply, got text=%q label=%q", replies[0].Text, replies[0].SuggestedReplyLabel)
+	}
+	if replies[1].Text != "Thanks" || replies[1].SuggestedReplyLabel != "" {
+		t.Errorf("Expected plain reply, got text=%q label=%q", replies[1].Text, replies[1].SuggestedReplyLabel)
+	}
+}
+
+func TestValidateAccessKey(t *testing.T) {
+	tests := []struct {
+		name  string
+		key   string
+		valid bool
+	}{
+		{"valid", "abcDEF1234567890abcDEF1234567890", true},
+		{"empty", "", false},
+		{"embedded newline", "abcdef\n123456", false},
+		{"trailing space", "abcdef123456 ", false},
+		{"file path", "/run/secrets/poe_key", false},
+		{"too long", strings.Repeat("a", 300), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateAccessKey(tt.key)
+			if tt.valid && err != nil {
+				t.Errorf("Expected key to be valid, got %v", err)
+			}
+			if !tt.valid && err == nil {
+				t.Error("Expected validation error, got nil")
+			}
+		})
+	}
+}
+
+func TestSetAccessKeyWarnsOnInvalidKey(t *testing.T) {
+	var buf strings.Builder
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	bot := NewBasePoeBot("/", "", "")
+	bot.SetAccessKey("line1\nline2")
+	if !strings.Contains(buf.String(), "invalid access key") {
+		t.Errorf("Expected warning for multi-line key, got log: %q", buf.String())
+	}
+	if bot.AccessKey() != "line1\nline2" {
+		t.Error("Expected key to be stored despite the warning")
+	}
+}
+
+func TestStreamEvents(t *testing.T) {
+	events := make(chan types.BotEvent, 4)
+	events <- types.NewMetaResponse()
+	events <- &types.PartialResponse{Text: "bridged"}
+	events <- types.NewErrorResponse("partial failure")
+	close(events)
+
+	w := httptest.NewRecorder()
+	StreamEvents(w, events)
+
+	if ct := w.Header().Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Expected text/event-stream, got %q", ct)
+	}
+
+	var names []string
+	for _, e := range readSSEEvents(t, w.Body.String()) {
+		names = append(names, e.Event)
+	}
+	expected := "meta,text,error,done"
+	if strings.Join(names, ",") != expected {
+		t.Errorf("Expected events %s, got %s", expected, strings.Join(names, ","))
+	}
+}
+
+func TestHandlerDoneEventPayload(t *testing.T) {
+	bot := newEventsBot(
+		&types.PartialResponse{Text: "answer"},
+		&types.DoneResponse{Data: map[string]any{"total_tokens": 42}},
+	)
+
+	events := readSSEEvents(t, serveQuery(t, botHandler(bot, nil)))
+	last := events[len(events)-1]
+	if last.Event != "done" {
+		t.Fatalf("Expected done as last event, got %q", last.Event)
+	}
+	if last.Data != `{"total_tokens":42}` {
+		t.Errorf("Expected done payload with total_tokens, got %s", last.Data)
+	}
+
+	// Default payload stays empty
+	events = readSSEEvents(t, serveQuery(t, botHandler(newEventsBot(&types.PartialResponse{Text: "x"}), nil)))
+	if events[len(events)-1].Data != "{}" {
+		t.Errorf("Expected default done payload {}, got %s", events[len(events)-1].Data)
+	}
+}
+
+func TestJSONHooksAreUsed(t *testing.T) {
+	origMarshal, origUnmarshal := types.JSONMarshal, types.JSONUnmarshal
+	defer func() { types.JSONMarshal, types.JSONUnmarshal = origMarshal, origUnmarshal }()
+
+	var marshals, unmarshals int
+	types.JSONMarshal = func(v any) ([]byte, error) {
+		marshals++
+		return origMarshal(v)
+	}
+	types.JSONUnmarshal = func(data []byte, v any) error {
+		unmarshals++
+		return origUnmarshal(data, v)
+	}
+
+	events := readSSEEvents(t, serveQuery(t, botHandler(newEventsBot(&types.PartialResponse{Text: "hi"}), nil)))
+	if len(events) != 2 || events[0].Data != `{"text":"hi"}` {
+		t.Fatalf("Unexpected events: %+v", events)
+	}
+	if marshals == 0 {
+		t.Error("Expected types.JSONMarshal to be used for events")
+	}
+	if unmarshals == 0 {
+		t.Error("Expected types.JSONUnmarshal to be used for the request")
+	}
+}
+
+// correlationBot records the correlation ID it sees and optionally forwards
+// the query to a dependency bot
+type correlationBot struct {
+	*BasePoeBot
+	mu            sync.Mutex
+	seen          string
+	dependencyURL string
+}
+
+func (b *correlationBot) GetResponse(ctx context.Context, req *types.QueryRequest) <-chan types.BotEvent {
+	b.mu.Lock()
+	b.seen = CorrelationID(ctx)
+	b.mu.Unlock()
+
+	ch := make(chan types.BotEvent)
+	go func() {
+		defer close(ch)
+		if b.dependencyURL == "" {
+			ch <- &types.PartialResponse{Text: "leaf"}
+			return
+		}
+		opts := &client.StreamRequestOptions{BaseURL: b.dependencyURL, NumTries: 1}
+		for msg := range client.StreamRequest(ctx, req, "dep", opts) {
+			ch <- &types.PartialResponse{Text: msg.Text}
+		}
+	}()
+	return ch
+}
+
+func TestCorrelationIDPropagation(t *testing.T) {
+	dep := &correlationBot{BasePoeBot: NewBasePoeBot("/dep", "", "")}
+	depServer := httptest.NewServer(MakeApp(dep))
+	defer depServer.Close()
+
+	front := &correlationBot{BasePoeBot: NewBasePoeBot("/", "", ""), dependencyURL: depServer.URL + "/"}
+
+	reqBody := `{"version":"1.2","type":"query","query":[{"role":"user","content":"hi"}],"user_id":"u1","conversation_id":"c1","message_id":"m1"}`
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(reqBody))
+	req.Header.Set("X-Correlation-ID", "trace-123")
+	w := httptest.NewRecorder()
+	botHandler(front, nil).ServeHTTP(w, req)
+
+	if !strings.Contains(w.Body.String(), `"text":"leaf"`) {
+		t.Fatalf("Expected dependency response to be forwarded, got %s", w.Body.String())
+	}
+	if front.seen != "trace-123" {
+		t.Errorf("Expected inbound correlation ID trace-123, got %q", front.seen)
+	}
+	dep.mu.Lock()
+	if dep.seen != "trace-123" {
+		t.Errorf("Expected correlation ID to reach the dependency, got %q", dep.seen)
+	}
+	dep.mu.Unlock()
+
+	// The inbound header is configurable
+	req = httptest.NewRequest(http.MethodPost, "/", strings.NewReader(reqBody))
+	req.Header.Set("X-Trace-ID", "trace-456")
+	HandlerWithOptions(front, &AppOptions{CorrelationIDHeader: "X-Trace-ID"}).ServeHTTP(httptest.NewRecorder(), req)
+	if front.seen != "trace-456" {
+		t.Errorf("Expected correlation ID from the configured header, got %q", front.seen)
+	}
+}
+
+func TestNewTestServer(t *testing.T) {
+	bot := &echoBot{BasePoeBot: NewBasePoeBot("/echo", "", "")}
+	ts, closeServer := NewTestServer(bot)
+	defer closeServer()
+
+	responses, err := client.QueryBotURL(context.Background(), ts.URL+"/echo",
+		[]types.ProtocolMessage{{Role: "user", Content: "ping"}}, nil)
+	if err != nil {
+		t.Fatalf("QueryBotURL failed: %v", err)
+	}
+	if len(responses) != 2 {
+		t.Fatalf("Expected 2 responses, got %d", len(responses))
+	}
+	if responses[0].Text != "You said: ping" {
+		t.Errorf("Expected echo response, got %q", responses[0].Text)
+	}
+	if !responses[1].IsSuggestedReply || responses[1].Text != "Again?" {
+		t.Errorf("Expected suggested reply, got %+v", responses[1])
+	}
+}
+
+func ExampleNewTestServer() {
+	bot := &echoBot{BasePoeBot: NewBasePoeBot("/", "", "")}
+	ts, closeServer := NewTestServer(bot)
+	defer closeServer()
+
+	responses, _ := client.QueryBotURL(context.Background(), ts.URL,
+		[]types.ProtocolMessage{{Role: "user", Content: "hello"}}, nil)
+	fmt.Println(responses[0].Text)
+	// Output: You said: hello
+}
+
+func TestThinkingRoundTrip(t *testing.T) {
+	bot := newEventsBot(
+		&types.PartialResponse{Text: "Let me think...", IsThinking: true},
+		&types.PartialResponse{Text: "42"},
+	)
+	ts, closeServer := NewTestServer(bot)
+	defer closeServer()
+
+	events := readSSEEvents(t, serveQuery(t, botHandler(bot, nil)))
+	if events[0].Event != "thinking" || events[0].Data != `{"text":"Let me think..."}` {
+		t.Errorf("Expected thinking event, got %+v", events[0])
+	}
+
+	responses, err := client.QueryBotURL(context.Background(), ts.URL, []types.ProtocolMessage{{Role: "user", Content: "hi"}}, nil)
+	if err != nil {
+		t.Fatalf("QueryBotURL failed: %v", err)
+	}
+	if len(responses) != 2 {
+		t.Fatalf("Expected 2 responses, got %d", len(responses))
+	}
+	if !responses[0].IsThinking || responses[0].Text != "Let me think..." {
+		t.Errorf("Expected thinking response, got %+v", responses[0])
+	}
+	if responses[1].IsThinking || responses[1].Text != "42" {
+		t.Errorf("Expected answer text, got %+v", responses[1])
+	}
+}
+
+func TestTextBufferCoalescesTextEvents(t *testing.T) {
+	bot := newEventsBot(
+		&types.PartialResponse{Text: "Hel"},
+		&types.PartialResponse{Text: "lo"},
+		&types.PartialResponse{Text: " world"},
+		&types.DataResponse{Metadata: "m"},
+		&types.PartialResponse{Text: "!"},
+		&types.PartialResponse{Text: "?"},
+	)
+	bot.SetTextBuffer(TextBuffer{Interval: time.Hour})
+
+	events := readSSEEvents(t, serveQuery(t, botHandler(bot, nil)))
+	var got []string
+	for _, e := range events {
+		got = append(got, e.Event+" "+e.Data)
+	}
+	want := []string{
+		`text {"text":"Hello world"}`,
+		`data {"metadata":"m"}`,
+		`text {"text":"!?"}`,
+		`done {}`,
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Unexpected events:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	bot.SetTextBuffer(TextBuffer{Interval: time.Hour, MaxBytes: 5})
+	events = readSSEEvents(t, serveQuery(t, botHandler(bot, nil)))
+	if events[0].Data != `{"text":"Hello"}` || events[1].Data != `{"text":" world"}` {
+		t.Errorf("Expected flush at MaxBytes, got %+v", events[:2])
+	}
+}
+
+// slowBot emits text chunks with a pause between them
+type slowBot struct {
+	*BasePoeBot
+	pause time.Duration
+}
+
+func (b *slowBot) GetResponse(ctx context.Context, req *types.QueryRequest) <-chan types.BotEvent {
+	ch := make(chan types.BotEvent)
+	go func() {
+		defer close(ch)
+		ch <- &types.PartialResponse{Text: "a"}
+		ch <- &types.PartialResponse{Text: "b"}
+		time.Sleep(b.pause)
+		ch <- &types.PartialResponse{Text: "c"}
+	}()
+	return ch
+}
+
+func TestTextBufferFlushesAfterInterval(t *testing.T) {
+	bot := &slowBot{BasePoeBot: NewBasePoeBot("/", "", ""), pause: 200 * time.Millisecond}
+	bot.SetTextBuffer(TextBuffer{Interval: 20 * time.Millisecond})
+
+	events := readSSEEvents(t, serveQuery(t, botHandler(bot, nil)))
+	if len(events) != 3 || events[0].Data != `{"text":"ab"}` || events[1].Data != `{"text":"c"}` {
+		t.Errorf("Expected text flushed within the interval, got %+v", events)
+	}
+}
+
+// headersBot records the request headers and bot query ID it sees
+type headersBot struct {
+	*BasePoeBot
+	headers    http.Header
+	botQueryID string
+}
+
+func (b *headersBot) GetResponse(ctx context.Context, req *types.QueryRequest) <-chan types.BotEvent {
+	b.headers = RequestHeaders(ctx)
+	b.botQueryID = req.BotQueryID
+	ch := make(chan types.BotEvent)
+	close(ch)
+	return ch
+}
+
+func TestRequestHeaders(t *testing.T) {
+	bot := &headersBot{BasePoeBot: NewBasePoeBot("/", "secret", "")}
+
+	reqBody := `{"version":"1.2","type":"query","query":[{"role":"user","content":"hi"}],"user_id":"u1","conversation_id":"c1","message_id":"m1"}`
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(reqBody))
+	req.Header.Set("Authorization", "Bearer secret")
+	req.Header.Set("X-Poe-User-Region", "eu")
+	req.Header.Set(BotQueryIDHeader, "q-123")
+	w := httptest.NewRecorder()
+	botHandler(bot, nil).ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+	if got := bot.headers.Get("X-Poe-User-Region"); got != "eu" {
+		t.Errorf("Expected X-Poe-User-Region header, got %q", got)
+	}
+	if got := bot.headers.Get("Authorization"); got != "" {
+		t.Errorf("Expected Authorization to be hidden, got %q", got)
+	}
+	if bot.botQueryID != "q-123" {
+		t.Errorf("Expected BotQueryID from header, got %q", bot.botQueryID)
+	}
+
+	if RequestHeaders(context.Background()) != nil {
+		t.Error("Expected nil headers outside a handler")
+	}
+}
+
+func TestDisableAutoDoneEvent(t *testing.T) {
+	bot := newEventsBot(
+		&types.PartialResponse{Text: "bridged"},
+		&types.DoneResponse{Data: map[string]any{"source": "upstream"}},
+	)
+	bot.SetEmitDoneEvent(false)
+
+	events := readSSEEvents(t, serveQuery(t, botHandler(bot, nil)))
+	var dones []sse.Event
+	for _, e := range events {
+		if e.Event == "done" {
+			dones = append(dones, e)
+		}
+	}
+	if len(dones) != 1 {
+		t.Fatalf("Expected exactly one done event, got %d: %+v", len(dones), events)
+	}
+	if dones[0].Data != `{"source":"upstream"}` || events[len(events)-1].Event != "done" {
+		t.Errorf("Expected the bot's done event last, got %+v", events)
+	}
+
+	// Without a DoneResponse, no done event is sent
+	bot = newEventsBot(&types.PartialResponse{Text: "partial"})
+	bot.SetEmitDoneEvent(false)
+	for _, e := range readSSEEvents(t, serveQuery(t, botHandler(bot, nil))) {
+		if e.Event == "done" {
+			t.Error("Expected no automatic done event")
+		}
+	}
+}
+
+func TestTextBufferMarkdownSafe(t *testing.T) {
+	bot := newEventsBot(
+		&types.PartialResponse{Text: "This is **bo"},
+		&types.PartialResponse{Text: "ld** and [a li"},
+		&types.PartialResponse{Text: "nk](https://x.io)"},
+		&types.PartialResponse{Text: " then **unfinished"},
+	)
+	bot.SetTextBuffer(TextBuffer{MarkdownSafe: true})
+
+	events := readSSEEvents(t, serveQuery(t, botHandler(bot, nil)))
+	var got []string
+	for _, e := range events {
+		got = append(got, e.Event+" "+e.Data)
+	}
+	want := []string{
+		`text {"text":"This is "}`,
+		`text {"text":"**bold** and "}`,
+		`text {"text":"[a link](https://x.io)"}`,
+		`text {"text":" then "}`,
+		`text {"text":"**unfinished"}`,
+		`done {}`,
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Unexpected events:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+// panickingBot panics while answering a query and records error reports
+type panickingBot struct {
+	*BasePoeBot
+	reports []*types.ReportErrorRequest
+}
+
+func (b *panickingBot) GetResponse(ctx context.Context, req *types.QueryRequest) <-chan types.BotEvent {
+	panic("boom")
+}
+
+func (b *panickingBot) OnError(ctx context.Context, req *types.ReportErrorRequest) error {
+	b.reports = append(b.reports, req)
+	return nil
+}
+
+func TestPanicHandler(t *testing.T) {
+	bot := &panickingBot{BasePoeBot: NewBasePoeBot("/", "", "")}
+
+	// Default handler
+	var logBuf strings.Builder
+	log.SetOutput(&logBuf)
+	defer log.SetOutput(os.Stderr)
+	events := readSSEEvents(t, serveQuery(t, botHandler(bot, nil)))
+	if len(events) != 2 || events[0].Event != "error" || events[1].Event != "done" {
+		t.Fatalf("Expected error and done events, got %+v", events)
+	}
+	if events[0].Data != `{"allow_retry":false,"error_type":"bot_internal_error","text":"The bot encountered an unexpected issue."}` {
+		t.Errorf("Unexpected default error event: %s", events[0].Data)
+	}
+	if !strings.Contains(logBuf.String(), "boom") || !strings.Contains(logBuf.String(), "panickingBot") {
+		t.Errorf("Expected panic value and stack trace to be logged, got %q", logBuf.String())
+	}
+	if len(bot.reports) != 1 {
+		t.Fatalf("Expected OnError to be called once, got %d calls", len(bot.reports))
+	}
+	report := bot.reports[0]
+	if report.Type != types.RequestTypeReportError || report.Message != "boom" {
+		t.Errorf("Unexpected error report: %+v", report)
+	}
+	if report.Metadata["error_type"] != types.ErrorBotInternalError || report.Metadata["message_id"] != "m1" {
+		t.Errorf("Unexpected error report metadata: %v", report.Metadata)
+	}
+	if stack, _ := report.Metadata["stack"].(string); !strings.Contains(stack, "panickingBot") {
+		t.Errorf("Expected the stack trace in the report, got %q", stack)
+	}
+
+	// The recovered value is only sent with DebugErrors
+	events = readSSEEvents(t, serveQuery(t, botHandler(bot, &AppOptions{DebugErrors: true})))
+	if !strings.Contains(events[0].Data, "unexpected issue: boom") {
+		t.Errorf("Expected the panic value with DebugErrors, got %s", events[0].Data)
+	}
+
+	// Custom handler
+	var gotValue any
+	var gotStack []byte
+	bot.SetPanicHandler(func(recovered any, stack []byte) (string, bool, *string) {
+		gotValue, gotStack = recovered, stack
+		errorType := "user_caused_error"
+		return "Custom failure", true, &errorType
+	})
+	events = readSSEEvents(t, serveQuery(t, botHandler(bot, nil)))
+	if events[0].Data != `{"allow_retry":true,"error_type":"user_caused_error","text":"Custom failure"}` {
+		t.Errorf("Unexpected custom error event: %s", events[0].Data)
+	}
+	if gotValue != "boom" || !strings.Contains(string(gotStack), "panickingBot") {
+		t.Errorf("Expected recovered value and stack, got %v and %q", gotValue, gotStack)
+	}
+
+	// Logged and reported whatever the handler
+	if strings.Count(logBuf.String(), "Panic in bot response: boom") != 3 || len(bot.reports) != 3 {
+		t.Errorf("Expected every panic to be logged and reported, got %d reports and log %q", len(bot.reports), logBuf.String())
+	}
+}
+
+func TestIndexDoneEvents(t *testing.T) {
+	idx := func(i int) *int { return &i }
+	bot := newEventsBot(
+		&types.PartialResponse{Text: "A1", Index: idx(0)},
+		&types.PartialResponse{Text: "B1", Index: idx(1)},
+		&types.DoneResponse{Index: idx(1)},
+		&types.PartialResponse{Text: "A2", Index: idx(0)},
+		&types.DoneResponse{Index: idx(0)},
+	)
+	ts, closeServer := NewTestServer(bot)
+	defer closeServer()
+
+	responses, err := client.QueryBotURL(context.Background(), ts.URL, []types.ProtocolMessage{{Role: "user", Content: "hi"}}, nil)
+	if err != nil {
+		t.Fatalf("QueryBotURL failed: %v", err)
+	}
+
+	var order []string
+	texts := map[int]string{}
+	for _, r := range responses {
+		if r.IsIndexDone() {
+			order = append(order, fmt.Sprintf("done %d after %q", *r.Index, texts[*r.Index]))
+			continue
+		}
+		texts[*r.Index] += r.Text
+	}
+	want := []string{`done 1 after "B1"`, `done 0 after "A1A2"`}
+	if strings.Join(order, "; ") != strings.Join(want, "; ") {
+		t.Errorf("Unexpected completion order: %v, want %v", order, want)
+	}
+}
+
+func TestDataEventRoundTrip(t *testing.T) {
+	metadata := `{"trace":"abc","items":[1,2]}`
+	bot := newEventsBot(
+		&types.DataResponse{Metadata: metadata},
+		&types.PartialResponse{Text: "Hello"},
+	)
+	ts, closeServer := NewTestServer(bot)
+	defer closeServer()
+
+	responses, err := client.QueryBotURL(context.Background(), ts.URL, []types.ProtocolMessage{{Role: "user", Content: "hi"}}, nil)
+	if err != nil {
+		t.Fatalf("QueryBotURL failed: %v", err)
+	}
+
+	var data *types.DataResponse
+	var text string
+	for _, r := range responses {
+		if d, ok := r.RawResponse.(*types.DataResponse); ok {
+			data = d
+			continue
+		}
+		text += r.Text
+	}
+	if data == nil {
+		t.Fatal("Expected a DataResponse from the data event")
+	}
+	if data.Metadata != metadata {
+		t.Errorf("Expected metadata %q, got %q", metadata, data.Metadata)
+	}
+	if text != "Hello" {
+		t.Errorf("Expected text 'Hello', got %q", text)
+	}
+}
+
+func TestJSONEvent(t *testing.T) {
+	bot := newEventsBot(
+		&types.JSONResponse{Data: map[string]any{"stage": "search", "progress": 0.5}},
+		&types.PartialResponse{Text: "Hello"},
+	)
+
+	body := serveQuery(t, botHandler(bot, nil))
+	expected := "event: json\ndata: {\"progress\":0.5,\"stage\":\"search\"}\n\n"
+	if !strings.Contains(body, expected) {
+		t.Errorf("Expected %q in SSE stream, got: %s", expected, body)
+	}
+
+	ts, closeServer := NewTestServer(bot)
+	defer closeServer()
+	responses, err := client.QueryBotURL(context.Background(), ts.URL, []types.ProtocolMessage{{Role: "user", Content: "hi"}}, nil)
+	if err != nil {
+		t.Fatalf("QueryBotURL failed: %v", err)
+	}
+	if len(responses) == 0 || responses[0].Data["stage"] != "search" || responses[0].Text != "" {
+		t.Errorf("Expected the json data first, got %+v", responses)
+	}
+}
+
+// dependencyBot calls another bot with the query context, so the client's log
+// lines belong to the same request
+type dependencyBot struct {
+	*BasePoeBot
+	dependencyURL string
+}
+
+func (b *dependencyBot) GetResponse(ctx context.Context, req *types.QueryRequest) <-chan types.BotEvent {
+	ch := make(chan types.BotEvent)
+	go func() {
+		defer close(ch)
+		opts := &client.StreamRequestOptions{BaseURL: b.dependencyURL, NumTries: 1}
+		for range client.StreamRequest(ctx, req, "Dependency", opts) {
+		}
+		ch <- &types.PartialResponse{Text: "done"}
+	}()
+	return ch
+}
+
+func TestRequestIDInLogs(t *testing.T) {
+	dependency := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "event: error\ndata: {\"allow_retry\": false, \"text\": \"unavailable\"}\n\n")
+	}))
+	defer dependency.Close()
+	bot := &dependencyBot{BasePoeBot: NewBasePoeBot("/", "", ""), dependencyURL: dependency.URL}
+
+	var logBuf strings.Builder
+	log.SetOutput(&logBuf)
+	defer log.SetOutput(os.Stderr)
+
+	query := func(header, requestID string) (string, []string) {
+		logBuf.Reset()
+		reqBody := `{"version":"1.2","type":"query","query":[{"role":"user","content":"hi"}],"user_id":"u1","conversation_id":"c1","message_id":"m1"}`
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(reqBody))
+		if requestID != "" {
+			req.Header.Set(header, requestID)
+		}
+		w := httptest.NewRecorder()
+		opts := &AppOptions{}
+		if header != "X-Request-ID" {
+			opts.RequestIDHeader = header
+		}
+		botHandler(bot, opts).ServeHTTP(w, req)
+		return w.Header().Get(header), strings.Split(strings.TrimSpace(logBuf.String()), "\n")
+	}
+
+	checkLines := func(id string, lines []string) {
+		t.Helper()
+		var sawClient bool
+		for _, line := range lines {
+			if !strings.Contains(line, "[request_id="+id+"] ") {
+				t.Errorf("Log line without request ID %q: %q", id, line)
+			}
+			if strings.Contains(line, "Bot request to Dependency") {
+				sawClient = true
+			}
+		}
+		if !sawClient {
+			t.Errorf("Expected a client log line, got %q", lines)
+		}
+	}
+
+	id, lines := query("X-Request-ID", "")
+	if id == "" {
+		t.Fatal("Expected a generated request ID in the response header")
+	}
+	checkLines(id, lines)
+
+	id, lines = query("X-Request-ID", "req-123")
+	if id != "req-123" {
+		t.Errorf("Expected the inbound request ID to be echoed, got %q", id)
+	}
+	checkLines("req-123", lines)
+
+	id, lines = query("X-Trace-ID", "trace-123")
+	if id != "trace-123" {
+		t.Errorf("Expected the request ID in the configured header, got %q", id)
+	}
+	checkLines("trace-123", lines)
+}
+
+func TestHandlerIgnoresPath(t *testing.T) {
+	bot := newTestBot("/bot", "", "", "Hello from anywhere")
+	handler := Handler(bot)
+
+	reqBody := `{"version":"1.2","type":"query","query":[{"role":"user","content":"hi"}],"user_id":"u1","conversation_id":"c1","message_id":"m1"}`
+	for _, path := range []string{"/", "/prod/my-bot", "/2015-03-31/functions/bot/invocations"} {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(reqBody))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200 at %s, got %d", path, w.Code)
+		}
+		if !strings.Contains(w.Body.String(), "Hello from anywhere") {
+			t.Errorf("Expected bot response at %s, got %q", path, w.Body.String())
+		}
+	}
+}
+
+// countingTransport counts the requests sent through it
+type countingTransport struct {
+	requests int
+}
+
+func (c *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	c.requests++
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestCostRequestWithOptions(t *testing.T) {
+	var paths []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "event: result\ndata: {\"status\": \"success\"}\n\n")
+	}))
+	defer ts.Close()
+
+	transport := &countingTransport{}
+	opts := &CostRequestOptions{BaseURL: ts.URL + "/", HTTPClient: &http.Client{Transport: transport}}
+	amounts := []types.CostItem{{AmountUSDMilliCents: 1000}}
+
+	if err := AuthorizeCostWithOptions(context.Background(), "key", "q1", amounts, opts); err != nil {
+		t.Errorf("AuthorizeCost failed: %v", err)
+	}
+	if err := CaptureCostWithOptions(context.Background(), "key", "q1", amounts, opts); err != nil {
+		t.Errorf("CaptureCost failed: %v", err)
+	}
+	if transport.requests != 2 {
+		t.Errorf("Expected the injected client to send 2 requests, got %d", transport.requests)
+	}
+	if want := []string{"/bot/cost/q1/authorize", "/bot/cost/q1/capture"}; strings.Join(paths, ",") != strings.Join(want, ",") {
+		t.Errorf("Expected paths %v, got %v", want, paths)
+	}
+}
+
+func TestCostRequestCancelled(t *testing.T) {
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	err := CaptureCostWithOptions(ctx, "key", "q1", []types.CostItem{{AmountUSDMilliCents: 1000}}, &CostRequestOptions{BaseURL: ts.URL + "/"})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected a cancellation error, got %v", err)
+	}
+}
+
+func TestCostRequestTransportError(t *testing.T) {
+	ts := httptest.NewServer(http.NotFoundHandler())
+	url := ts.URL + "/"
+	ts.Close()
+
+	err := CaptureCostWithOptions(context.Background(), "key", "q1", []types.CostItem{{AmountUSDMilliCents: 1000}}, &CostRequestOptions{BaseURL: url})
+	var costErr *CostRequestError
+	if !errors.As(err, &costErr) {
+		t.Fatalf("Expected a CostRequestError, got %T: %v", err, err)
+	}
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) {
+		t.Errorf("Expected the network error to be unwrappable, got %v", err)
+	}
+}
+
+func TestCostRequestResults(t *testing.T) {
+	tests := []struct {
+		name  string
+		serve func(w http.ResponseWriter)
+		check func(t *testing.T, err error)
+	}{
+		{
+			name: "success",
+			serve: func(w http.ResponseWriter) {
+				fmt.Fprint(w, "event: ping\ndata: {}\n\nevent: result\ndata: {\"status\": \"success\"}\n\n")
+			},
+			check: func(t *testing.T, err error) {
+				if err != nil {
+					t.Errorf("Expected success, got %v", err)
+				}
+			},
+		},
+		{
+			name: "insufficient funds",
+			serve: func(w http.ResponseWriter) {
+				fmt.Fprint(w, "event: result\ndata: {\"status\": \"insufficient_funds\"}\n\n")
+			},
+			check: func(t *testing.T, err error) {
+				var fundErr *InsufficientFundError
+				if !errors.As(err, &fundErr) || fundErr.Status != "insufficient_funds" {
+					t.Errorf("Expected InsufficientFundError with the status, got %#v", err)
+				}
+			},
+		},
+		{
+			name: "other failure",
+			serve: func(w http.ResponseWriter) {
+				fmt.Fprint(w, "event: result\ndata: {\"status\": \"rejected\"}\n\n")
+			},
+			check: func(t *testing.T, err error) {
+				var costErr *CostRequestError
+				if !errors.As(err, &costErr) || costErr.Status != "rejected" {
+					t.Errorf("Expected CostRequestError with status 'rejected', got %#v", err)
+				}
+			},
+		},
+		{
+			name: "stream error",
+			serve: func(w http.ResponseWriter) {
+				// Promise more body than is sent, then drop the connection
+				w.Header().Set("Content-Length", "1000")
+				w.WriteHeader(http.StatusOK)
+				fmt.Fprint(w, "event: ping\ndata: {}\n\n")
+				w.(http.Flusher).Flush()
+				conn, _, err := http.NewResponseController(w).Hijack()
+				if err == nil {
+					conn.Close()
+				}
+			},
+			check: func(t *testing.T, err error) {
+				var costErr *CostRequestError
+				if !errors.As(err, &costErr) || costErr.Cause == nil {
+					t.Errorf("Expected CostRequestError wrapping the read error, got %#v", err)
+				}
+				if !errors.Is(err, io.ErrUnexpectedEOF) {
+					t.Errorf("Expected the read error to be unexpected EOF, got %v", err)
+				}
+			},
+		},
+		{
+			name:  "no result",
+			serve: func(w http.ResponseWriter) { fmt.Fprint(w, "event: ping\ndata: {}\n\n") },
+			check: func(t *testing.T, err error) {
+				var costErr *CostRequestError
+				if !errors.As(err, &costErr) {
+					t.Errorf("Expected CostRequestError, got %#v", err)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				tt.serve(w)
+			}))
+			defer ts.Close()
+			err := CaptureCost(context.Background(), "key", "q1", []types.CostItem{{AmountUSDMilliCents: 1000}}, ts.URL+"/")
+			tt.check(t, err)
+		})
+	}
+}
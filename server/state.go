@@ -0,0 +1,36 @@
+package server
+
+import (
+	"context"
+
+	"github.com/n0madic/go-poe/types"
+)
+
+type conversationStateKey struct{}
+
+// ConversationState returns the per-conversation state loaded by StateStore.LoadState.
+// Bots may read and modify the map inside GetResponse; changes are passed to
+// StateStore.SaveState once the response channel is closed.
+// Returns nil when called outside of a query.
+func ConversationState(ctx context.Context) map[string]any {
+	state, _ := ctx.Value(conversationStateKey{}).(map[string]any)
+	return state
+}
+
+// loadConversationState calls LoadState and stores the result in the context.
+// The returned bool reports whether the state should be saved afterwards.
+func loadConversationState(ctx context.Context, store StateStore, conversationID string) (context.Context, map[string]any, bool) {
+	if store == nil {
+		return context.WithValue(ctx, conversationStateKey{}, map[string]any{}), nil, false
+	}
+	state, err := store.LoadState(conversationID)
+	if err != nil {
+		types.Logf(ctx, "Error loading state for conversation %s: %v", conversationID, err)
+		// Don't save over state we failed to read
+		return context.WithValue(ctx, conversationStateKey{}, map[string]any{}), nil, false
+	}
+	if state == nil {
+		state = make(map[string]any)
+	}
+	return context.WithValue(ctx, conversationStateKey{}, state), state, true
+}
@@ -0,0 +1,39 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/n0madic/go-poe/types"
+)
+
+// CollectEvents drains ch and returns all events in order
+func CollectEvents(ch <-chan types.BotEvent) []types.BotEvent {
+	var events []types.BotEvent
+	for event := range ch {
+		events = append(events, event)
+	}
+	return events
+}
+
+// RunQueryForTest calls bot.GetResponse the way the handler does (including
+// attachment message insertion) and returns all emitted events.
+// It is intended for unit tests of GetResponse implementations.
+func RunQueryForTest(bot PoeBot, req *types.QueryRequest) []types.BotEvent {
+	if bot.ShouldInsertAttachmentMessages() {
+		req = insertBotAttachmentMessages(bot, req)
+	}
+	return CollectEvents(bot.GetResponse(context.Background(), req))
+}
+
+// NewTestServer starts an httptest.Server serving bot at bot.Path() with the
+// same handler as MakeApp, but without syncing settings. Query it with
+// client.QueryBotURL at the server URL plus the bot's path. The returned
+// func shuts the server down.
+func NewTestServer(bot PoeBot) (*httptest.Server, func()) {
+	mux := http.NewServeMux()
+	mux.Handle(bot.Path(), botHandler(bot, nil))
+	ts := httptest.NewServer(mux)
+	return ts, ts.Close
+}
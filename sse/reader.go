@@ -11,11 +11,20 @@ type Reader struct {
 	scanner *bufio.Scanner
 }
 
-// NewReader creates a new SSE Reader
+// NewReader creates a new SSE Reader. Lines longer than bufio.MaxScanTokenSize
+// (64KB) fail with bufio.ErrTooLong; use NewReaderSize for larger lines.
 func NewReader(r io.Reader) *Reader {
 	return &Reader{scanner: bufio.NewScanner(r)}
 }
 
+// NewReaderSize creates a new SSE Reader accepting lines of up to
+// maxLineBytes bytes, e.g. a data line carrying a large JSON payload
+func NewReaderSize(r io.Reader, maxLineBytes int) *Reader {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, min(maxLineBytes, bufio.MaxScanTokenSize)), maxLineBytes)
+	return &Reader{scanner: scanner}
+}
+
 // ReadEvent reads the next SSE event from the stream.
 // Returns io.EOF when the stream is exhausted.
 func (r *Reader) ReadEvent() (Event, error) {
@@ -24,7 +33,8 @@ func (r *Reader) ReadEvent() (Event, error) {
 	hasData := false
 
 	for r.scanner.Scan() {
-		line := r.scanner.Text()
+		// bufio.ScanLines drops the \n but keeps the \r of a CRLF ending
+		line := strings.TrimSuffix(r.scanner.Text(), "\r")
 
 		// Empty line means end of event
 		if line == "" {
@@ -1,12 +1,17 @@
 package sse
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"errors"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestReader(t *testing.T) {
@@ -345,3 +350,146 @@ func TestReaderWriterRoundTrip(t *testing.T) {
 		}
 	}
 }
+
+func TestReaderSize(t *testing.T) {
+	data := `{"blob":"` + strings.Repeat("x", 200*1024) + `"}`
+	stream := "event: json\ndata: " + data + "\n\nevent: done\ndata: {}\n\n"
+
+	// The default reader rejects the long line
+	if _, err := NewReader(strings.NewReader(stream)).ReadEvent(); !errors.Is(err, bufio.ErrTooLong) {
+		t.Errorf("expected bufio.ErrTooLong from NewReader, got %v", err)
+	}
+
+	reader := NewReaderSize(strings.NewReader(stream), 1024*1024)
+	event, err := reader.ReadEvent()
+	if err != nil {
+		t.Fatalf("read error: %v", err)
+	}
+	if event.Event != "json" || event.Data != data {
+		t.Errorf("unexpected event %q with %d bytes of data", event.Event, len(event.Data))
+	}
+	if event, err = reader.ReadEvent(); err != nil || event.Event != "done" {
+		t.Errorf("expected done event, got %+v, %v", event, err)
+	}
+}
+
+func TestReaderCRLF(t *testing.T) {
+	lf := "event: text\ndata: {\"text\": \"hi\"}\nid: 1\n\n: comment\ndata: line1\ndata: line2\n\nevent: done\ndata: {}\n\n"
+	crlf := strings.ReplaceAll(lf, "\n", "\r\n")
+
+	readAll := func(stream string) []Event {
+		reader := NewReader(strings.NewReader(stream))
+		var events []Event
+		for {
+			event, err := reader.ReadEvent()
+			if err == io.EOF {
+				return events
+			}
+			if err != nil {
+				t.Fatalf("read error: %v", err)
+			}
+			events = append(events, event)
+		}
+	}
+
+	want, got := readAll(lf), readAll(crlf)
+	if len(want) != 3 {
+		t.Fatalf("expected 3 events from the LF stream, got %d", len(want))
+	}
+	if len(got) != len(want) {
+		t.Fatalf("expected %d events from the CRLF stream, got %d: %+v", len(want), len(got), got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("event %d: got %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestWriterComment(t *testing.T) {
+	rec := httptest.NewRecorder()
+	writer := NewWriter(rec)
+
+	if err := writer.WriteComment("thinking"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := writer.WritePing(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := writer.WriteComment("two\nlines"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := writer.WriteEvent(Event{Event: "done", Data: "{}"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := ": thinking\n\n: ping\n\n: two\n: lines\n\nevent: done\ndata: {}\n\n"
+	if got := rec.Body.String(); got != expected {
+		t.Errorf("expected:\n%q\ngot:\n%q", expected, got)
+	}
+
+	// Readers skip comments
+	event, err := NewReader(strings.NewReader(expected)).ReadEvent()
+	if err != nil || event.Event != "done" {
+		t.Errorf("expected comments to be skipped, got %+v, %v", event, err)
+	}
+}
+
+// syncRecorder is an httptest.ResponseRecorder whose body can be read while
+// another goroutine writes
+type syncRecorder struct {
+	*httptest.ResponseRecorder
+	mu sync.Mutex
+}
+
+func (r *syncRecorder) Write(b []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.ResponseRecorder.Write(b)
+}
+
+func (r *syncRecorder) String() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.Body.String()
+}
+
+func TestWriterKeepalive(t *testing.T) {
+	rec := &syncRecorder{ResponseRecorder: httptest.NewRecorder()}
+	writer := NewWriter(rec)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- writer.Keepalive(ctx, 5*time.Millisecond) }()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for strings.Count(rec.String(), ": ping\n\n") < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected pings while the context is active")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("expected nil after cancel, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected Keepalive to stop on cancel")
+	}
+
+	// No pings are written after Keepalive returns
+	pings := strings.Count(rec.String(), ": ping\n\n")
+	time.Sleep(20 * time.Millisecond)
+	if after := strings.Count(rec.String(), ": ping\n\n"); after != pings {
+		t.Errorf("expected no pings after cancel, got %d more", after-pings)
+	}
+
+	// A failing write stops it with the error
+	failing := &Writer{w: &errorWriter{}}
+	if err := failing.Keepalive(context.Background(), time.Millisecond); err == nil {
+		t.Error("expected the write error")
+	}
+}
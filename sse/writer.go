@@ -1,14 +1,20 @@
 package sse
 
 import (
+	"context"
 	"fmt"
 	"net/http"
+	"strings"
+	"sync"
+	"time"
 )
 
-// Writer writes Server-Sent Events to an http.ResponseWriter
+// Writer writes Server-Sent Events to an http.ResponseWriter. It is safe to
+// write from several goroutines, e.g. events alongside Keepalive.
 type Writer struct {
 	w       http.ResponseWriter
 	flusher http.Flusher
+	mu      sync.Mutex
 }
 
 // NewWriter creates a new SSE Writer and sets appropriate headers.
@@ -23,6 +29,8 @@ func NewWriter(w http.ResponseWriter) *Writer {
 
 // WriteEvent writes a single SSE event and flushes
 func (sw *Writer) WriteEvent(e Event) error {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
 	if e.ID != "" {
 		if _, err := fmt.Fprintf(sw.w, "id: %s\n", e.ID); err != nil {
 			return err
@@ -41,3 +49,46 @@ func (sw *Writer) WriteEvent(e Event) error {
 	}
 	return nil
 }
+
+// WriteComment writes text as a comment and flushes. Clients ignore comments,
+// but they keep idle connections from being dropped by proxies. Each line of
+// a multi-line text becomes its own comment line.
+func (sw *Writer) WriteComment(text string) error {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	for _, line := range strings.Split(text, "\n") {
+		if _, err := fmt.Fprintf(sw.w, ": %s\n", line); err != nil {
+			return err
+		}
+	}
+	if _, err := fmt.Fprint(sw.w, "\n"); err != nil {
+		return err
+	}
+	if sw.flusher != nil {
+		sw.flusher.Flush()
+	}
+	return nil
+}
+
+// WritePing writes a ": ping" comment
+func (sw *Writer) WritePing() error {
+	return sw.WriteComment("ping")
+}
+
+// Keepalive writes a ping every interval until ctx is done, then returns nil,
+// or until a write fails, returning the error. Run it in its own goroutine
+// while a slow response is produced.
+func (sw *Writer) Keepalive(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if err := sw.WritePing(); err != nil {
+				return err
+			}
+		}
+	}
+}
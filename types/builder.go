@@ -0,0 +1,102 @@
+package types
+
+import (
+	"maps"
+	"slices"
+)
+
+// QueryBuilder builds a QueryRequest with the protocol version and query type
+// filled in:
+//
+//	req := types.NewQueryBuilder().
+//	    WithMessages(types.ProtocolMessage{Role: "user", Content: "Hi"}).
+//	    WithUserID("u1").
+//	    WithTemperature(0.2).
+//	    Build()
+type QueryBuilder struct {
+	req QueryRequest
+}
+
+// NewQueryBuilder returns a builder for a query request of ProtocolVersion
+func NewQueryBuilder() *QueryBuilder {
+	return &QueryBuilder{req: QueryRequest{
+		BaseRequest: BaseRequest{Version: ProtocolVersion, Type: RequestTypeQuery},
+	}}
+}
+
+// WithMessages appends messages to the query
+func (b *QueryBuilder) WithMessages(messages ...ProtocolMessage) *QueryBuilder {
+	b.req.Query = append(b.req.Query, messages...)
+	return b
+}
+
+// WithUserID sets the user ID
+func (b *QueryBuilder) WithUserID(id Identifier) *QueryBuilder {
+	b.req.UserID = id
+	return b
+}
+
+// WithConversationID sets the conversation ID
+func (b *QueryBuilder) WithConversationID(id Identifier) *QueryBuilder {
+	b.req.ConversationID = id
+	return b
+}
+
+// WithMessageID sets the message ID
+func (b *QueryBuilder) WithMessageID(id Identifier) *QueryBuilder {
+	b.req.MessageID = id
+	return b
+}
+
+// WithTemperature sets the sampling temperature
+func (b *QueryBuilder) WithTemperature(t float64) *QueryBuilder {
+	b.req.Temperature = &t
+	return b
+}
+
+// WithLogitBias sets the logit bias by token
+func (b *QueryBuilder) WithLogitBias(bias map[string]float64) *QueryBuilder {
+	b.req.LogitBias = bias
+	return b
+}
+
+// WithStopSequences appends stop sequences
+func (b *QueryBuilder) WithStopSequences(stops ...string) *QueryBuilder {
+	b.req.StopSequences = append(b.req.StopSequences, stops...)
+	return b
+}
+
+// WithSkipSystemPrompt sets whether the bot's system prompt is skipped
+func (b *QueryBuilder) WithSkipSystemPrompt(skip bool) *QueryBuilder {
+	b.req.SkipSystemPrompt = skip
+	return b
+}
+
+// WithLanguageCode sets the user's language code
+func (b *QueryBuilder) WithLanguageCode(code string) *QueryBuilder {
+	b.req.LanguageCode = code
+	return b
+}
+
+// WithMetadata sets the request metadata
+func (b *QueryBuilder) WithMetadata(metadata string) *QueryBuilder {
+	b.req.Metadata = metadata
+	return b
+}
+
+// WithTools appends tool definitions
+func (b *QueryBuilder) WithTools(tools ...ToolDefinition) *QueryBuilder {
+	b.req.Tools = append(b.req.Tools, tools...)
+	return b
+}
+
+// Build returns a new request with the fields set so far. The builder can
+// be reused; later calls do not change requests already built.
+func (b *QueryBuilder) Build() *QueryRequest {
+	req := b.req
+	req.Query = slices.Clone(b.req.Query)
+	req.StopSequences = slices.Clone(b.req.StopSequences)
+	req.Tools = slices.Clone(b.req.Tools)
+	req.LogitBias = maps.Clone(b.req.LogitBias)
+	return &req
+}
@@ -2,8 +2,10 @@ package types
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"math"
+	"strings"
 )
 
 // CostItem represents a cost item for authorization and charge requests
@@ -12,6 +14,36 @@ type CostItem struct {
 	Description         *string `json:"description,omitempty"`
 }
 
+// NewCostItem returns a CostItem for milliCents (1/1000 of a US cent) with an
+// optional description. Negative amounts are rejected.
+func NewCostItem(milliCents int, description string) (CostItem, error) {
+	if milliCents < 0 {
+		return CostItem{}, fmt.Errorf("cost amount must not be negative, got %d", milliCents)
+	}
+	item := CostItem{AmountUSDMilliCents: milliCents}
+	if description != "" {
+		item.Description = &description
+	}
+	return item, nil
+}
+
+// ValidateCostItems checks that items is non-empty, that no amount is
+// negative and that descriptions, when set, are not blank
+func ValidateCostItems(items []CostItem) error {
+	if len(items) == 0 {
+		return errors.New("no cost items")
+	}
+	for i, item := range items {
+		if item.AmountUSDMilliCents < 0 {
+			return fmt.Errorf("cost item %d: amount must not be negative, got %d", i, item.AmountUSDMilliCents)
+		}
+		if item.Description != nil && strings.TrimSpace(*item.Description) == "" {
+			return fmt.Errorf("cost item %d: description is blank", i)
+		}
+	}
+	return nil
+}
+
 // costItemJSON is the JSON representation for custom unmarshaling
 type costItemJSON struct {
 	AmountUSDMilliCents json.Number `json:"amount_usd_milli_cents"`
@@ -0,0 +1,12 @@
+package types
+
+import "encoding/json"
+
+// JSONMarshal and JSONUnmarshal are used by the client and server packages to
+// encode and decode protocol messages. They default to encoding/json and may be
+// replaced at startup with a compatible implementation. They must not be
+// changed while requests are in flight.
+var (
+	JSONMarshal   func(v any) ([]byte, error)    = json.Marshal
+	JSONUnmarshal func(data []byte, v any) error = json.Unmarshal
+)
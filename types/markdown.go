@@ -0,0 +1,107 @@
+package types
+
+import "strings"
+
+// inlineDelimiters are markdown delimiters that must come in pairs
+var inlineDelimiters = []string{"**", "__", "~~", "`"}
+
+// SafeMarkdownBoundary returns the length of the longest prefix of text that
+// can be sent without ending inside an unfinished inline markdown construct:
+// bold (** or __), strikethrough (~~), inline code (`) or a link or image
+// ([label](url)). A trailing character that may start such a construct is
+// held back as well. Inside an open fenced code block, where inline markup
+// does not apply, the prefix ends at the last complete line.
+//
+// Streaming code can send text[:n] and keep the rest until more text arrives.
+func SafeMarkdownBoundary(text string) int {
+	// Skip closed fenced code blocks; inside an open one only hold back the
+	// current line
+	scanFrom := 0
+	for {
+		start := strings.Index(text[scanFrom:], "```")
+		if start < 0 {
+			break
+		}
+		start += scanFrom
+		end := strings.Index(text[start+3:], "```")
+		if end < 0 {
+			if nl := strings.LastIndexByte(text, '\n'); nl > start {
+				return nl + 1
+			}
+			return start
+		}
+		scanFrom = start + 3 + end + 3
+	}
+
+	segment := text[scanFrom:]
+	cut := len(segment)
+	for _, delim := range inlineDelimiters {
+		if i := unmatchedDelimiter(segment, delim); i >= 0 && i < cut {
+			cut = i
+		}
+	}
+	if i := openLinkStart(segment); i >= 0 && i < cut {
+		cut = i
+	}
+	if cut == len(segment) && cut > 0 {
+		// A lone trailing delimiter character may grow into a construct
+		last := segment[cut-1]
+		prev := byte(0)
+		if cut > 1 {
+			prev = segment[cut-2]
+		}
+		switch {
+		case last == '!' || last == '\\':
+			cut--
+		case (last == '*' || last == '_' || last == '~') && prev != last:
+			cut--
+		}
+	}
+	return scanFrom + cut
+}
+
+// unmatchedDelimiter returns the index of the last opening delim without a
+// closing one, or -1 if every occurrence is paired
+func unmatchedDelimiter(text, delim string) int {
+	open := -1
+	for i := 0; i <= len(text)-len(delim); {
+		if text[i:i+len(delim)] != delim {
+			i++
+			continue
+		}
+		if open < 0 {
+			open = i
+		} else {
+			open = -1
+		}
+		i += len(delim)
+	}
+	return open
+}
+
+// openLinkStart returns the index where an unfinished link or image starts,
+// or -1 if the last link is complete
+func openLinkStart(text string) int {
+	i := strings.LastIndexByte(text, '[')
+	if i < 0 {
+		return -1
+	}
+	start := i
+	if i > 0 && text[i-1] == '!' {
+		start = i - 1
+	}
+	rest := text[i:]
+	closeBracket := strings.IndexByte(rest, ']')
+	if closeBracket < 0 {
+		return start
+	}
+	after := rest[closeBracket+1:]
+	if after == "" {
+		// The URL part may still follow
+		return start
+	}
+	if after[0] == '(' && !strings.Contains(after, ")") {
+		return start
+	}
+	return -1
+}
@@ -0,0 +1,94 @@
+package types
+
+import (
+	"strings"
+	"time"
+)
+
+// WithReference returns a copy of msg that replies to ref
+func WithReference(msg, ref ProtocolMessage) ProtocolMessage {
+	msg.ReferencedMessage = &ref
+	return msg
+}
+
+// ReferenceChain walks referenced_message links starting at msg and returns
+// the messages in order: msg, the message it replies to, and so on.
+// Cyclic references are followed only once.
+func ReferenceChain(msg ProtocolMessage) []ProtocolMessage {
+	chain := []ProtocolMessage{msg}
+	seen := make(map[*ProtocolMessage]bool)
+	for ref := msg.ReferencedMessage; ref != nil && !seen[ref]; ref = ref.ReferencedMessage {
+		seen[ref] = true
+		chain = append(chain, *ref)
+	}
+	return chain
+}
+
+// BranchConversation returns a copy of query truncated after the message with
+// MessageID fromMessageID, to continue the conversation from that point, e.g.
+// to regenerate or edit a reply. It returns nil if no message has that ID.
+func BranchConversation(query []ProtocolMessage, fromMessageID string) []ProtocolMessage {
+	for i, msg := range query {
+		if msg.MessageID != "" && msg.MessageID == fromMessageID {
+			branch := make([]ProtocolMessage, i+1)
+			copy(branch, query[:i+1])
+			return branch
+		}
+	}
+	return nil
+}
+
+// UserByID returns the participant of a multi-user chat with the given ID
+// from Users. A message's author is found by its SenderID, or Sender.ID when
+// only Sender is set; both hold a User.ID.
+func (r *QueryRequest) UserByID(id string) (*User, bool) {
+	for i := range r.Users {
+		if r.Users[i].ID == id {
+			return &r.Users[i], true
+		}
+	}
+	return nil, false
+}
+
+// WithTimestamps returns a copy of messages in which every message without a
+// Timestamp is stamped with now, in unix milliseconds
+func WithTimestamps(messages []ProtocolMessage, now time.Time) []ProtocolMessage {
+	stamped := make([]ProtocolMessage, len(messages))
+	copy(stamped, messages)
+	for i := range stamped {
+		if stamped[i].Timestamp == 0 {
+			stamped[i].Timestamp = now.UnixMilli()
+		}
+	}
+	return stamped
+}
+
+// FormatTranscript renders the messages of req as a human-readable transcript
+// for logs and debugging: one "role: content" entry per message, with the
+// sender name when known and one indented line per attachment.
+func FormatTranscript(req *QueryRequest) string {
+	if req == nil {
+		return ""
+	}
+	var b strings.Builder
+	for i, msg := range req.Query {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		b.WriteString(msg.Role)
+		if msg.Sender != nil && msg.Sender.Name != nil && *msg.Sender.Name != "" {
+			b.WriteString(" (" + *msg.Sender.Name + ")")
+		}
+		b.WriteString(": ")
+		b.WriteString(strings.ReplaceAll(msg.Content, "\n", "\n  "))
+		b.WriteString("\n")
+		for _, att := range msg.Attachments {
+			b.WriteString("  [attachment: " + att.Name)
+			if att.ContentType != "" {
+				b.WriteString(", " + att.ContentType)
+			}
+			b.WriteString("]\n")
+		}
+	}
+	return b.String()
+}
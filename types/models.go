@@ -20,7 +20,8 @@ type Sender struct {
 	Name *string `json:"name,omitempty"`
 }
 
-// User in a chat
+// User in a chat, listed in QueryRequest.Users. Messages refer to their
+// author by SenderID and Sender.ID; see QueryRequest.UserByID.
 type User struct {
 	ID   Identifier `json:"id"`
 	Name *string    `json:"name,omitempty"`
@@ -107,7 +108,7 @@ type ReportErrorRequest struct {
 // ParseRawRequest parses a raw JSON request and returns the type field
 func ParseRawRequest(data []byte) (RequestType, json.RawMessage, error) {
 	var base BaseRequest
-	if err := json.Unmarshal(data, &base); err != nil {
+	if err := JSONUnmarshal(data, &base); err != nil {
 		return "", nil, err
 	}
 	return base.Type, json.RawMessage(data), nil
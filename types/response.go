@@ -7,20 +7,35 @@ type BotEvent interface {
 
 // PartialResponse is the primary response type yielded during streaming
 type PartialResponse struct {
-	Text              string                    `json:"text"`
-	Data              map[string]any            `json:"data,omitempty"`
-	RawResponse       any                       `json:"raw_response,omitempty"`
-	FullPrompt        *string                   `json:"full_prompt,omitempty"`
-	RequestID         *string                   `json:"request_id,omitempty"`
-	IsSuggestedReply  bool                      `json:"is_suggested_reply,omitempty"`
-	IsReplaceResponse bool                      `json:"is_replace_response,omitempty"`
-	Attachment        *Attachment               `json:"attachment,omitempty"`
-	ToolCalls         []ToolCallDefinitionDelta `json:"tool_calls,omitempty"`
-	Index             *int                      `json:"index,omitempty"`
+	Text                string                    `json:"text"`
+	Data                map[string]any            `json:"data,omitempty"`
+	DataArray           []any                     `json:"data_array,omitempty"` // json event data with a top-level array
+	RawResponse         any                       `json:"raw_response,omitempty"`
+	FullPrompt          *string                   `json:"full_prompt,omitempty"`
+	RequestID           *string                   `json:"request_id,omitempty"`
+	IsSuggestedReply    bool                      `json:"is_suggested_reply,omitempty"`
+	SuggestedReplyLabel string                    `json:"suggested_reply_label,omitempty"`
+	IsReplaceResponse   bool                      `json:"is_replace_response,omitempty"`
+	IsThinking          bool                      `json:"is_thinking,omitempty"`
+	Attachment          *Attachment               `json:"attachment,omitempty"`
+	ToolCalls           []ToolCallDefinitionDelta `json:"tool_calls,omitempty"`
+	AggregatedToolCalls []ToolCallDefinition      `json:"aggregated_tool_calls,omitempty"`
+	Index               *int                      `json:"index,omitempty"`
 }
 
 func (r *PartialResponse) isBotEvent() {}
 
+// IsIndexDone reports whether the response marks its Index as complete
+func (r *PartialResponse) IsIndexDone() bool {
+	return r.Index != nil && r.Data != nil && r.Data["event"] == IndexDoneEvent
+}
+
+// IsClearResponse reports whether the response is a replace_response with
+// empty text, which clears all previously streamed text
+func (r *PartialResponse) IsClearResponse() bool {
+	return r.IsReplaceResponse && r.Text == ""
+}
+
 // ErrorResponse is similar to PartialResponse for communicating errors
 type ErrorResponse struct {
 	PartialResponse
@@ -45,6 +60,8 @@ type MetaResponse struct {
 	SuggestedReplies bool        `json:"suggested_replies"`
 	ContentType      ContentType `json:"content_type"`
 	RefetchSettings  bool        `json:"refetch_settings,omitempty"`
+	// Extra holds meta fields not covered above, for forward compatibility
+	Extra map[string]any `json:"extra,omitempty"`
 }
 
 func (r *MetaResponse) isBotEvent() {}
@@ -65,6 +82,31 @@ type DataResponse struct {
 
 func (r *DataResponse) isBotEvent() {}
 
+// JSONResponse carries structured side-channel data, sent as a json event.
+// The client delivers it as a PartialResponse with Data set and no text.
+type JSONResponse struct {
+	Data map[string]any `json:"data"`
+}
+
+func (r *JSONResponse) isBotEvent() {}
+
+// DoneResponse sets the payload of the final done event, e.g. a usage summary.
+// If several are emitted, the last one wins.
+//
+// With Index set, it instead marks that response index as complete while
+// other indices may still be streaming. This is sent as a json event with
+// Data["event"] == IndexDoneEvent, see PartialResponse.IsIndexDone.
+type DoneResponse struct {
+	Data  map[string]any `json:"data,omitempty"`
+	Index *int           `json:"index,omitempty"`
+}
+
+// IndexDoneEvent is the "event" value of the json event marking one response
+// index as complete
+const IndexDoneEvent = "index_done"
+
+func (r *DoneResponse) isBotEvent() {}
+
 // SettingsResponse is the bot's response to a settings request
 type SettingsResponse struct {
 	ResponseVersion              *int               `json:"response_version,omitempty"`
@@ -0,0 +1,284 @@
+package types
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// OverrideOptions configures SettingsResponse.ApplyOverridesWithOptions
+type OverrideOptions struct {
+	// IgnoreUnknown skips keys that are not settings fields instead of
+	// returning an error
+	IgnoreUnknown bool
+}
+
+// ApplyOverrides sets the fields named by the JSON keys of overrides, e.g.
+// settings loaded from a config file. Values must have the field's JSON type
+// and unknown keys are an error. On error the settings are left unchanged.
+func (s *SettingsResponse) ApplyOverrides(overrides map[string]any) error {
+	return s.ApplyOverridesWithOptions(overrides, OverrideOptions{})
+}
+
+// ApplyOverridesWithOptions is ApplyOverrides with configurable handling of
+// unknown keys
+func (s *SettingsResponse) ApplyOverridesWithOptions(overrides map[string]any, opts OverrideOptions) error {
+	fields := settingsFieldIndex()
+
+	known := make(map[string]any, len(overrides))
+	var unknown []string
+	for key, value := range overrides {
+		if _, ok := fields[key]; ok {
+			known[key] = value
+		} else {
+			unknown = append(unknown, key)
+		}
+	}
+	if len(unknown) > 0 && !opts.IgnoreUnknown {
+		sort.Strings(unknown)
+		return fmt.Errorf("unknown settings: %s", strings.Join(unknown, ", "))
+	}
+
+	data, err := json.Marshal(known)
+	if err != nil {
+		return fmt.Errorf("invalid settings overrides: %w", err)
+	}
+	var parsed SettingsResponse
+	if err := json.Unmarshal(data, &parsed); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) {
+			return fmt.Errorf("invalid value for %s: expected %s, got %s", typeErr.Field, typeErr.Type, typeErr.Value)
+		}
+		return fmt.Errorf("invalid settings overrides: %w", err)
+	}
+
+	dst := reflect.ValueOf(s).Elem()
+	src := reflect.ValueOf(parsed)
+	for key := range known {
+		i := fields[key]
+		dst.Field(i).Set(src.Field(i))
+	}
+	return nil
+}
+
+// settingsFieldIndex maps the JSON names of SettingsResponse fields to their index
+func settingsFieldIndex() map[string]int {
+	t := reflect.TypeOf(SettingsResponse{})
+	fields := make(map[string]int, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name != "" && name != "-" {
+			fields[name] = i
+		}
+	}
+	return fields
+}
+
+// ToMap returns the settings as a map keyed by JSON field name, holding the
+// set fields with pointers dereferenced. It marshals to the same JSON as the
+// settings, e.g. for syncing them or inspecting the effective settings.
+func (s *SettingsResponse) ToMap() (map[string]any, error) {
+	if s == nil {
+		return nil, errors.New("settings are nil")
+	}
+	v := reflect.ValueOf(s).Elem()
+	m := make(map[string]any)
+	for name, i := range settingsFieldIndex() {
+		field := v.Field(i)
+		switch field.Kind() {
+		case reflect.Pointer:
+			if field.IsNil() {
+				continue
+			}
+			m[name] = field.Elem().Interface()
+		case reflect.Map, reflect.Slice:
+			// omitempty skips empty maps and slices as well as nil ones
+			if field.Len() == 0 {
+				continue
+			}
+			m[name] = field.Interface()
+		default:
+			return nil, fmt.Errorf("unsupported settings field %s of kind %s", name, field.Kind())
+		}
+	}
+	return m, nil
+}
+
+// AssertSettingsRoundTrip marshals settings to JSON, unmarshals the result
+// and marshals it again, and returns an error naming the first path whose
+// JSON differs between the two encodings. It is intended for tests guarding
+// against fields, such as parameter controls, that do not survive decoding.
+func AssertSettingsRoundTrip(settings *SettingsResponse) error {
+	first, err := json.Marshal(settings)
+	if err != nil {
+		return fmt.Errorf("failed to marshal settings: %w", err)
+	}
+	var decoded SettingsResponse
+	if err := json.Unmarshal(first, &decoded); err != nil {
+		return fmt.Errorf("failed to unmarshal settings: %w", err)
+	}
+	second, err := json.Marshal(&decoded)
+	if err != nil {
+		return fmt.Errorf("failed to marshal decoded settings: %w", err)
+	}
+
+	var want, got any
+	if err := json.Unmarshal(first, &want); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(second, &got); err != nil {
+		return err
+	}
+	if diff := jsonDiff("settings", want, got); diff != "" {
+		return fmt.Errorf("settings do not round-trip: %s", diff)
+	}
+	return nil
+}
+
+// jsonDiff describes the first difference between two decoded JSON values,
+// or returns "" if they are equal
+func jsonDiff(path string, want, got any) string {
+	switch w := want.(type) {
+	case map[string]any:
+		g, ok := got.(map[string]any)
+		if !ok {
+			return fmt.Sprintf("%s: got %s, want an object", path, jsonString(got))
+		}
+		keys := make([]string, 0, len(w)+len(g))
+		for k := range w {
+			keys = append(keys, k)
+		}
+		for k := range g {
+			if _, ok := w[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			wv, wok := w[k]
+			gv, gok := g[k]
+			switch {
+			case !gok:
+				return fmt.Sprintf("%s.%s: missing after round trip, want %s", path, k, jsonString(wv))
+			case !wok:
+				return fmt.Sprintf("%s.%s: unexpected %s after round trip", path, k, jsonString(gv))
+			}
+			if diff := jsonDiff(path+"."+k, wv, gv); diff != "" {
+				return diff
+			}
+		}
+		return ""
+	case []any:
+		g, ok := got.([]any)
+		if !ok {
+			return fmt.Sprintf("%s: got %s, want an array", path, jsonString(got))
+		}
+		if len(w) != len(g) {
+			return fmt.Sprintf("%s: got %d elements, want %d", path, len(g), len(w))
+		}
+		for i := range w {
+			if diff := jsonDiff(fmt.Sprintf("%s[%d]", path, i), w[i], g[i]); diff != "" {
+				return diff
+			}
+		}
+		return ""
+	default:
+		if want != got {
+			return fmt.Sprintf("%s: got %s, want %s", path, jsonString(got), jsonString(want))
+		}
+		return ""
+	}
+}
+
+func jsonString(v any) string {
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+// The setters below store the address of a copy of their argument in the
+// pointer field of the same name and return s, so they can be chained:
+//
+//	settings := types.NewSettingsResponse().
+//	    SetIntroductionMessage("Hello!").
+//	    SetAllowAttachments(true)
+
+// SetResponseVersion sets the settings response version
+func (s *SettingsResponse) SetResponseVersion(n int) *SettingsResponse {
+	s.ResponseVersion = &n
+	return s
+}
+
+// SetContextClearWindowSecs sets the inactivity in seconds after which the context is cleared
+func (s *SettingsResponse) SetContextClearWindowSecs(n int) *SettingsResponse {
+	s.ContextClearWindowSecs = &n
+	return s
+}
+
+// SetAllowUserContextClear sets whether users can clear the context
+func (s *SettingsResponse) SetAllowUserContextClear(v bool) *SettingsResponse {
+	s.AllowUserContextClear = &v
+	return s
+}
+
+// SetCustomRateCard sets the custom rate card
+func (s *SettingsResponse) SetCustomRateCard(v string) *SettingsResponse {
+	s.CustomRateCard = &v
+	return s
+}
+
+// SetAllowAttachments sets whether users can send attachments
+func (s *SettingsResponse) SetAllowAttachments(v bool) *SettingsResponse {
+	s.AllowAttachments = &v
+	return s
+}
+
+// SetIntroductionMessage sets the message shown when a conversation starts
+func (s *SettingsResponse) SetIntroductionMessage(v string) *SettingsResponse {
+	s.IntroductionMessage = &v
+	return s
+}
+
+// SetExpandTextAttachments sets whether text attachments are expanded into the query
+func (s *SettingsResponse) SetExpandTextAttachments(v bool) *SettingsResponse {
+	s.ExpandTextAttachments = &v
+	return s
+}
+
+// SetEnableImageComprehension sets whether image comprehension is enabled
+func (s *SettingsResponse) SetEnableImageComprehension(v bool) *SettingsResponse {
+	s.EnableImageComprehension = &v
+	return s
+}
+
+// SetEnforceAuthorRoleAlternation sets whether user and bot messages must alternate
+func (s *SettingsResponse) SetEnforceAuthorRoleAlternation(v bool) *SettingsResponse {
+	s.EnforceAuthorRoleAlternation = &v
+	return s
+}
+
+// SetEnableMultiBotChatPrompting sets whether multi-bot chat prompting is enabled
+func (s *SettingsResponse) SetEnableMultiBotChatPrompting(v bool) *SettingsResponse {
+	s.EnableMultiBotChatPrompting = &v
+	return s
+}
+
+// SetEnableMultiEntityPrompting sets whether multi-entity prompting is enabled
+func (s *SettingsResponse) SetEnableMultiEntityPrompting(v bool) *SettingsResponse {
+	s.EnableMultiEntityPrompting = &v
+	return s
+}
+
+// SetRateCard sets the rate card
+func (s *SettingsResponse) SetRateCard(v string) *SettingsResponse {
+	s.RateCard = &v
+	return s
+}
+
+// SetCostLabel sets the cost label
+func (s *SettingsResponse) SetCostLabel(v string) *SettingsResponse {
+	s.CostLabel = &v
+	return s
+}
@@ -0,0 +1,23 @@
+package types
+
+import "strings"
+
+// ApplyStopSequences truncates text at the earliest occurrence of any of the
+// stop sequences, as in QueryRequest.StopSequences, and reports whether one
+// was found. The stop sequence itself is not included. Empty stop sequences
+// are ignored.
+func ApplyStopSequences(text string, stops []string) (string, bool) {
+	cut := -1
+	for _, stop := range stops {
+		if stop == "" {
+			continue
+		}
+		if i := strings.Index(text, stop); i >= 0 && (cut < 0 || i < cut) {
+			cut = i
+		}
+	}
+	if cut < 0 {
+		return text, false
+	}
+	return text[:cut], true
+}
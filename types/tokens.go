@@ -0,0 +1,32 @@
+package types
+
+import "unicode/utf8"
+
+// messageTokenOverhead approximates the tokens used by role and message framing
+const messageTokenOverhead = 4
+
+// ApproxTokenCount estimates the token count of text as one token per four characters
+func ApproxTokenCount(text string) int {
+	return (utf8.RuneCountInString(text) + 3) / 4
+}
+
+// EstimateTokens returns a rough token estimate for messages using ApproxTokenCount
+func EstimateTokens(messages []ProtocolMessage) int {
+	return EstimateTokensWith(messages, ApproxTokenCount)
+}
+
+// EstimateTokensWith estimates the token count for messages using the given
+// tokenizer for message content and parsed attachment content, plus a small
+// fixed overhead per message
+func EstimateTokensWith(messages []ProtocolMessage, tokenize func(text string) int) int {
+	total := 0
+	for _, msg := range messages {
+		total += messageTokenOverhead + tokenize(msg.Content)
+		for _, att := range msg.Attachments {
+			if att.ParsedContent != nil {
+				total += tokenize(*att.ParsedContent)
+			}
+		}
+	}
+	return total
+}
@@ -1,5 +1,12 @@
 package types
 
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+)
+
 // ParametersDefinition defines parameters for function calling
 type ParametersDefinition struct {
 	Type       string         `json:"type"`
@@ -67,3 +74,62 @@ type CustomCallDefinition struct {
 	Name  string `json:"name"`
 	Input string `json:"input"`
 }
+
+// toolNamePattern matches function names accepted by OpenAI-compatible APIs
+var toolNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
+// ValidateToolDefinitions checks that tool definitions are well-formed:
+// type "function", a valid unique name, an "object" parameters schema,
+// and required parameters that are declared in properties.
+func ValidateToolDefinitions(tools []ToolDefinition) error {
+	names := make(map[string]bool, len(tools))
+	for i, tool := range tools {
+		if tool.Type != "function" {
+			return fmt.Errorf("tool %d: unsupported type %q, expected \"function\"", i, tool.Type)
+		}
+		name := tool.Function.Name
+		if !toolNamePattern.MatchString(name) {
+			return fmt.Errorf("tool %d: invalid function name %q", i, name)
+		}
+		if names[name] {
+			return fmt.Errorf("tool %d: duplicate function name %q", i, name)
+		}
+		names[name] = true
+		params := tool.Function.Parameters
+		if params.Type != "object" {
+			return fmt.Errorf("tool %q: parameters type must be \"object\", got %q", name, params.Type)
+		}
+		for _, req := range params.Required {
+			if _, ok := params.Properties[req]; !ok {
+				return fmt.Errorf("tool %q: required parameter %q is not defined in properties", name, req)
+			}
+		}
+	}
+	return nil
+}
+
+// LoadToolDefinitions reads a JSON array of tool definitions and validates them
+func LoadToolDefinitions(r io.Reader) ([]ToolDefinition, error) {
+	var tools []ToolDefinition
+	if err := json.NewDecoder(r).Decode(&tools); err != nil {
+		return nil, fmt.Errorf("failed to decode tool definitions: %w", err)
+	}
+	if err := ValidateToolDefinitions(tools); err != nil {
+		return nil, err
+	}
+	return tools, nil
+}
+
+// WriteToolDefinitions writes tool definitions as an indented JSON array
+// that can be read back with LoadToolDefinitions
+func WriteToolDefinitions(w io.Writer, tools []ToolDefinition) error {
+	if err := ValidateToolDefinitions(tools); err != nil {
+		return err
+	}
+	if tools == nil {
+		tools = []ToolDefinition{}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(tools)
+}
@@ -32,6 +32,7 @@ const (
 	ErrorInsufficientFund          ErrorType = "insufficient_fund"
 	ErrorUserCausedError           ErrorType = "user_caused_error"
 	ErrorPrivacyAuthorizationError ErrorType = "privacy_authorization_error"
+	ErrorBotInternalError          ErrorType = "bot_internal_error"
 )
 
 // RequestType constants
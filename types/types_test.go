@@ -1,7 +1,10 @@
 package types
 
 import (
+	"bytes"
 	"encoding/json"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -263,6 +266,49 @@ func TestCostItemFloatCeiling(t *testing.T) {
 	}
 }
 
+// TestNewCostItem tests cost item construction and validation
+func TestNewCostItem(t *testing.T) {
+	item, err := NewCostItem(1000, "Image generation")
+	if err != nil {
+		t.Fatalf("NewCostItem failed: %v", err)
+	}
+	if item.AmountUSDMilliCents != 1000 || item.Description == nil || *item.Description != "Image generation" {
+		t.Errorf("Unexpected cost item: %+v", item)
+	}
+
+	item, err = NewCostItem(0, "")
+	if err != nil || item.Description != nil {
+		t.Errorf("Expected free item without description, got %+v, %v", item, err)
+	}
+
+	if _, err := NewCostItem(-1, "refund"); err == nil {
+		t.Error("Expected error for negative amount")
+	}
+}
+
+// TestValidateCostItems tests cost item list validation
+func TestValidateCostItems(t *testing.T) {
+	desc := "Tokens"
+	blank := "  "
+	tests := []struct {
+		name    string
+		items   []CostItem
+		wantErr bool
+	}{
+		{"valid", []CostItem{{AmountUSDMilliCents: 10, Description: &desc}, {AmountUSDMilliCents: 0}}, false},
+		{"empty", nil, true},
+		{"negative amount", []CostItem{{AmountUSDMilliCents: 10}, {AmountUSDMilliCents: -5}}, true},
+		{"blank description", []CostItem{{AmountUSDMilliCents: 10, Description: &blank}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidateCostItems(tt.items); (err != nil) != tt.wantErr {
+				t.Errorf("ValidateCostItems() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
 // TestBaseControlUnionMarshalUnmarshal tests BaseControl discriminated union
 func TestBaseControlUnionMarshalUnmarshal(t *testing.T) {
 	tests := []struct {
@@ -459,6 +505,7 @@ func TestBotEventInterface(t *testing.T) {
 	var _ BotEvent = &ErrorResponse{}
 	var _ BotEvent = &MetaResponse{}
 	var _ BotEvent = &DataResponse{}
+	var _ BotEvent = &JSONResponse{}
 }
 
 // TestParseRawRequest tests ParseRawRequest function
@@ -488,3 +535,630 @@ func TestParseRawRequest(t *testing.T) {
 func ptr(i int) *int {
 	return &i
 }
+
+// TestLoadToolDefinitionsRoundTrip tests loading and writing a multi-tool JSON document
+func TestLoadToolDefinitionsRoundTrip(t *testing.T) {
+	doc := `[
+  {
+    "type": "function",
+    "function": {
+      "name": "get_weather",
+      "description": "Get the current weather",
+      "parameters": {
+        "type": "object",
+        "properties": {"location": {"type": "string"}},
+        "required": ["location"]
+      }
+    }
+  },
+  {
+    "type": "function",
+    "function": {
+      "name": "get_time",
+      "description": "Get the current time",
+      "parameters": {"type": "object", "properties": {}}
+    }
+  }
+]`
+
+	tools, err := LoadToolDefinitions(strings.NewReader(doc))
+	if err != nil {
+		t.Fatalf("LoadToolDefinitions failed: %v", err)
+	}
+	if len(tools) != 2 {
+		t.Fatalf("Expected 2 tools, got %d", len(tools))
+	}
+	if tools[0].Function.Name != "get_weather" || tools[1].Function.Name != "get_time" {
+		t.Errorf("Unexpected tool names: %q, %q", tools[0].Function.Name, tools[1].Function.Name)
+	}
+
+	var buf bytes.Buffer
+	if err := WriteToolDefinitions(&buf, tools); err != nil {
+		t.Fatalf("WriteToolDefinitions failed: %v", err)
+	}
+	reloaded, err := LoadToolDefinitions(&buf)
+	if err != nil {
+		t.Fatalf("Reloading written tools failed: %v", err)
+	}
+	if !reflect.DeepEqual(tools, reloaded) {
+		t.Errorf("Round trip mismatch:\n got %+v\nwant %+v", reloaded, tools)
+	}
+}
+
+// TestLoadToolDefinitionsValidation tests that invalid tool documents are rejected
+func TestLoadToolDefinitionsValidation(t *testing.T) {
+	tests := []struct {
+		name string
+		doc  string
+	}{
+		{"invalid json", `[{"type": "function"`},
+		{"wrong type", `[{"type": "retrieval", "function": {"name": "a", "parameters": {"type": "object"}}}]`},
+		{"empty name", `[{"type": "function", "function": {"name": "", "parameters": {"type": "object"}}}]`},
+		{"bad name", `[{"type": "function", "function": {"name": "get weather", "parameters": {"type": "object"}}}]`},
+		{"duplicate name", `[{"type": "function", "function": {"name": "a", "parameters": {"type": "object"}}},
+			{"type": "function", "function": {"name": "a", "parameters": {"type": "object"}}}]`},
+		{"non-object parameters", `[{"type": "function", "function": {"name": "a", "parameters": {"type": "string"}}}]`},
+		{"undeclared required", `[{"type": "function", "function": {"name": "a", "parameters": {"type": "object", "properties": {}, "required": ["x"]}}}]`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := LoadToolDefinitions(strings.NewReader(tt.doc)); err == nil {
+				t.Error("Expected validation error, got nil")
+			}
+		})
+	}
+}
+
+// TestPartialResponseIsClearResponse tests detection of clearing replace responses
+func TestPartialResponseIsClearResponse(t *testing.T) {
+	if !(&PartialResponse{IsReplaceResponse: true}).IsClearResponse() {
+		t.Error("Expected empty replace response to be a clear")
+	}
+	if (&PartialResponse{IsReplaceResponse: true, Text: "new"}).IsClearResponse() {
+		t.Error("Replace response with text is not a clear")
+	}
+	if (&PartialResponse{}).IsClearResponse() {
+		t.Error("Empty text response is not a clear")
+	}
+}
+
+// TestEstimateTokens tests the token estimate heuristic
+func TestEstimateTokens(t *testing.T) {
+	if got := EstimateTokens(nil); got != 0 {
+		t.Errorf("Expected 0 tokens for no messages, got %d", got)
+	}
+
+	// 400 characters of English text is roughly 100 tokens
+	text := strings.Repeat("word ", 80)
+	got := EstimateTokens([]ProtocolMessage{{Role: "user", Content: text}})
+	if got < 90 || got > 120 {
+		t.Errorf("Expected roughly 100 tokens for 400 chars, got %d", got)
+	}
+
+	// Estimates grow monotonically as history grows
+	var messages []ProtocolMessage
+	prev := 0
+	for i := 0; i < 5; i++ {
+		messages = append(messages, ProtocolMessage{Role: "user", Content: strings.Repeat("x", i)})
+		n := EstimateTokens(messages)
+		if n <= prev {
+			t.Errorf("Expected estimate to increase after message %d: %d <= %d", i, n, prev)
+		}
+		prev = n
+	}
+
+	parsed := strings.Repeat("y", 40)
+	withAttachment := []ProtocolMessage{{
+		Role:        "user",
+		Content:     text,
+		Attachments: []Attachment{{Name: "a.txt", ParsedContent: &parsed}},
+	}}
+	if EstimateTokens(withAttachment) <= got {
+		t.Error("Expected parsed attachment content to be counted")
+	}
+}
+
+// TestEstimateTokensWith tests a pluggable tokenizer
+func TestEstimateTokensWith(t *testing.T) {
+	words := func(text string) int { return len(strings.Fields(text)) }
+	messages := []ProtocolMessage{
+		{Role: "user", Content: "one two three"},
+		{Role: "bot", Content: "four five"},
+	}
+	want := 5 + 2*messageTokenOverhead
+	if got := EstimateTokensWith(messages, words); got != want {
+		t.Errorf("Expected %d tokens, got %d", want, got)
+	}
+}
+
+// TestReferenceChain tests building and walking referenced_message chains
+func TestReferenceChain(t *testing.T) {
+	root := ProtocolMessage{Role: "user", Content: "original", MessageID: "m1"}
+	reply := WithReference(ProtocolMessage{Role: "bot", Content: "reply", MessageID: "m2"}, root)
+	nested := WithReference(ProtocolMessage{Role: "user", Content: "reply to reply", MessageID: "m3"}, reply)
+
+	if nested.ReferencedMessage == nil || nested.ReferencedMessage.MessageID != "m2" {
+		t.Fatalf("Expected nested message to reference m2, got %+v", nested.ReferencedMessage)
+	}
+
+	chain := ReferenceChain(nested)
+	var ids []string
+	for _, m := range chain {
+		ids = append(ids, m.MessageID)
+	}
+	if strings.Join(ids, ",") != "m3,m2,m1" {
+		t.Errorf("Expected chain m3,m2,m1, got %v", ids)
+	}
+
+	// Serialized chains round-trip through JSON
+	data, err := json.Marshal(nested)
+	if err != nil {
+		t.Fatalf("Failed to marshal: %v", err)
+	}
+	var decoded ProtocolMessage
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("Failed to unmarshal: %v", err)
+	}
+	if len(ReferenceChain(decoded)) != 3 {
+		t.Errorf("Expected decoded chain of length 3")
+	}
+
+	if len(ReferenceChain(root)) != 1 {
+		t.Error("Expected a message without reference to form a chain of one")
+	}
+
+	// Cycles terminate
+	a := &ProtocolMessage{MessageID: "a"}
+	b := &ProtocolMessage{MessageID: "b", ReferencedMessage: a}
+	a.ReferencedMessage = b
+	if got := len(ReferenceChain(*a)); got != 3 {
+		t.Errorf("Expected cyclic chain to stop after one loop, got %d", got)
+	}
+}
+
+// TestSafeMarkdownBoundary tests holding back unfinished markdown constructs
+func TestSafeMarkdownBoundary(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{"plain text", "Hello world", "Hello world"},
+		{"complete bold", "a **bold** word", "a **bold** word"},
+		{"mid bold", "This is **very imp", "This is "},
+		{"bold opener only", "Note: **", "Note: "},
+		{"lone trailing star", "Note: *", "Note: "},
+		{"mid strikethrough", "was ~~old", "was "},
+		{"mid inline code", "run `go te", "run "},
+		{"complete link", "see [docs](https://x.io) now", "see [docs](https://x.io) now"},
+		{"mid link label", "see [do", "see "},
+		{"link label closed", "see [docs]", "see "},
+		{"mid link url", "see [docs](https://x.", "see "},
+		{"mid image", "look ![chart](https://x.io/c", "look "},
+		{"trailing bang", "Wow!", "Wow"},
+		{"open code fence", "```go\nfmt.Println(\"**\")\nfmt.Pri", "```go\nfmt.Println(\"**\")\n"},
+		{"closed code fence", "```\na**b\n``` then **x", "```\na**b\n``` then "},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n := SafeMarkdownBoundary(tt.text)
+			if got := tt.text[:n]; got != tt.want {
+				t.Errorf("SafeMarkdownBoundary(%q) prefix = %q, want %q", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestSettingsApplyOverrides tests layering config overrides onto settings
+func TestSettingsApplyOverrides(t *testing.T) {
+	s := NewSettingsResponse()
+	err := s.ApplyOverrides(map[string]any{
+		"introduction_message":      "Bonjour!",
+		"allow_attachments":         true,
+		"context_clear_window_secs": float64(3600),
+		"server_bot_dependencies":   map[string]any{"GPT-4o": 2},
+	})
+	if err != nil {
+		t.Fatalf("ApplyOverrides failed: %v", err)
+	}
+	if s.IntroductionMessage == nil || *s.IntroductionMessage != "Bonjour!" {
+		t.Errorf("IntroductionMessage not applied: %v", s.IntroductionMessage)
+	}
+	if s.AllowAttachments == nil || !*s.AllowAttachments {
+		t.Error("AllowAttachments not applied")
+	}
+	if s.ContextClearWindowSecs == nil || *s.ContextClearWindowSecs != 3600 {
+		t.Error("ContextClearWindowSecs not applied")
+	}
+	if s.ServerBotDependencies["GPT-4o"] != 2 {
+		t.Errorf("ServerBotDependencies not applied: %v", s.ServerBotDependencies)
+	}
+	if s.ResponseVersion == nil || *s.ResponseVersion != 2 {
+		t.Error("Expected defaults to be kept")
+	}
+
+	tests := []struct {
+		name      string
+		overrides map[string]any
+		errPart   string
+	}{
+		{"wrong type", map[string]any{"allow_attachments": "yes"}, "allow_attachments"},
+		{"fractional int", map[string]any{"context_clear_window_secs": 1.5}, "context_clear_window_secs"},
+		{"unknown key", map[string]any{"introduction_message": "x", "intro_msg": "x"}, "intro_msg"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewSettingsResponse()
+			err := s.ApplyOverrides(tt.overrides)
+			if err == nil || !strings.Contains(err.Error(), tt.errPart) {
+				t.Fatalf("Expected error mentioning %q, got %v", tt.errPart, err)
+			}
+			if s.IntroductionMessage != nil || s.AllowAttachments != nil {
+				t.Error("Expected settings to be unchanged on error")
+			}
+		})
+	}
+
+	s = NewSettingsResponse()
+	err = s.ApplyOverridesWithOptions(map[string]any{"introduction_message": "Hi", "intro_msg": "x"}, OverrideOptions{IgnoreUnknown: true})
+	if err != nil || s.IntroductionMessage == nil || *s.IntroductionMessage != "Hi" {
+		t.Errorf("Expected unknown keys to be ignored, got %v", err)
+	}
+}
+
+func TestApplyStopSequences(t *testing.T) {
+	tests := []struct {
+		text  string
+		stops []string
+		want  string
+		hit   bool
+	}{
+		{"Hello\nUser: hi", []string{"\nUser:"}, "Hello", true},
+		{"one END two STOP three", []string{"STOP", "END"}, "one ", true},
+		{"no stops here", []string{"STOP", "END"}, "no stops here", false},
+		{"no stops here", nil, "no stops here", false},
+		{"empty stop", []string{""}, "empty stop", false},
+		{"STOP at start", []string{"STOP"}, "", true},
+	}
+	for _, tt := range tests {
+		got, hit := ApplyStopSequences(tt.text, tt.stops)
+		if got != tt.want || hit != tt.hit {
+			t.Errorf("ApplyStopSequences(%q, %q) = %q, %v; want %q, %v", tt.text, tt.stops, got, hit, tt.want, tt.hit)
+		}
+	}
+}
+
+func TestFormatTranscript(t *testing.T) {
+	name := "Alice"
+	req := &QueryRequest{Query: []ProtocolMessage{
+		{Role: "system", Content: "Be brief."},
+		{Role: "user", Sender: &Sender{Name: &name}, Content: "Summarize these\nplease", Attachments: []Attachment{
+			{Name: "report.pdf", ContentType: "application/pdf"},
+			{Name: "chart.png", ContentType: "image/png"},
+		}},
+		{Role: "bot", Content: "Done."},
+	}}
+
+	want := "system: Be brief.\n" +
+		"\n" +
+		"user (Alice): Summarize these\n  please\n" +
+		"  [attachment: report.pdf, application/pdf]\n" +
+		"  [attachment: chart.png, image/png]\n" +
+		"\n" +
+		"bot: Done.\n"
+	if got := FormatTranscript(req); got != want {
+		t.Errorf("FormatTranscript() =\n%s\nwant\n%s", got, want)
+	}
+	if got := FormatTranscript(nil); got != "" {
+		t.Errorf("FormatTranscript(nil) = %q, want empty", got)
+	}
+}
+
+func TestAssertSettingsRoundTrip(t *testing.T) {
+	str := func(s string) *string { return &s }
+	num := func(n Number) *Number { return &n }
+	enabled := true
+	settings := NewSettingsResponse()
+	settings.IntroductionMessage = str("Hi!")
+	settings.ParameterControls = &ParameterControls{
+		APIVersion: "2",
+		Sections: []Section{
+			{
+				Name: str("Generation"),
+				Controls: []FullControl{
+					NewFullControl(ToggleSwitch{Control: "toggle_switch", Label: "Creative", ParameterName: "creative", DefaultValue: &enabled}),
+					NewFullControl(ConditionallyRenderControls{
+						Control: "condition",
+						Condition: ComparatorCondition{
+							Comparator: "eq",
+							Left:       ParameterValue{ParameterName: "creative"},
+							Right:      LiteralValue{Literal: true},
+						},
+						Controls: []BaseControl{
+							NewBaseControl(Slider{Control: "slider", Label: "Temperature", ParameterName: "temperature", DefaultValue: num(0.7), MinValue: 0, MaxValue: 2, Step: 0.1}),
+							NewBaseControl(Divider{Control: "divider"}),
+						},
+					}),
+				},
+			},
+			{
+				Tabs: []Tab{{
+					Name: str("Image"),
+					Controls: []FullControl{
+						NewFullControl(DropDown{Control: "drop_down", Label: "Style", ParameterName: "style", Options: []ValueNamePair{{Value: "vivid", Name: "Vivid"}}}),
+						NewFullControl(AspectRatio{Control: "aspect_ratio", Label: "Size", ParameterName: "size", Options: []AspectRatioOption{{Value: str("1:1"), Width: 1, Height: 1}}}),
+					},
+				}},
+			},
+		},
+	}
+	if err := AssertSettingsRoundTrip(settings); err != nil {
+		t.Errorf("Expected settings to round-trip, got %v", err)
+	}
+
+	// A control field unknown to the decoder is lost on the way back
+	type customTextField struct {
+		Control       string `json:"control"`
+		Label         string `json:"label"`
+		ParameterName string `json:"parameter_name"`
+		MaxLength     int    `json:"max_length"`
+	}
+	settings.ParameterControls.Sections[1].Tabs[0].Controls = append(settings.ParameterControls.Sections[1].Tabs[0].Controls,
+		NewFullControl(customTextField{Control: "text_field", Label: "Prompt", ParameterName: "prompt", MaxLength: 100}))
+	err := AssertSettingsRoundTrip(settings)
+	if err == nil || !strings.Contains(err.Error(), "settings.parameter_controls.sections[1].tabs[0].controls[2].max_length: missing after round trip") {
+		t.Errorf("Expected a diff naming the lost field, got %v", err)
+	}
+}
+
+func TestBranchConversation(t *testing.T) {
+	query := []ProtocolMessage{
+		{Role: "system", Content: "Be brief."},
+		{Role: "user", Content: "Hi", MessageID: "m1"},
+		{Role: "bot", Content: "Hello!", MessageID: "m2"},
+		{Role: "user", Content: "Tell me a joke", MessageID: "m3"},
+		{Role: "bot", Content: "No.", MessageID: "m4"},
+	}
+
+	tests := []struct {
+		from string
+		want int
+	}{
+		{"m1", 2},
+		{"m3", 4},
+		{"m4", 5},
+		{"missing", 0},
+		{"", 0},
+	}
+	for _, tt := range tests {
+		branch := BranchConversation(query, tt.from)
+		if len(branch) != tt.want {
+			t.Errorf("BranchConversation(%q) returned %d messages, want %d", tt.from, len(branch), tt.want)
+			continue
+		}
+		if tt.want == 0 {
+			if branch != nil {
+				t.Errorf("BranchConversation(%q) = %v, want nil", tt.from, branch)
+			}
+			continue
+		}
+		if branch[len(branch)-1].MessageID != tt.from {
+			t.Errorf("BranchConversation(%q) ends at %q", tt.from, branch[len(branch)-1].MessageID)
+		}
+	}
+
+	// The branch does not share storage with the query
+	branch := BranchConversation(query, "m3")
+	branch[1].Content = "changed"
+	branch = append(branch, ProtocolMessage{Role: "bot", Content: "Why did..."})
+	if query[1].Content != "Hi" || query[4].Content != "No." {
+		t.Errorf("Expected the original query to be unchanged, got %+v", query)
+	}
+}
+
+func TestQueryBuilder(t *testing.T) {
+	req := NewQueryBuilder().Build()
+	if req.Version != ProtocolVersion || req.Type != RequestTypeQuery {
+		t.Errorf("Expected version %q and type query, got %q and %q", ProtocolVersion, req.Version, req.Type)
+	}
+	if req.Query != nil || req.Temperature != nil || req.UserID != "" {
+		t.Errorf("Expected no other fields set, got %+v", req)
+	}
+
+	b := NewQueryBuilder().
+		WithMessages(ProtocolMessage{Role: "system", Content: "Be brief"}).
+		WithMessages(ProtocolMessage{Role: "user", Content: "Hi"}).
+		WithUserID("u1").
+		WithConversationID("c1").
+		WithMessageID("m1").
+		WithTemperature(0.2).
+		WithLogitBias(map[string]float64{"42": -10}).
+		WithStopSequences("END").
+		WithSkipSystemPrompt(true).
+		WithLanguageCode("fr").
+		WithMetadata("meta").
+		WithTools(ToolDefinition{Type: "function", Function: FunctionDefinition{Name: "lookup"}})
+	req = b.Build()
+
+	if len(req.Query) != 2 || req.Query[0].Role != "system" || req.Query[1].Content != "Hi" {
+		t.Errorf("Unexpected messages: %+v", req.Query)
+	}
+	if req.UserID != "u1" || req.ConversationID != "c1" || req.MessageID != "m1" {
+		t.Errorf("Unexpected IDs: %q %q %q", req.UserID, req.ConversationID, req.MessageID)
+	}
+	if req.Temperature == nil || *req.Temperature != 0.2 {
+		t.Errorf("Expected temperature 0.2, got %v", req.Temperature)
+	}
+	if req.LogitBias["42"] != -10 || len(req.StopSequences) != 1 || req.StopSequences[0] != "END" {
+		t.Errorf("Unexpected logit bias or stop sequences: %v %v", req.LogitBias, req.StopSequences)
+	}
+	if !req.SkipSystemPrompt || req.LanguageCode != "fr" || req.Metadata != "meta" {
+		t.Errorf("Unexpected flags: %+v", req)
+	}
+	if len(req.Tools) != 1 || req.Tools[0].Function.Name != "lookup" {
+		t.Errorf("Unexpected tools: %+v", req.Tools)
+	}
+	if req.Version != ProtocolVersion || req.Type != RequestTypeQuery {
+		t.Errorf("Expected defaults to be kept, got %q and %q", req.Version, req.Type)
+	}
+
+	// Requests already built are not changed by reusing the builder
+	next := b.WithMessages(ProtocolMessage{Role: "user", Content: "More"}).WithTemperature(1).Build()
+	if len(req.Query) != 2 || *req.Temperature != 0.2 {
+		t.Errorf("Expected the first request to be unchanged, got %+v", req.Query)
+	}
+	if len(next.Query) != 3 || *next.Temperature != 1 {
+		t.Errorf("Expected the second request to have the new fields, got %+v", next.Query)
+	}
+}
+
+func TestUserByID(t *testing.T) {
+	alice, bob := "Alice", "Bob"
+	aliceID, bobID := "u1", "u2"
+	req := &QueryRequest{
+		Users: []User{{ID: aliceID, Name: &alice}, {ID: bobID, Name: &bob}},
+		Query: []ProtocolMessage{
+			{Role: "user", Content: "Hi all", SenderID: &aliceID},
+			{Role: "user", Content: "Hey", Sender: &Sender{ID: &bobID}},
+		},
+	}
+
+	var names []string
+	for _, msg := range req.Query {
+		id := msg.SenderID
+		if id == nil {
+			id = msg.Sender.ID
+		}
+		user, ok := req.UserByID(*id)
+		if !ok {
+			t.Fatalf("Expected user %q to be found", *id)
+		}
+		names = append(names, *user.Name)
+	}
+	if strings.Join(names, ",") != "Alice,Bob" {
+		t.Errorf("Expected Alice,Bob, got %v", names)
+	}
+
+	if user, ok := req.UserByID("u3"); ok || user != nil {
+		t.Errorf("Expected unknown user to be missing, got %v", user)
+	}
+}
+
+func TestSettingsResponseSetters(t *testing.T) {
+	s := &SettingsResponse{}
+	got := s.SetResponseVersion(2).
+		SetContextClearWindowSecs(3600).
+		SetAllowUserContextClear(true).
+		SetCustomRateCard("custom").
+		SetAllowAttachments(false).
+		SetIntroductionMessage("Hello!").
+		SetExpandTextAttachments(true).
+		SetEnableImageComprehension(true).
+		SetEnforceAuthorRoleAlternation(false).
+		SetEnableMultiBotChatPrompting(true).
+		SetEnableMultiEntityPrompting(false).
+		SetRateCard("rate").
+		SetCostLabel("label")
+	if got != s {
+		t.Fatal("Expected the setters to return the receiver")
+	}
+
+	ints := map[string]*int{"ResponseVersion": s.ResponseVersion, "ContextClearWindowSecs": s.ContextClearWindowSecs}
+	wantInts := map[string]int{"ResponseVersion": 2, "ContextClearWindowSecs": 3600}
+	for name, p := range ints {
+		if p == nil || *p != wantInts[name] {
+			t.Errorf("%s = %v, want %d", name, p, wantInts[name])
+		}
+	}
+	bools := map[string]*bool{
+		"AllowUserContextClear":        s.AllowUserContextClear,
+		"AllowAttachments":             s.AllowAttachments,
+		"ExpandTextAttachments":        s.ExpandTextAttachments,
+		"EnableImageComprehension":     s.EnableImageComprehension,
+		"EnforceAuthorRoleAlternation": s.EnforceAuthorRoleAlternation,
+		"EnableMultiBotChatPrompting":  s.EnableMultiBotChatPrompting,
+		"EnableMultiEntityPrompting":   s.EnableMultiEntityPrompting,
+	}
+	wantBools := map[string]bool{
+		"AllowUserContextClear":        true,
+		"AllowAttachments":             false,
+		"ExpandTextAttachments":        true,
+		"EnableImageComprehension":     true,
+		"EnforceAuthorRoleAlternation": false,
+		"EnableMultiBotChatPrompting":  true,
+		"EnableMultiEntityPrompting":   false,
+	}
+	for name, p := range bools {
+		if p == nil || *p != wantBools[name] {
+			t.Errorf("%s = %v, want %v", name, p, wantBools[name])
+		}
+	}
+	strs := map[string]*string{
+		"CustomRateCard":      s.CustomRateCard,
+		"IntroductionMessage": s.IntroductionMessage,
+		"RateCard":            s.RateCard,
+		"CostLabel":           s.CostLabel,
+	}
+	wantStrs := map[string]string{"CustomRateCard": "custom", "IntroductionMessage": "Hello!", "RateCard": "rate", "CostLabel": "label"}
+	for name, p := range strs {
+		if p == nil || *p != wantStrs[name] {
+			t.Errorf("%s = %v, want %q", name, p, wantStrs[name])
+		}
+	}
+
+	// Each call stores a fresh pointer
+	first := s.AllowAttachments
+	s.SetAllowAttachments(true)
+	if *first || !*s.AllowAttachments {
+		t.Error("Expected a new pointer per call")
+	}
+}
+
+func TestSettingsResponseToMap(t *testing.T) {
+	str := func(s string) *string { return &s }
+	allow := false
+	settings := NewSettingsResponse()
+	settings.IntroductionMessage = str("Hi!")
+	settings.AllowAttachments = &allow
+	settings.ServerBotDependencies = map[string]int{"GPT-4": 2, "Claude": 1}
+	settings.ParameterControls = &ParameterControls{
+		APIVersion: "2",
+		Sections: []Section{{
+			Name: str("Generation"),
+			Controls: []FullControl{
+				NewFullControl(TextField{Control: "text_field", Label: "Name", ParameterName: "name"}),
+			},
+		}},
+	}
+
+	m, err := settings.ToMap()
+	if err != nil {
+		t.Fatalf("ToMap failed: %v", err)
+	}
+	if m["response_version"] != 2 || m["allow_attachments"] != false {
+		t.Errorf("Expected dereferenced typed values, got %v and %v", m["response_version"], m["allow_attachments"])
+	}
+	if _, ok := m["rate_card"]; ok {
+		t.Error("Expected unset fields to be omitted")
+	}
+
+	decode := func(v any) map[string]any {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatalf("Marshal failed: %v", err)
+		}
+		var out map[string]any
+		if err := json.Unmarshal(data, &out); err != nil {
+			t.Fatalf("Unmarshal failed: %v", err)
+		}
+		return out
+	}
+	if want, got := decode(settings), decode(m); !reflect.DeepEqual(want, got) {
+		t.Errorf("Expected the map to marshal like the settings:\nwant %v\ngot  %v", want, got)
+	}
+
+	if _, err := (*SettingsResponse)(nil).ToMap(); err == nil {
+		t.Error("Expected an error for nil settings")
+	}
+}